@@ -1,18 +1,45 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	ttl     string
+	maxHits int64
+	mode    string
+)
+
+type createRequest struct {
+	Short   string
+	Long    string
+	TTL     string   `json:",omitempty"`
+	MaxHits int64    `json:",omitempty"`
+	Mode    string   `json:",omitempty"`
+	Group   string   `json:",omitempty"`
+	Editors []string `json:",omitempty"`
+}
+
+type createResponse struct {
+	Short string
+	URL   string
+}
+
 func add(short, long string) {
-	fmt.Printf("%v -> %v\n", short, long)
+	if short != "" {
+		fmt.Printf("%v -> %v\n", short, long)
+	}
 	create := url + "/create"
-	body := fmt.Sprintf("{ \"Short\": \"%v\", \"Long\": \"%v\" }", short, long)
-	req, err := http.NewRequest("POST", create, strings.NewReader(body))
+	body, err := json.Marshal(createRequest{Short: short, Long: long, TTL: ttl, MaxHits: maxHits, Mode: mode, Group: group, Editors: editors})
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequest("POST", create, bytes.NewReader(body))
 	if err != nil {
 		panic(err)
 	}
@@ -24,28 +51,51 @@ func add(short, long string) {
 	} else if resp.StatusCode != http.StatusOK {
 		fmt.Printf("error %v\n", resp.Status)
 	} else {
-		fmt.Println("ok")
-		resp.Body.Close()
+		defer resp.Body.Close()
+		var created createResponse
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+			fmt.Println(err.Error())
+		} else if short == "" {
+			fmt.Printf("%v -> %v\n", created.URL, long)
+		} else {
+			fmt.Println("ok")
+		}
 	}
 }
 
 var addCmd = &cobra.Command{
 	Use:   "add",
 	Short: "Create a new short URL.",
-	Long: `Create a new short URL given the short alias and the full URL
+	Long: `Create a new short URL given the short alias and the full URL. If only
+the full URL is given, a short alias is generated.
+
+Any path after the short alias is appended to the full URL, so my-url/a/b
+goes to http://my-long-url.org/with/a/path/a/b. If the full URL has
+placeholders {1}, {2}, ... they are instead filled with the path's segments.
+Query parameters are passed through.
 
-tinyr add my-url http://my-long-url.org/with/a/path`,
+tinyr add my-url http://my-long-url.org/with/a/path
+tinyr add http://my-long-url.org/with/a/path
+tinyr add --ttl 72h --max_hits 100 my-url http://my-long-url.org/with/a/path
+tinyr add jira 'https://jira.example.com/browse/{1}'
+tinyr add --group my-team --editors bob@example.com my-url http://my-long-url.org`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) != 2 {
-			fmt.Printf("Both short and long urls are required.\n")
-			return
+		switch len(args) {
+		case 1:
+			add("", args[0])
+		case 2:
+			add(args[0], args[1])
+		default:
+			fmt.Printf("A long url, and optionally a short url, is required.\n")
 		}
-		short := args[0]
-		long := args[1]
-		add(short, long)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(addCmd)
+	addCmd.PersistentFlags().StringVar(&ttl, "ttl", "", "Expire the short URL after this duration (e.g. 72h)")
+	addCmd.PersistentFlags().Int64Var(&maxHits, "max_hits", 0, "Expire the short URL after this many redirects")
+	addCmd.PersistentFlags().StringVar(&mode, "mode", "", "Redirect mode, prefix or template (default inferred from the URL)")
+	addCmd.PersistentFlags().StringVar(&group, "group", "", "Name of a group to share ownership with")
+	addCmd.PersistentFlags().StringSliceVar(&editors, "editors", nil, "Emails of users who may edit")
 }
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var backupOutput string
+
+type backupResponse struct {
+	Path string
+}
+
+func backup() {
+	if backupOutput == "" {
+		var resp backupResponse
+		if err := postJSON("/backup", nil, &resp); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		fmt.Printf("ok (%v)\n", resp.Path)
+		return
+	}
+	req, err := http.NewRequest("GET", url+"/backup/download", nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("error %v\n", resp.Status)
+		return
+	}
+	out := os.Stdout
+	if backupOutput != "-" {
+		if out, err = os.Create(backupOutput); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		defer out.Close()
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up the database",
+	Long: `Take a consistent backup of the database while the service runs. Only
+admins may take backups, and only the pebble backend supports them.
+
+Without an output file, the backup is kept in the server's backup directory;
+with one, it is downloaded as a gzipped tarball. Either can be restored by
+starting the service with -pebbleRestoreFrom and an empty -pebblePath.
+
+tinyr backup
+tinyr backup -o tinyr.tar.gz`,
+	Run: func(cmd *cobra.Command, args []string) {
+		backup()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	backupCmd.PersistentFlags().StringVarP(&backupOutput, "output", "o", "", "Tarball to download the backup to (- for stdout)")
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	version int
+)
+
+type updateRequest struct {
+	Short   string
+	Long    string
+	TTL     *string `json:",omitempty"`
+	MaxHits *int64  `json:",omitempty"`
+	Mode    *string `json:",omitempty"`
+	Version int
+}
+
+type updateResponse struct {
+	Short   string
+	Version int
+}
+
+// confirmVersion looks up the current version of short, and returns it once
+// the user confirms that it is the one to change. Without a version, changes
+// made since the user last saw short would otherwise be overwritten.
+func confirmVersion(short string) (v int, err error) {
+	q := neturl.Values{}
+	q.Set("start", short)
+	q.Set("end", short)
+	req, err := http.NewRequest("GET", url+"/list?"+q.Encode(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("error %v", resp.Status)
+		return
+	}
+	var entries []struct {
+		Short   string
+		Long    string
+		Version int
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return
+	}
+	if len(entries) != 1 || entries[0].Short != short {
+		err = fmt.Errorf("no such short url %v", short)
+		return
+	}
+	fmt.Printf("current: %v -> %v (version %v)\nchange this version? [y/N] ", short, entries[0].Long, entries[0].Version)
+	var answer string
+	fmt.Scanln(&answer)
+	if answer != "y" && answer != "yes" {
+		err = fmt.Errorf("not changed; pass --version to skip this check")
+		return
+	}
+	v = entries[0].Version
+	return
+}
+
+func edit(cmd *cobra.Command, short, long string) {
+	if version < 0 {
+		var err error
+		if version, err = confirmVersion(short); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+	fmt.Printf("%v -> %v (version %v)\n", short, long, version)
+	update := updateRequest{Short: short, Long: long, Version: version}
+	// Only send what was given; the rest is unchanged.
+	if cmd.Flags().Changed("ttl") {
+		update.TTL = &ttl
+	}
+	if cmd.Flags().Changed("max_hits") {
+		update.MaxHits = &maxHits
+	}
+	if cmd.Flags().Changed("mode") {
+		update.Mode = &mode
+	}
+	body, err := json.Marshal(update)
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequest("POST", url+"/update", bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err.Error())
+	} else if resp.StatusCode == http.StatusConflict {
+		fmt.Println("short url was changed concurrently; re-run to overwrite")
+	} else if resp.StatusCode != http.StatusOK {
+		fmt.Printf("error %v\n", resp.Status)
+	} else {
+		defer resp.Body.Close()
+		var updated updateResponse
+		if err := json.NewDecoder(resp.Body).Decode(&updated); err != nil {
+			fmt.Println(err.Error())
+		} else {
+			fmt.Printf("ok (version %v)\n", updated.Version)
+		}
+	}
+}
+
+// editCmd represents the edit command
+var editCmd = &cobra.Command{
+	Use:   "edit",
+	Short: "Change the full URL of a short URL",
+	Long: `Change the full URL that an existing short alias points to. The edit fails if
+the short URL has changed since the given version. Without one, the current
+URL is shown and must be confirmed. Limits and mode are unchanged unless
+given; an empty --ttl or --max_hits 0 removes them.
+
+tinyr edit my-url http://my-other-long-url.org/with/a/path
+tinyr edit --version 3 my-url http://my-other-long-url.org/with/a/path`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Printf("Both short and long urls are required.\n")
+			return
+		}
+		edit(cmd, args[0], args[1])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(editCmd)
+	editCmd.PersistentFlags().IntVar(&version, "version", -1, "Expected version of the short URL")
+	editCmd.PersistentFlags().StringVar(&ttl, "ttl", "", "Expire the short URL after this duration (e.g. 72h)")
+	editCmd.PersistentFlags().Int64Var(&maxHits, "max_hits", 0, "Expire the short URL after this many redirects")
+	editCmd.PersistentFlags().StringVar(&mode, "mode", "", "Redirect mode, prefix or template (default inferred from the URL)")
+}
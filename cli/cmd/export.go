@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	format string
+	output string
+	onlyMe bool
+)
+
+// formatOf returns the format flag, or infers it from a file's extension.
+func formatOf(path string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return "csv"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "jsonl"
+}
+
+func export() {
+	q := neturl.Values{}
+	q.Set("format", formatOf(output))
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if onlyMe {
+		q.Set("mine", "true")
+	}
+	req, err := http.NewRequest("GET", url+"/export?"+q.Encode(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("error %v\n", resp.Status)
+		return
+	}
+	out := os.Stdout
+	if output != "" && output != "-" {
+		if out, err = os.Create(output); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		defer out.Close()
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export short URLs",
+	Long: `Export short URLs as JSON lines, CSV or YAML, for backup or import into
+another tinyr. The format is inferred from the output file's extension
+unless given.
+
+tinyr export > links.jsonl
+tinyr export --mine -o links.csv
+tinyr export --prefix team --format yaml`,
+	Run: func(cmd *cobra.Command, args []string) {
+		export()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.PersistentFlags().StringVar(&format, "format", "", "Format: jsonl, csv or yaml")
+	exportCmd.PersistentFlags().StringVarP(&output, "output", "o", "", "File to write to (default stdout)")
+	exportCmd.PersistentFlags().StringVar(&prefix, "prefix", "", "Only export short URLs in this namespace")
+	exportCmd.PersistentFlags().BoolVar(&onlyMe, "mine", false, "Only export short URLs you own")
+}
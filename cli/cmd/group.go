@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type groupRequest struct {
+	Name string
+}
+
+type memberRequest struct {
+	Group string
+	Email string
+}
+
+type groupEntry struct {
+	Name    string
+	Members []string
+}
+
+// postJSON sends body to path and decodes the response into out, if given.
+func postJSON(path string, body, out any) (err error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequest("POST", url+path, bytes.NewReader(b))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error %v", resp.Status)
+	}
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return
+}
+
+func printGroup(g groupEntry) {
+	fmt.Printf("%v: %v\n", g.Name, strings.Join(g.Members, ", "))
+}
+
+// groupCreate creates a group with the caller as its only member, then adds
+// each of members.
+func groupCreate(name string, members []string) {
+	var g groupEntry
+	if err := postJSON("/groups/create", groupRequest{Name: name}, &g); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	for _, email := range members {
+		if err := postJSON("/groups/add", memberRequest{Group: name, Email: email}, &g); err != nil {
+			fmt.Printf("%v: %v\n", email, err.Error())
+		}
+	}
+	printGroup(g)
+}
+
+func groupChange(path, name, email string) {
+	var g groupEntry
+	if err := postJSON(path, memberRequest{Group: name, Email: email}, &g); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	printGroup(g)
+}
+
+func groupLs() {
+	req, err := http.NewRequest("GET", url+"/groups", nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("error %v\n", resp.Status)
+		return
+	}
+	var groups []groupEntry
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	for _, g := range groups {
+		printGroup(g)
+	}
+}
+
+// groupCmd represents the group command
+var groupCmd = &cobra.Command{
+	Use:   "group",
+	Short: "Manage groups that share short URLs",
+	Long: `Manage groups. Members of a group share ownership of the short URLs
+owned by the group. Members are given by email, and must have logged in.
+
+tinyr group create my-team alice@example.com bob@example.com
+tinyr group add my-team carol@example.com
+tinyr group rm my-team bob@example.com
+tinyr group ls`,
+}
+
+var groupCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a group",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			fmt.Println("group name is required")
+			return
+		}
+		groupCreate(args[0], args[1:])
+	},
+}
+
+var groupAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a member to a group",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Println("group name and member email are required")
+			return
+		}
+		groupChange("/groups/add", args[0], args[1])
+	},
+}
+
+var groupRmCmd = &cobra.Command{
+	Use:   "rm",
+	Short: "Remove a member from a group",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Println("group name and member email are required")
+			return
+		}
+		groupChange("/groups/remove", args[0], args[1])
+	},
+}
+
+var groupLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List your groups",
+	Run: func(cmd *cobra.Command, args []string) {
+		groupLs()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(groupCmd)
+	groupCmd.AddCommand(groupCreateCmd, groupAddCmd, groupRmCmd, groupLsCmd)
+}
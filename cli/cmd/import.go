@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	policy string
+	dryRun bool
+)
+
+type importError struct {
+	Row   int
+	Short string
+	Error string
+}
+
+type importResponse struct {
+	DryRun      bool
+	Created     int
+	Overwritten int
+	Skipped     int
+	Failed      int
+	Stopped     bool
+	Errors      []importError
+}
+
+func importLinks(path string) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		defer f.Close()
+		in = f
+	}
+	q := neturl.Values{}
+	q.Set("format", formatOf(path))
+	q.Set("policy", policy)
+	if dryRun {
+		q.Set("dry_run", "true")
+	}
+	req, err := http.NewRequest("POST", url+"/import?"+q.Encode(), in)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("error %v\n", resp.Status)
+		return
+	}
+	var report importResponse
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	for _, e := range report.Errors {
+		fmt.Printf("row %v (%v): %v\n", e.Row, e.Short, e.Error)
+	}
+	if report.DryRun {
+		fmt.Print("dry run: ")
+	}
+	fmt.Printf("%v created, %v overwritten, %v skipped, %v failed\n",
+		report.Created, report.Overwritten, report.Skipped, report.Failed)
+	if report.Stopped {
+		fmt.Println("stopped at the last error; later rows were not imported")
+	}
+}
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import short URLs",
+	Long: `Import short URLs from a JSON lines, CSV or YAML file, as written by
+tinyr export, or - for stdin. Imported short URLs are owned by you. The
+format is inferred from the file's extension unless given.
+
+Existing short URLs are handled by --policy: skip leaves them, overwrite
+replaces those you own, and fail stops the import.
+
+tinyr import --dry_run links.jsonl
+tinyr import --policy skip links.csv`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Println("a file is required")
+			return
+		}
+		importLinks(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.PersistentFlags().StringVar(&format, "format", "", "Format: jsonl, csv or yaml")
+	importCmd.PersistentFlags().StringVar(&policy, "policy", "fail", "Policy for existing short URLs: skip, overwrite or fail")
+	importCmd.PersistentFlags().BoolVar(&dryRun, "dry_run", false, "Report what would be imported without importing")
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	pageSize int
+	prefix   string
+)
+
+type listEntry struct {
+	Short string
+	Long  string
+	Hits  int
+}
+
+type mineResponse struct {
+	Entries []listEntry
+	Next    string
+}
+
+func mine(cursor string) (page mineResponse, err error) {
+	q := neturl.Values{}
+	q.Set("limit", fmt.Sprintf("%d", pageSize))
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	req, err := http.NewRequest("GET", url+"/mine?"+q.Encode(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("error %v", resp.Status)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	return
+}
+
+// lsPrefix lists every short URL in a namespace, whoever owns it.
+func lsPrefix() {
+	q := neturl.Values{}
+	q.Set("prefix", prefix)
+	req, err := http.NewRequest("GET", url+"/list?"+q.Encode(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("error %v\n", resp.Status)
+		return
+	}
+	var entries []listEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	for _, e := range entries {
+		fmt.Printf("%v -> %v (%v hits)\n", e.Short, e.Long, e.Hits)
+	}
+}
+
+func ls() {
+	if prefix != "" {
+		lsPrefix()
+		return
+	}
+	cursor := ""
+	for {
+		page, err := mine(cursor)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		for _, e := range page.Entries {
+			fmt.Printf("%v -> %v (%v hits)\n", e.Short, e.Long, e.Hits)
+		}
+		if cursor = page.Next; cursor == "" {
+			return
+		}
+	}
+}
+
+// lsCmd represents the ls command
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List your short URLs",
+	Long: `List the short URLs that you own, or all short URLs in a namespace.
+
+tinyr ls
+tinyr ls --prefix team`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ls()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+	lsCmd.PersistentFlags().IntVar(&pageSize, "page_size", 100, "Number of entries fetched per request")
+	lsCmd.PersistentFlags().StringVar(&prefix, "prefix", "", "List short URLs in this namespace instead")
+}
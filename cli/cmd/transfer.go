@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	newOwner string
+	group    string
+	editors  []string
+)
+
+type transferRequest struct {
+	Short   string
+	Owner   *string   `json:",omitempty"`
+	Group   *string   `json:",omitempty"`
+	Editors *[]string `json:",omitempty"`
+	Version int
+}
+
+func transfer(cmd *cobra.Command, short string) {
+	if version < 0 {
+		var err error
+		if version, err = confirmVersion(short); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+	req := transferRequest{Short: short, Version: version}
+	// Only send what was given; the rest is unchanged.
+	if cmd.Flags().Changed("owner") {
+		req.Owner = &newOwner
+	}
+	if cmd.Flags().Changed("group") {
+		req.Group = &group
+	}
+	if cmd.Flags().Changed("editors") {
+		req.Editors = &editors
+	}
+	var updated updateResponse
+	if err := postJSON("/transfer", req, &updated); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Printf("ok (version %v)\n", updated.Version)
+}
+
+// transferCmd represents the transfer command
+var transferCmd = &cobra.Command{
+	Use:   "transfer",
+	Short: "Change who owns and may edit a short URL",
+	Long: `Change the owner, owning group or editors of a short URL. Owners and
+members of the owning group may change the URL and its ownership; editors may
+only change the URL. Users are given by email. An empty group removes it.
+Without --version, the current URL is shown and must be confirmed.
+
+tinyr transfer --owner alice@example.com my-url
+tinyr transfer --group my-team my-url
+tinyr transfer --editors bob@example.com,carol@example.com my-url`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Println("short url is required")
+			return
+		}
+		transfer(cmd, args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(transferCmd)
+	transferCmd.PersistentFlags().StringVar(&newOwner, "owner", "", "Email of the new owner")
+	transferCmd.PersistentFlags().StringVar(&group, "group", "", "Name of the owning group")
+	transferCmd.PersistentFlags().StringSliceVar(&editors, "editors", nil, "Emails of users who may edit")
+	transferCmd.PersistentFlags().IntVar(&version, "version", -1, "Expected version of the short URL")
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+const (
+	defaultStatsWindow = 24 * time.Hour
+	defaultStatsBucket = time.Hour
+	maxStatsBuckets    = 1000
+)
+
+// hitRecorder batches hits in the background so that redirects never wait on
+// the database. Hits are dropped, and counted, if the buffer is full.
+type hitRecorder struct {
+	hits     chan db.Hit
+	store    db.HitStore
+	batch    int
+	interval time.Duration
+	logger   *slog.Logger
+	// flushed is called with the shorts of each batch once it is recorded.
+	flushed func(shorts []string)
+	dropped atomic.Uint64
+	// stop ends recording, which is done once queued hits are flushed.
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newHitRecorder(store db.HitStore, config Config, flushed func(shorts []string)) *hitRecorder {
+	r := &hitRecorder{
+		hits:     make(chan db.Hit, max(config.HitBufferSize, 1)),
+		store:    store,
+		batch:    max(config.HitBatchSize, 1),
+		interval: config.HitFlushInterval,
+		logger:   config.Logger,
+		flushed:  flushed,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if r.interval <= 0 {
+		r.interval = time.Second
+	}
+	go r.run()
+	return r
+}
+
+func (r *hitRecorder) Record(hit db.Hit) {
+	select {
+	case r.hits <- hit:
+	default:
+		r.dropped.Add(1)
+		r.logger.Warn("hit buffer full; dropping", "short", hit.Short)
+	}
+}
+
+// Dropped returns the count of hits dropped because the buffer was full.
+func (r *hitRecorder) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+// Healthz fails only if the recorder has stopped. A full buffer drops hits,
+// which are logged and counted, but it drains on the next flush, so it does
+// not take the replica out of service.
+func (r *hitRecorder) Healthz(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return fmt.Errorf("hit recorder stopped")
+	default:
+		return nil
+	}
+}
+
+// Close flushes queued hits and stops recording. Hits recorded after are
+// dropped.
+func (r *hitRecorder) Close() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *hitRecorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	batch := make([]db.Hit, 0, r.batch)
+	for {
+		select {
+		case <-r.stop:
+			r.drain(batch)
+			return
+		case hit := <-r.hits:
+			batch = append(batch, hit)
+			if len(batch) < r.batch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		r.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// drain flushes batch and the hits queued behind it.
+func (r *hitRecorder) drain(batch []db.Hit) {
+	for {
+		select {
+		case hit := <-r.hits:
+			if batch = append(batch, hit); len(batch) < r.batch {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				r.flush(batch)
+			}
+			return
+		}
+		r.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+func (r *hitRecorder) flush(batch []db.Hit) {
+	if err := r.store.Record(batch); err != nil {
+		r.logger.Warn("Error recording hits", "count", len(batch), "error", err)
+		return
+	}
+	r.logger.Debug("recorded hits", "count", len(batch))
+	if r.flushed == nil {
+		return
+	}
+	seen := make(map[string]bool)
+	var shorts []string
+	for _, h := range batch {
+		if !seen[h.Short] {
+			seen[h.Short] = true
+			shorts = append(shorts, h.Short)
+		}
+	}
+	r.flushed(shorts)
+}
+
+// bucketHits counts hits into consecutive buckets of width bucket starting at
+// since.
+func bucketHits(hits []db.Hit, since, until time.Time, bucket time.Duration) (buckets []StatsBucket) {
+	for start := since; start.Before(until); start = start.Add(bucket) {
+		buckets = append(buckets, StatsBucket{Start: start})
+	}
+	for _, h := range hits {
+		if idx := int(h.Timestamp.Sub(since) / bucket); idx >= 0 && idx < len(buckets) {
+			buckets[idx].Hits++
+		}
+	}
+	return
+}
+
+func parseStatsRequest(r *http.Request) (req StatsRequest, err error) {
+	q := r.URL.Query()
+	req.Short = q.Get("short")
+	req.Until = time.Now()
+	if v := q.Get("until"); v != "" {
+		if req.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return
+		}
+	}
+	req.Since = req.Until.Add(-defaultStatsWindow)
+	if v := q.Get("since"); v != "" {
+		if req.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return
+		}
+	}
+	req.Bucket = defaultStatsBucket
+	if v := q.Get("bucket"); v != "" {
+		if req.Bucket, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+	req.Clicks = q.Get("clicks") == "true"
+
+	if !ValidShort(req.Short) {
+		err = util.InvalidValueError(req.Short)
+	} else if req.Bucket <= 0 || req.Until.Sub(req.Since)/req.Bucket > maxStatsBuckets {
+		err = util.InvalidValueError(req.Bucket.String())
+	} else if !req.Since.Before(req.Until) {
+		err = util.InvalidValueError(req.Since.String())
+	}
+	return
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, err := s.UserFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	req, err := parseStatsRequest(r)
+	if err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.logger.Info("Stats", "short", req.Short, "since", req.Since, "until", req.Until, "bucket", req.Bucket)
+
+	data, err := s.store(ctx).Shorts().Get(req.Short)
+	if err != nil {
+		util.ErrorResponse(w, http.StatusNotFound, util.NoSuchKeyError(req.Short).Error())
+		return
+	} else if err = db.Authorize(data, uid, false, s.store(ctx).Users()); err != nil {
+		util.ErrorResponse(w, util.StatusCode(err), err.Error())
+		return
+	}
+
+	total, err := s.store(ctx).Hits().Count(req.Short)
+	if err != nil {
+		s.logger.Warn("Error counting hits", "short", req.Short, "error", err)
+		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	hits, err := s.store(ctx).Hits().Clicks(req.Short, req.Since, req.Until)
+	if err != nil {
+		s.logger.Warn("Error fetching clicks", "short", req.Short, "error", err)
+		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := StatsResponse{
+		Short:   req.Short,
+		Total:   total,
+		Buckets: bucketHits(hits, req.Since, req.Until, req.Bucket),
+	}
+	if req.Clicks {
+		resp.Clicks = make([]LogEntry, 0, len(hits))
+		for _, h := range hits {
+			resp.Clicks = append(resp.Clicks, LogEntry{
+				Host:      h.Host,
+				Timestamp: h.Timestamp,
+				Referrer:  h.Referrer,
+				UserAgent: h.UserAgent,
+			})
+		}
+	}
+	util.JsonResponse(w, http.StatusOK, resp)
+}
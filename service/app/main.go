@@ -3,22 +3,30 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/peterbourgon/ff"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/crypto/acme/autocert"
 
 	"github.com/ml8/tinyr/service"
 	"github.com/ml8/tinyr/service/db"
 	"github.com/ml8/tinyr/service/healthz"
+	"github.com/ml8/tinyr/service/invalidation"
+	"github.com/ml8/tinyr/service/metrics"
+	"github.com/ml8/tinyr/service/tracing"
+	"github.com/ml8/tinyr/service/util"
 )
 
 var (
@@ -33,6 +41,53 @@ var (
 	cacheTTL  = fs.Duration("cacheTTL", time.Minute*5, "ttl for caching entries")
 	cacheSize = fs.Int("cacheSize", 1024, "size of url cache")
 
+	// Cache expiry flags
+	cacheJitter        = fs.Float64("cacheJitter", 0.1, "max fraction by which each cached entry's ttl is randomly shortened")
+	negativeCacheTTL   = fs.Duration("negativeCacheTTL", 10*time.Second, "ttl for caching urls that were not found; 0 disables")
+	cacheStale         = fs.Duration("cacheStale", 0, "time past their ttl for which cached entries are served while they are refreshed; 0 disables")
+	cacheSweepInterval = fs.Duration("cacheSweepInterval", time.Minute, "interval for removing expired cache entries; 0 removes them only when read")
+
+	// Invalidation flags
+	peers     = fs.String("peers", "", "replicas to send cache invalidations to: a host, such as a headless service, resolved to each replica, or a comma-separated list of urls; empty disables")
+	peerPort  = fs.String("peerPort", ":8081", "port to receive cache invalidations from peers on")
+	peerToken = fs.String("peerToken", "", "token peers must send with invalidations")
+
+	// Health check flags
+	healthzInterval = fs.Duration("healthzInterval", 10*time.Second, "interval for background health checks, which probes are served from; 0 checks on every probe")
+	healthzTimeout  = fs.Duration("healthzTimeout", 5*time.Second, "timeout for each health check")
+
+	// Tracing flags
+	traceExporter    = fs.String("traceExporter", "", "trace exporter: otlp, stdout or file; empty disables tracing")
+	traceEndpoint    = fs.String("traceEndpoint", "", "OTLP/HTTP collector url, e.g. http://localhost:4318; defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	traceFile        = fs.String("traceFile", "traces.json", "file for the file trace exporter")
+	traceSampleRatio = fs.Float64("traceSampleRatio", 1, "fraction of new traces recorded")
+
+	// Shutdown flags
+	drainPeriod     = fs.Duration("drainPeriod", 5*time.Second, "time between failing health checks and closing listeners on SIGTERM")
+	shutdownTimeout = fs.Duration("shutdownTimeout", 20*time.Second, "max time for in-flight requests to finish on shutdown")
+
+	// Short generation flags
+	shortAlphabet = fs.String("shortAlphabet", service.DefaultShortAlphabet, "characters used in generated short urls")
+	shortLength   = fs.Int("shortLength", service.DefaultShortLength, "length of generated short urls")
+
+	// Analytics flags
+	hitBufferSize    = fs.Int("hitBufferSize", 4096, "max number of redirects queued for recording")
+	hitBatchSize     = fs.Int("hitBatchSize", 256, "max number of redirects recorded per write")
+	hitFlushInterval = fs.Duration("hitFlushInterval", time.Second, "interval for recording queued redirects")
+
+	// Expiry flags
+	reapInterval = fs.Duration("reapInterval", time.Minute, "interval for deleting expired urls; 0 disables")
+
+	// Namespace flags
+	reservedNames = fs.String("reserved", "", "comma-separated list of names, e.g. team/admin, that cannot be created")
+
+	// Admin and backup flags
+	admins         = fs.String("admins", "", "comma-separated list of emails of users who may back up the database")
+	backupDir      = fs.String("backupDir", "", "directory for PebbleDB backups; empty disables backups")
+	backupTar      = fs.Bool("backupTar", false, "write backups as gzipped tarballs rather than directories")
+	backupInterval = fs.Duration("backupInterval", 0, "interval for scheduled backups; 0 disables")
+	backupRetain   = fs.Int("backupRetain", 7, "number of backups kept; 0 keeps all")
+
 	// TLS flags
 	certDir = fs.String("certDir", "", "directory for certificate caching")
 	domain  = fs.String("domain", "", "domain for TLS")
@@ -40,10 +95,12 @@ var (
 
 	// Database flags
 	pebblePath  = fs.String("pebblePath", "", "path to PebbleDB directory")
+	pebbleCodec = fs.String("pebbleCodec", db.GobCodec, "codec for new PebbleDB values: gob, json or msgpack")
+	restoreFrom = fs.String("pebbleRestoreFrom", "", "PebbleDB backup, a directory or tarball, to restore if pebblePath is empty")
 	cqlHosts    = fs.String("cqlHosts", "", "comma-separated list of cql hosts")
 	cqlKeyspace = fs.String("cqlKeyspace", "tinyr", "keyspace for cql")
 	connStr     = fs.String("connStr", "", "sql connection string")
-	sqlDriver   = fs.String("sqlDriver", "mysql", "sql database driver")
+	sqlDriver   = fs.String("sqlDriver", "mysql", "sql database driver: mysql, postgres or sqlite")
 
 	// Auth flags
 	clientID     = fs.String("clientID", "", "OIDC client ID")
@@ -65,6 +122,14 @@ func dbConfig(logger *slog.Logger) (cfg db.Config) {
 	if *pebblePath != "" {
 		cfg.Type = db.Pebble
 		cfg.Pebble.Path = *pebblePath
+		cfg.Pebble.Codec = *pebbleCodec
+		cfg.Pebble.RestoreFrom = *restoreFrom
+		cfg.Pebble.Backup = db.BackupConfig{
+			Dir:      *backupDir,
+			Tar:      *backupTar,
+			Interval: *backupInterval,
+			Retain:   *backupRetain,
+		}
 	}
 
 	if *cqlHosts != "" {
@@ -113,10 +178,25 @@ func main() {
 	mux := http.NewServeMux()
 	mux.Handle("/", h)
 	mux.Handle("/healthz", healthz.Handler())
+	mux.Handle("/livez", healthz.LivezHandler())
+	mux.Handle("/readyz", healthz.ReadyzHandler())
+	mux.Handle("/metrics", metrics.Handler())
 
 	config := service.Config{}
 	config.Logger = logger
-	config.DB = db.New(dbConfig(config.Logger))
+	stopTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    *traceExporter,
+		Endpoint:    *traceEndpoint,
+		File:        *traceFile,
+		SampleRatio: *traceSampleRatio,
+		ServiceName: "tinyr",
+	})
+	util.OkOrDie(err)
+
+	config.Metrics = metrics.New(prometheus.DefaultRegisterer)
+	dbcfg := dbConfig(config.Logger)
+	backend := db.TypeName(dbcfg.Type)
+	config.DB = config.Metrics.DB(tracing.DB(db.New(dbcfg), backend), backend)
 	config.ShortURLPrefix = ""
 
 	config.ClientID = *clientID
@@ -131,16 +211,87 @@ func main() {
 	config.LoginURL = "/login"
 	config.CacheSize = *cacheSize
 	config.CacheTTL = *cacheTTL
+	config.CacheJitter = *cacheJitter
+	config.NegativeCacheTTL = *negativeCacheTTL
+	config.CacheStale = *cacheStale
+	config.CacheSweepInterval = *cacheSweepInterval
+	var bus *invalidation.HTTP
+	if *peers != "" {
+		bus = invalidation.NewHTTP(invalidation.HTTPConfig{
+			Peers:      peerConfig(),
+			Token:      *peerToken,
+			BufferSize: 4096,
+			BatchSize:  256,
+			Logger:     logger,
+		})
+		config.Invalidations = bus
+	}
+	config.ShortAlphabet = *shortAlphabet
+	config.ShortLength = *shortLength
+	config.HitBufferSize = *hitBufferSize
+	config.HitBatchSize = *hitBatchSize
+	config.HitFlushInterval = *hitFlushInterval
+	config.ReapInterval = *reapInterval
+	if *reservedNames != "" {
+		config.Reserved = strings.Split(*reservedNames, ",")
+	}
+	if *admins != "" {
+		config.Admins = strings.Split(*admins, ",")
+	}
+
+	svc := service.New(config)
+	svc.Register(mux)
 
-	service.Init(mux, config)
+	healthz.SetDeadline(*healthzTimeout)
+	stopHealthz := func() {}
+	if *healthzInterval > 0 {
+		stopHealthz = healthz.Start(*healthzInterval)
+	}
 
+	var servers []*http.Server
 	if *useTLS {
-		serveTLS(mux)
+		servers = serveTLS(mux)
 	} else {
-		serve(mux)
+		servers = serve(mux)
+	}
+	if bus != nil {
+		servers = append(servers, servePeers(bus))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	// Probes check on demand while draining, so none race the database closing.
+	stopHealthz()
+	shutdown(svc, servers)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := stopTracing(ctx); err != nil {
+		logger.Warn("Error flushing traces", "error", err)
 	}
 }
 
+// shutdown fails health checks for the drain period, so that load balancers
+// stop routing here, then waits for in-flight requests before closing svc.
+func shutdown(svc *service.Server, servers []*http.Server) {
+	logger.Info("draining", "period", *drainPeriod)
+	healthz.Drain()
+	time.Sleep(*drainPeriod)
+
+	logger.Info("shutting down", "timeout", *shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("Error shutting down server", "addr", server.Addr, "error", err)
+		}
+	}
+	if err := svc.Close(); err != nil {
+		logger.Warn("Error closing service", "error", err)
+	}
+	logger.Info("shut down")
+}
+
 type home struct {
 	src string
 }
@@ -157,7 +308,7 @@ func fetchIndex(path string) string {
 	return string(f)
 }
 
-func serveTLS(mux *http.ServeMux) {
+func serveTLS(mux *http.ServeMux) []*http.Server {
 	u, _ := url.Parse(*hostname)
 	allowedHost := u.Host
 	certManager := autocert.Manager{
@@ -170,19 +321,53 @@ func serveTLS(mux *http.ServeMux) {
 		},
 		Cache: autocert.DirCache(*certDir),
 	}
-	server := http.Server{
+	server := &http.Server{
 		Addr:    ":443",
 		Handler: mux,
 		TLSConfig: &tls.Config{
 			GetCertificate: certManager.GetCertificate,
 		},
 	}
+	challenges := &http.Server{Addr: ":80", Handler: certManager.HTTPHandler(nil)}
 	logger.Info(fmt.Sprintf("Serving on %v", server.Addr))
-	go http.ListenAndServe(":80", certManager.HTTPHandler(nil))
-	panic(server.ListenAndServeTLS("", ""))
+	go listen(challenges.ListenAndServe)
+	go listen(func() error { return server.ListenAndServeTLS("", "") })
+	return []*http.Server{server, challenges}
 }
 
-func serve(mux *http.ServeMux) {
+// servePeers receives invalidations from the other replicas, apart from the
+// public routes.
+func servePeers(bus *invalidation.HTTP) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(invalidation.Path, bus)
+	addr := *peerPort
+	if !strings.HasPrefix(addr, ":") {
+		addr = ":" + addr
+	}
+	server := &http.Server{Addr: addr, Handler: mux}
+	logger.Info(fmt.Sprintf("Serving peers on %v", addr))
+	go listen(server.ListenAndServe)
+	return server
+}
+
+// peerConfig returns the peers named by the peers flag.
+func peerConfig() func(context.Context) ([]string, error) {
+	if strings.Contains(*peers, "://") {
+		return invalidation.StaticPeers(strings.Split(*peers, ",")...)
+	}
+	return invalidation.DNSPeers(*peers, strings.TrimPrefix(*peerPort, ":"))
+}
+
+func serve(mux *http.ServeMux) []*http.Server {
+	server := &http.Server{Addr: p, Handler: mux}
 	logger.Info(fmt.Sprintf("Serving on %v", p))
-	panic(http.ListenAndServe(p, mux))
+	go listen(server.ListenAndServe)
+	return []*http.Server{server}
+}
+
+// listen runs f, a ListenAndServe, and dies if it fails other than by shutdown.
+func listen(f func() error) {
+	if err := f(); !errors.Is(err, http.ErrServerClosed) {
+		panic(err)
+	}
 }
@@ -13,6 +13,7 @@ import (
 	"github.com/zitadel/oidc/v3/pkg/oidc"
 
 	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/tracing"
 	"github.com/ml8/tinyr/service/util"
 )
 
@@ -33,8 +34,6 @@ type AuthConfig struct {
 	Logger       *slog.Logger
 }
 
-var authcfg AuthConfig
-
 const authTemplate = `
 <html>
 <head><title>Login OK</title></head>
@@ -52,42 +51,48 @@ function copy_token() {
 </html>
 `
 
-func initAuth(mux *http.ServeMux, config Config) {
-	authcfg = config.AuthConfig
-	authcfg.Logger.Info("Config", "authcfg", authcfg)
+// initAuth connects to the OIDC provider.
+func (s *Server) initAuth(config AuthConfig) {
+	s.auth = config
+	s.auth.Logger.Info("Config", "authcfg", s.auth)
 
-	cookieHandler := httphelper.NewCookieHandler(authcfg.Key, authcfg.Key, httphelper.WithUnsecure())
-	client := &http.Client{Timeout: time.Minute}
+	cookieHandler := httphelper.NewCookieHandler(s.auth.Key, s.auth.Key, httphelper.WithUnsecure())
+	// Traced, so that code exchanges show up in the callback's trace.
+	client := tracing.Client(&http.Client{Timeout: time.Minute})
 
 	options := []rp.Option{
 		rp.WithCookieHandler(cookieHandler),
 		rp.WithVerifierOpts(rp.WithIssuedAtOffset(30 * time.Second)),
 		rp.WithHTTPClient(client),
-		rp.WithLogger(authcfg.Logger),
+		rp.WithLogger(s.auth.Logger),
 	}
 
-	redirect := fmt.Sprintf("%s%s", authcfg.BaseURL, authcfg.CallbackURL)
-	ctx := logging.ToContext(context.TODO(), authcfg.Logger)
-	provider, err := rp.NewRelyingPartyOIDC(ctx, authcfg.Issuer, authcfg.ClientID, authcfg.ClientSecret, redirect, authcfg.Scopes, options...)
+	redirect := fmt.Sprintf("%s%s", s.auth.BaseURL, s.auth.CallbackURL)
+	ctx := logging.ToContext(context.TODO(), s.auth.Logger)
+	var err error
+	s.provider, err = rp.NewRelyingPartyOIDC(ctx, s.auth.Issuer, s.auth.ClientID, s.auth.ClientSecret, redirect, s.auth.Scopes, options...)
 	util.OkOrDie(err)
+}
+
+func (s *Server) registerAuth(mux *http.ServeMux) {
 	urlOptions := []rp.URLParamOpt{
 		rp.WithPromptURLParam(""),
 	}
-	mux.Handle(authcfg.LoginURL, rp.AuthURLHandler(
+	mux.Handle(s.auth.LoginURL, rp.AuthURLHandler(
 		func() string { return "" },
-		provider,
+		s.provider,
 		urlOptions...,
 	))
-	mux.Handle(authcfg.CallbackURL, rp.CodeExchangeHandler(rp.UserinfoCallback(responseHandler), provider))
+	mux.Handle(s.auth.CallbackURL, tracing.Route("auth", rp.CodeExchangeHandler(rp.UserinfoCallback(s.responseHandler), s.provider)))
 }
 
-func responseHandler(w http.ResponseWriter, r *http.Request, tokens *oidc.Tokens[*oidc.IDTokenClaims], state string, rp rp.RelyingParty, info *oidc.UserInfo) {
-	svc.logger.Debug("OIDC response", "info", info)
-	user := svc.db.Users().LookupOrCreate(db.UserData{Name: info.Name, Email: info.Email})
-	tok, err := createToken(user.Id)
-	svc.logger.Info("Login", "uid", user.Id)
+func (s *Server) responseHandler(w http.ResponseWriter, r *http.Request, tokens *oidc.Tokens[*oidc.IDTokenClaims], state string, rp rp.RelyingParty, info *oidc.UserInfo) {
+	s.logger.Debug("OIDC response", "info", info)
+	user := s.store(r.Context()).Users().LookupOrCreate(db.UserData{Name: info.Name, Email: info.Email})
+	tok, err := s.createToken(user.Id)
+	s.logger.Info("Login", "uid", user.Id)
 	if err != nil {
-		svc.logger.Error("Could not create token", "error", err)
+		s.logger.Error("Could not create token", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -96,10 +101,10 @@ func responseHandler(w http.ResponseWriter, r *http.Request, tokens *oidc.Tokens
 	w.Write([]byte(msg))
 }
 
-func UserFrom(r *http.Request) (uid uint64, err error) {
+func (s *Server) UserFrom(r *http.Request) (uid uint64, err error) {
 	ok := false
-	uid, ok = verifyRequest(r)
-	svc.logger.Info("Auth info", "uid", uid, "ok", ok)
+	uid, ok = s.verifyRequest(r)
+	s.logger.Info("Auth info", "uid", uid, "ok", ok)
 	if !ok {
 		err = util.InvalidTokenError
 	}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// admin returns the user making r if they are an admin, and otherwise writes
+// an error.
+func (s *Server) admin(w http.ResponseWriter, r *http.Request) (uid uint64, ok bool) {
+	uid, err := s.UserFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !s.admins[uid] {
+		s.logger.Info("Not an admin", "uid", uid)
+		util.ErrorResponse(w, http.StatusForbidden, util.PermissionDeniedError.Error())
+		return
+	}
+	return uid, true
+}
+
+// backuper returns the store if it can be backed up, and otherwise writes an
+// error.
+func (s *Server) backuper(w http.ResponseWriter) (b db.Backuper, ok bool) {
+	if b, ok = s.db.(db.Backuper); !ok {
+		util.ErrorResponse(w, http.StatusNotImplemented, "This store cannot be backed up")
+	}
+	return
+}
+
+// backupHandler backs up the store to the server's backup directory.
+func (s *Server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := s.admin(w, r)
+	if !ok {
+		return
+	}
+	b, ok := s.backuper(w)
+	if !ok {
+		return
+	}
+	s.logger.Info("Backup", "uid", uid)
+	path, err := b.Backup()
+	if err != nil {
+		s.logger.Warn("Error backing up", "error", err)
+		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	util.JsonResponse(w, http.StatusOK, BackupResponse{Path: path})
+}
+
+// downloadBackupHandler sends a backup of the store as a gzipped tarball.
+func (s *Server) downloadBackupHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := s.admin(w, r)
+	if !ok {
+		return
+	}
+	b, ok := s.backuper(w)
+	if !ok {
+		return
+	}
+	s.logger.Info("Download backup", "uid", uid)
+	name := fmt.Sprintf("tinyr-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.WriteHeader(http.StatusOK)
+	if err := b.WriteBackup(w); err != nil {
+		// Too late for an error status; the client sees a truncated tarball.
+		s.logger.Warn("Error backing up", "error", err)
+	}
+}
@@ -0,0 +1,271 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// Import conflict policies, for shorts that already exist.
+const (
+	// PolicySkip leaves existing shorts as they are.
+	PolicySkip = "skip"
+	// PolicyOverwrite replaces existing shorts that the importer owns, owners
+	// included, and reports the rest as errors.
+	PolicyOverwrite = "overwrite"
+	// PolicyFail stops the import at the first existing short or other error.
+	// Records before it stay imported.
+	PolicyFail = "fail"
+)
+
+const (
+	// flushEvery is the number of exported records between flushes to the
+	// client.
+	flushEvery = 100
+	// exportPageSize is the number of records read from the store at a time.
+	exportPageSize = maxPageSize
+	// maxImportBytes caps the body of an import.
+	maxImportBytes = 32 << 20
+)
+
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, err := s.UserFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = FormatJSONL
+	}
+	s.logger.Info("Export", "format", format, "prefix", q.Get("prefix"), "mine", q.Get("mine"))
+	start, end := "", ""
+	if prefix := q.Get("prefix"); prefix != "" {
+		start, end = prefixRange(prefix)
+	}
+	// Pages are written as they are read, so the export is never all in
+	// memory.
+	page := func(cursor string) (db.ListResults, error) {
+		if q.Get("mine") == "true" {
+			return s.store(ctx).Shorts().ListByOwner(uid, cursor, exportPageSize)
+		}
+		return s.store(ctx).Shorts().ListPage(start, end, cursor, exportPageSize)
+	}
+	results, err := page("")
+	if err != nil {
+		s.logger.Warn("Error listing", "error", err)
+		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	rw, err := newRecordWriter(format, w)
+	if err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentTypes[format])
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	// Too late for an error status on failure; the client sees a truncated
+	// stream.
+	for n := 0; ; {
+		for _, data := range results.Matching {
+			if err = rw.Write(data); err != nil {
+				s.logger.Warn("Error exporting", "short", data.Short, "error", err)
+				return
+			}
+			if n++; n%flushEvery == 0 && flusher != nil {
+				rw.Flush()
+				flusher.Flush()
+			}
+		}
+		if results.Next == "" {
+			break
+		}
+		cursor := results.Next
+		if results, err = page(cursor); err != nil {
+			s.logger.Warn("Error listing", "cursor", cursor, "error", err)
+			return
+		}
+	}
+	if err = rw.Flush(); err != nil {
+		s.logger.Warn("Error exporting", "error", err)
+	}
+}
+
+func (s *Server) importHandler(w http.ResponseWriter, r *http.Request) {
+	uid, err := s.UserFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	format, policy := q.Get("format"), q.Get("policy")
+	if format == "" {
+		format = FormatJSONL
+	}
+	if policy == "" {
+		policy = PolicyFail
+	}
+	dryRun := q.Get("dry_run") == "true"
+	s.logger.Info("Import", "format", format, "policy", policy, "dryRun", dryRun)
+	if !slices.Contains([]string{PolicySkip, PolicyOverwrite, PolicyFail}, policy) {
+		util.ErrorResponse(w, http.StatusBadRequest, util.InvalidValueError(policy).Error())
+		return
+	}
+	rr, err := newRecordReader(format, http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := ImportResponse{DryRun: dryRun, Errors: []ImportError{}}
+	status := http.StatusOK
+	for row := 1; ; row++ {
+		data, err := rr.Read()
+		if err == io.EOF {
+			break
+		}
+		// Errors reading the stream, rather than a record, end it.
+		_, recoverable := err.(rowError)
+		fatal := err != nil && !recoverable
+		if err == nil {
+			var outcome string
+			outcome, err = s.importRecord(r.Context(), data, uid, policy, dryRun)
+			switch outcome {
+			case importCreated:
+				resp.Created++
+			case importOverwritten:
+				resp.Overwritten++
+			case importSkipped:
+				resp.Skipped++
+			}
+		}
+		if err == nil {
+			continue
+		}
+		resp.Failed++
+		resp.Errors = append(resp.Errors, ImportError{Row: row, Short: data.Short, Error: err.Error()})
+		if fatal || policy == PolicyFail {
+			resp.Stopped = true
+			// Records before the cap stay imported, as for other errors.
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			break
+		}
+	}
+	s.logger.Info("Imported", "created", resp.Created, "overwritten", resp.Overwritten, "skipped", resp.Skipped, "failed", resp.Failed)
+	util.JsonResponse(w, status, resp)
+}
+
+const (
+	importCreated     = "created"
+	importOverwritten = "overwritten"
+	importSkipped     = "skipped"
+)
+
+// importRecord stores data on behalf of uid, applying the same checks as
+// /create, and returns what it did, or would do on a dry run.
+func (s *Server) importRecord(ctx context.Context, data db.ShortData, uid uint64, policy string, dryRun bool) (outcome string, err error) {
+	data.Long = httpify(data.Long)
+	data.Owner = uid
+	data.Version = 0
+	if data.Mode == db.RedirectTemplate {
+		if _, err = redirectMode("template", data.Long); err != nil {
+			return
+		}
+	}
+	if !ValidShort(data.Short) {
+		err = util.InvalidValueError(data.Short)
+		return
+	} else if err = validLong(data); err != nil {
+		return
+	} else if data.MaxHits < 0 {
+		err = util.InvalidValueError(fmt.Sprint(data.MaxHits))
+		return
+	} else if s.reserved.reserved(data.Short) {
+		err = util.InvalidValueError(data.Short)
+		return
+	}
+	if err = s.checkImportOwners(ctx, data, uid); err != nil {
+		return
+	} else if err = s.checkNamespace(ctx, data.Short, uid); err != nil {
+		return
+	}
+
+	prev, err := s.store(ctx).Shorts().Get(data.Short)
+	if _, ok := err.(util.NoSuchKeyError); !ok && err != nil {
+		return
+	}
+	exists := err == nil
+	err = nil
+	switch {
+	case !exists:
+		outcome = importCreated
+		if !dryRun {
+			err = s.store(ctx).Shorts().Create(data)
+		}
+	case policy == PolicySkip:
+		outcome = importSkipped
+	case policy == PolicyOverwrite:
+		if err = db.Authorize(prev, uid, true, s.store(ctx).Users()); err != nil {
+			return
+		}
+		outcome = importOverwritten
+		if !dryRun {
+			err = s.overwrite(ctx, prev, data, uid)
+		}
+	default:
+		err = util.AlreadyExistsError(data.Short)
+	}
+	if err != nil {
+		outcome = ""
+	} else if !dryRun {
+		s.invalidate(data.Short)
+	}
+	return
+}
+
+// overwrite replaces prev with data, ownership included, on behalf of uid.
+// Both writes expect the version read as prev, so that concurrent changes are
+// reported rather than lost; a change between them leaves the url replaced but
+// not the owners.
+func (s *Server) overwrite(ctx context.Context, prev, data db.ShortData, uid uint64) error {
+	data.Version = prev.Version
+	if err := s.store(ctx).Shorts().Update(data); err != nil {
+		return err
+	}
+	data.Version++
+	return s.store(ctx).Shorts().SetOwners(uid, data)
+}
+
+// checkImportOwners checks that uid may share data with its group and editors,
+// as /create does.
+func (s *Server) checkImportOwners(ctx context.Context, data db.ShortData, uid uint64) error {
+	if data.Group != 0 {
+		group, err := s.store(ctx).Users().GetGroup(data.Group)
+		if err != nil {
+			return err
+		} else if !slices.Contains(group.Members, uid) {
+			return util.PermissionDeniedError
+		}
+	}
+	for _, e := range data.Editors {
+		if _, err := s.store(ctx).Users().Get(e); err != nil {
+			return util.NoSuchKeyError(fmt.Sprint(e))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+func TestImportPolicies(t *testing.T) {
+	ctx := context.Background()
+	newServer := func() (*Server, uint64, uint64) {
+		d := db.NewInMemory()
+		alice := d.Users().LookupOrCreate(db.UserData{Email: "alice@example.com"}).Id
+		bob := d.Users().LookupOrCreate(db.UserData{Email: "bob@example.com"}).Id
+		d.Users().CreateGroup(db.GroupData{Id: db.GroupId("team"), Name: "team", Members: []uint64{alice}})
+		d.Shorts().Create(db.ShortData{Short: "mine", Long: "https://old", Owner: alice, Editors: []uint64{bob}})
+		d.Shorts().Create(db.ShortData{Short: "theirs", Long: "https://old", Owner: bob})
+		return &Server{db: d, logger: slog.Default()}, alice, bob
+	}
+
+	for _, tc := range []struct {
+		short, policy string
+		dryRun        bool
+		outcome       string
+		err           error
+	}{
+		{"new", PolicyFail, false, importCreated, nil},
+		{"new", PolicySkip, true, importCreated, nil},
+		{"mine", PolicySkip, false, importSkipped, nil},
+		{"mine", PolicyFail, false, "", util.AlreadyExistsError("mine")},
+		{"mine", PolicyOverwrite, false, importOverwritten, nil},
+		{"mine", PolicyOverwrite, true, importOverwritten, nil},
+		{"theirs", PolicyOverwrite, false, "", util.PermissionDeniedError},
+	} {
+		s, alice, _ := newServer()
+		data := db.ShortData{Short: tc.short, Long: "https://new", Group: db.GroupId("team")}
+		outcome, err := s.importRecord(ctx, data, alice, tc.policy, tc.dryRun)
+		if outcome != tc.outcome || err != tc.err {
+			t.Errorf("%v %v (dry run %v): incorrect outcome %q, %v; expected %q, %v", tc.short, tc.policy, tc.dryRun, outcome, err, tc.outcome, tc.err)
+			continue
+		}
+		got, err := s.db.Shorts().Get(tc.short)
+		changed := tc.outcome != "" && tc.outcome != importSkipped && !tc.dryRun
+		if changed && (err != nil || got.Long != "https://new") {
+			t.Errorf("%v %v: incorrect entry %v, %v", tc.short, tc.policy, got, err)
+		} else if !changed && err == nil && got.Long != "https://old" {
+			t.Errorf("%v %v (dry run %v): entry changed to %v", tc.short, tc.policy, tc.dryRun, got)
+		}
+	}
+}
+
+func TestImportOverwriteOwners(t *testing.T) {
+	ctx := context.Background()
+	d := db.NewInMemory()
+	alice := d.Users().LookupOrCreate(db.UserData{Email: "alice@example.com"}).Id
+	bob := d.Users().LookupOrCreate(db.UserData{Email: "bob@example.com"}).Id
+	carol := d.Users().LookupOrCreate(db.UserData{Email: "carol@example.com"}).Id
+	d.Users().CreateGroup(db.GroupData{Id: db.GroupId("team"), Name: "team", Members: []uint64{alice, bob}})
+	d.Shorts().Create(db.ShortData{Short: "shared", Long: "https://old", Owner: bob, Group: db.GroupId("team"), Editors: []uint64{carol}})
+	s := &Server{db: d, logger: slog.Default()}
+
+	// A member of the owning group replaces the entry and its owners.
+	data := db.ShortData{Short: "shared", Long: "https://new", Editors: []uint64{bob}}
+	if outcome, err := s.importRecord(ctx, data, alice, PolicyOverwrite, false); err != nil || outcome != importOverwritten {
+		t.Fatalf("Incorrect outcome %q, %v", outcome, err)
+	}
+	got, err := d.Shorts().Get("shared")
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if got.Long != "https://new" || got.Owner != alice || got.Group != 0 || !reflect.DeepEqual(got.Editors, []uint64{bob}) {
+		t.Errorf("Incorrect entry %v", got)
+	}
+
+	// Editors may not overwrite.
+	if _, err := s.importRecord(ctx, data, bob, PolicyOverwrite, false); err != util.PermissionDeniedError {
+		t.Errorf("Incorrect error %v", err)
+	}
+}
+
+func TestImportLookupError(t *testing.T) {
+	d := db.NewInMemory()
+	s := &Server{db: unavailableDB{d, "a"}, logger: slog.Default()}
+	// The namespace check passes for a top-level short, but its lookup fails.
+	if outcome, err := s.importRecord(context.Background(), db.ShortData{Short: "b", Long: "https://b"}, 1, PolicyFail, false); err == nil || outcome != "" {
+		t.Errorf("Incorrect outcome %q, %v", outcome, err)
+	}
+	if _, err := d.Shorts().Get("b"); err == nil {
+		t.Errorf("Expected nothing to be created")
+	}
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// The benchmarks compare New with the heap cache it replaced, under parallel
+// load: a cache of 1024 entries over 4096 keys, mostly read, as redirects are.
+
+const (
+	benchSize = 1024
+	benchKeys = 4096
+)
+
+var benchCaches = []struct {
+	name string
+	new  func(size int) KVCache[int]
+}{
+	{"sieve", New[int]},
+	{"heap", newHeap[int]},
+}
+
+func benchKeyNames() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("short-%d", i)
+	}
+	return keys
+}
+
+// benchmark runs parallel goroutines that each put one in every writes
+// operations, and get otherwise.
+func benchmark(b *testing.B, writes int) {
+	keys := benchKeyNames()
+	for _, bc := range benchCaches {
+		b.Run(bc.name, func(b *testing.B) {
+			c := bc.new(benchSize)
+			for i := 0; i < benchSize; i++ {
+				c.Put(keys[i], i)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for i := 0; pb.Next(); i++ {
+					// Skew towards low keys, as traffic skews towards popular shorts.
+					k := keys[min(r.Intn(benchKeys), r.Intn(benchKeys))]
+					if writes > 0 && i%writes == 0 {
+						c.Put(k, i)
+					} else {
+						c.Get(k)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchmark(b, 0)
+}
+
+func BenchmarkMixed(b *testing.B) {
+	benchmark(b, 10)
+}
+
+func BenchmarkPut(b *testing.B) {
+	benchmark(b, 1)
+}
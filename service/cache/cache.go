@@ -1,143 +1,138 @@
 package cache
 
 import (
-	"container/heap"
-	"sync"
+	"math/rand/v2"
+	"sync/atomic"
 	"time"
-
-	"github.com/ml8/tinyr/service/util"
 )
 
-type KVEntry[T any] struct {
-	Key       string
-	Value     T
-	Timestamp int64
-	entry     *qentry
-}
-
 type KVCache[T any] interface {
+	// Put puts value for the cache's TTL.
 	Put(key string, value T) (previous T, err error)
+	// PutWithTTL puts value for ttl rather than the cache's TTL; zero keeps it
+	// until it is evicted, and DefaultTTL is the cache's TTL.
+	PutWithTTL(key string, value T, ttl time.Duration) (previous T, err error)
+	// Get returns the value for key, unless it has expired.
 	Get(key string) (value T, err error)
+	// GetStale returns the value for key as Get does, and also one that has
+	// expired but is within the cache's stale window, reporting whether it is
+	// fresh, so that it can be served while it is refreshed.
+	GetStale(key string) (value T, fresh bool, err error)
+	// Invalidate removes key and advances its generation.
 	Invalidate(key string) (value T, err error)
-}
-
-type qentry struct {
-	value     uint64
-	timestamp int64
-	index     int // as an optimization we store the current index; this allows us to fix the heap in O(log n) vs. O(n)
-}
-
-type queue []*qentry
-
-type cache[T any] struct {
-	sync.Mutex
-	size    int
-	entries map[uint64]*KVEntry[T]
-	pq      queue
-}
-
-// Implement sort.Interface for queue
-func (pq queue) Len() int {
-	return len(pq)
-}
-func (pq queue) Less(i, j int) bool {
-	return pq[i].timestamp < pq[j].timestamp
-}
-func (pq queue) Swap(i, j int) {
-	t := pq[i]
-	pq[i] = pq[j]
-	pq[j] = t
-	pq[i].index = i
-	pq[j].index = j
-}
-
-// Implement heap.Interface for queue
-func (pq *queue) Push(x any) {
-	x.(*qentry).index = len(*pq)
-	*pq = append(*pq, x.(*qentry))
-}
-func (pq *queue) Pop() any {
-	el := (*pq)[len(*pq)-1]
-	*pq = (*pq)[0 : len(*pq)-1]
-	return el
-}
-
-func New[T any](size int) KVCache[T] {
-	return &cache[T]{
-		size:    size,
-		entries: make(map[uint64]*KVEntry[T]),
-		pq:      make([]*qentry, 0, size)}
-}
-
-func (c *cache[T]) maybeEvict() {
-	if len(c.entries) < c.size {
-		return
+	// Generation returns key's generation. Callers loading a value from
+	// elsewhere read the generation before loading, then store the value with
+	// PutIfGeneration, so that a value loaded before an invalidation does not
+	// replace it.
+	Generation(key string) uint64
+	// PutIfGeneration puts value for ttl, as PutWithTTL does, unless key was
+	// invalidated since generation, and reports whether it did.
+	PutIfGeneration(key string, value T, ttl time.Duration, generation uint64) (stored bool)
+	// Expire removes key, as Invalidate does, because its value is too old.
+	Expire(key string) (value T, err error)
+	// Sweep removes every entry past its TTL and the stale window, and
+	// returns how many it removed.
+	Sweep() int
+	Stats() Stats
+}
+
+// Config configures a cache.
+type Config struct {
+	// Size is about the most entries the cache holds.
+	Size int
+	// Entries expire after TTL, shortened by a random fraction of up to
+	// Jitter of it; zero keeps them until they are evicted.
+	TTL    time.Duration
+	Jitter float64
+	// Stale keeps expired entries for this long after, for GetStale. They are
+	// removed when read after it, or swept.
+	Stale time.Duration
+}
+
+// DefaultTTL, as a ttl, is the cache's TTL.
+const DefaultTTL time.Duration = -1
+
+// Keys share genStripes generations, by hash, so that they take bounded
+// space. An invalidation may then also stop another key's put, which only
+// costs a miss.
+const genStripes = 64
+
+// generations are the invalidation generations of a cache's keys.
+type generations [genStripes]atomic.Uint64
+
+func (g *generations) of(h uint64) *atomic.Uint64 {
+	return &g[h%genStripes]
+}
+
+// now is the cache's clock, replaced in tests.
+var now = time.Now
+
+// deadline returns when an entry put now for ttl expires, as nanoseconds, or
+// zero if it does not. The ttl is shortened by up to jitter of itself, so that
+// entries put together do not all expire, and miss, together.
+func deadline(ttl time.Duration, jitter float64) int64 {
+	if ttl <= 0 {
+		return 0
 	}
-	el := heap.Pop(&c.pq).(*qentry)
-	delete(c.entries, el.value)
-}
-
-func (c *cache[T]) access(key uint64, ts int64) {
-	// Update timestamp for pq and fix heap
-	e := c.entries[key]
-	e.entry.timestamp = ts
-	heap.Fix(&c.pq, e.entry.index)
+	if jitter > 0 {
+		ttl -= time.Duration(rand.Float64() * jitter * float64(ttl))
+	}
+	return now().Add(ttl).UnixNano()
 }
 
-func (c *cache[T]) remove(key uint64) {
-	// remove entry from pq and map
-	e := c.entries[key]
-	heap.Remove(&c.pq, e.entry.index)
-	delete(c.entries, key)
+// expired is true iff an entry with deadline d has expired at t.
+func expired(d, t int64) bool {
+	return d != 0 && t >= d
 }
 
-func (c *cache[T]) Put(key string, value T) (previous T, err error) {
-	c.Lock()
-	defer c.Unlock()
-	h := util.Hash(key)
-	ts := time.Now().UnixNano()
-	if entry, ok := c.entries[h]; ok {
-		// no eviction; replace value.
-		previous = entry.Value
-		entry.Timestamp = ts
-		entry.Value = value
-		c.access(h, ts)
-		return
+// StartSweeper sweeps c every interval, so that expired entries that are not
+// read again do not wait for eviction, until stop is called. Stop waits for a
+// sweep in progress.
+func StartSweeper[T any](c KVCache[T], interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
 	}
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			c.Sweep()
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
 
-	// new key.
-	c.maybeEvict()
-	n := &KVEntry[T]{
-		Key:       key,
-		Value:     value,
-		Timestamp: ts,
-		entry:     &qentry{h, ts, 0}}
-	c.entries[h] = n
-	heap.Push(&c.pq, n.entry)
-	return
+// Stats counts cache events since the cache was created.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Expiries  uint64
+	// Stale counts expired entries returned by GetStale.
+	Stale uint64
 }
 
-func (c *cache[T]) Get(key string) (value T, err error) {
-	c.Lock()
-	defer c.Unlock()
-	h := util.Hash(key)
-	if entry, ok := c.entries[h]; ok {
-		value = entry.Value
-		c.access(h, time.Now().UnixNano())
-	} else {
-		err = util.NoSuchKeyError(key)
-	}
-	return
+// counters are a cache's Stats, updated without its lock.
+type counters struct {
+	hits, misses, evictions, expiries, stale atomic.Uint64
 }
 
-func (c *cache[T]) Invalidate(key string) (value T, err error) {
-	c.Lock()
-	defer c.Unlock()
-	h := util.Hash(key)
-	if entry, ok := c.entries[h]; ok {
-		value = entry.Value
-		c.remove(h)
-		return
+func (c *counters) Stats() Stats {
+	return Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Expiries:  c.expiries.Load(),
+		Stale:     c.stale.Load(),
 	}
-	return
 }
@@ -3,6 +3,9 @@ package cache
 import (
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/ml8/tinyr/service/util"
 )
 
 func putN(cache KVCache[int], n int) {
@@ -20,7 +23,7 @@ func TestEvictLast(t *testing.T) {
 	v, e := cache.Get(fmt.Sprintf("%d", 0))
 	if e == nil {
 		t.Errorf("Key 0 should've been evicted. Got %v", v)
-	} else if _, ok := e.(NoSuchKeyError); !ok {
+	} else if _, ok := e.(util.NoSuchKeyError); !ok {
 		t.Errorf("Error type should be NoSuchKeyError; got %v", e)
 	}
 
@@ -44,7 +47,7 @@ func TestInvalidate(t *testing.T) {
 	v, e := cache.Get(fmt.Sprintf("%d", 0))
 	if e == nil {
 		t.Errorf("Key 0 should've been invalidated. Got %v", v)
-	} else if _, ok := e.(NoSuchKeyError); !ok {
+	} else if _, ok := e.(util.NoSuchKeyError); !ok {
 		t.Errorf("Error type should be NoSuchKeyError; got %v", e)
 	}
 
@@ -53,7 +56,204 @@ func TestInvalidate(t *testing.T) {
 	v, e = cache.Get(fmt.Sprintf("%d", 4))
 	if e == nil {
 		t.Errorf("Key 0 should've been invalidated. Got %v", v)
-	} else if _, ok := e.(NoSuchKeyError); !ok {
+	} else if _, ok := e.(util.NoSuchKeyError); !ok {
 		t.Errorf("Error type should be NoSuchKeyError; got %v", e)
 	}
 }
+
+func TestGeneration(t *testing.T) {
+	advance := clock(t)
+	for name, cache := range map[string]KVCache[int]{"sieve": NewWithConfig[int](Config{Size: 5, TTL: time.Minute}), "heap": newHeap[int](5)} {
+		gen := cache.Generation("a")
+		if !cache.PutIfGeneration("a", 1, DefaultTTL, gen) {
+			t.Errorf("%v: put should have been stored", name)
+		}
+
+		// Values read before an invalidation are not put after it.
+		gen = cache.Generation("a")
+		cache.Invalidate("a")
+		if cache.PutIfGeneration("a", 2, DefaultTTL, gen) {
+			t.Errorf("%v: put should have been skipped", name)
+		}
+		if v, err := cache.Get("a"); err == nil {
+			t.Errorf("%v: key a should have been invalidated; got %v", name, v)
+		}
+		gen = cache.Generation("a")
+		if !cache.PutIfGeneration("a", 3, time.Second, gen) {
+			t.Errorf("%v: put should have been stored", name)
+		}
+		if v, err := cache.Get("a"); err != nil || v != 3 {
+			t.Errorf("%v: incorrect value %v, %v", name, v, err)
+		}
+		advance(time.Second)
+		if _, err := cache.Get("a"); err == nil {
+			t.Errorf("%v: key a should have expired", name)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	cache := New[int](2)
+	putN(cache, 3)
+
+	cache.Get("0")
+	cache.Get("1")
+	cache.Get("2")
+	cache.Expire("2")
+	cache.Expire("2")
+
+	expected := Stats{Hits: 2, Misses: 1, Evictions: 1, Expiries: 1}
+	if s := cache.Stats(); s != expected {
+		t.Errorf("Incorrect stats %+v, expected %+v", s, expected)
+	}
+}
+
+// clock replaces the cache's clock with one that only moves when advanced.
+func clock(t *testing.T) (advance func(time.Duration)) {
+	t0 := time.Now()
+	now = func() time.Time { return t0 }
+	t.Cleanup(func() { now = time.Now })
+	return func(d time.Duration) { t0 = t0.Add(d) }
+}
+
+func TestTTL(t *testing.T) {
+	advance := clock(t)
+	cache := NewWithConfig[int](Config{Size: 5, TTL: time.Minute})
+	cache.Put("a", 1)
+	cache.PutWithTTL("b", 2, time.Second)
+	cache.PutWithTTL("c", 3, 0)
+
+	advance(time.Second)
+	if _, err := cache.Get("b"); err == nil {
+		t.Errorf("Key b should have expired")
+	}
+	if _, err := cache.Get("a"); err != nil {
+		t.Errorf("Key a should not have expired")
+	}
+
+	// Putting again resets the TTL.
+	advance(50 * time.Second)
+	cache.Put("a", 1)
+	advance(30 * time.Second)
+	if _, err := cache.Get("a"); err != nil {
+		t.Errorf("Key a should not have expired")
+	}
+	advance(time.Hour)
+	if _, err := cache.Get("a"); err == nil {
+		t.Errorf("Key a should have expired")
+	}
+	if _, err := cache.Get("c"); err != nil {
+		t.Errorf("Key c should never expire")
+	}
+	if s := cache.Stats(); s.Expiries != 2 || s.Misses != 2 {
+		t.Errorf("Incorrect stats %+v", s)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	advance := clock(t)
+	for name, tc := range map[string]struct {
+		cache   KVCache[int]
+		expires bool
+	}{
+		"sieve": {NewWithConfig[int](Config{Size: 5, TTL: time.Minute}), true},
+		// The heap cache has no TTL of its own.
+		"heap": {newHeap[int](5), false},
+	} {
+		tc.cache.PutWithTTL("a", 1, DefaultTTL)
+		tc.cache.PutIfGeneration("b", 2, DefaultTTL, tc.cache.Generation("b"))
+		advance(time.Hour)
+		for _, key := range []string{"a", "b"} {
+			if _, err := tc.cache.Get(key); (err != nil) != tc.expires {
+				t.Errorf("%v: key %v expired %v, expected %v", name, key, err != nil, tc.expires)
+			}
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	advance := clock(t)
+	for name, cache := range map[string]KVCache[int]{"sieve": NewWithConfig[int](Config{Size: 4000, TTL: time.Minute}), "heap": newHeap[int](1000)} {
+		putN(cache, 500)
+		cache.PutWithTTL("short", 0, time.Second)
+		cache.PutWithTTL("forever", 0, 0)
+		advance(time.Second)
+		if n := cache.Sweep(); n != 1 {
+			t.Errorf("%v: only one entry should have expired, swept %v", name, n)
+		}
+		advance(time.Minute)
+		if n := cache.Sweep(); name == "sieve" && n != 500 {
+			t.Errorf("%v: incorrect number of entries swept %v", name, n)
+		}
+		if _, err := cache.Get("forever"); err != nil {
+			t.Errorf("%v: key forever should not have been swept", name)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	advance := clock(t)
+	cache := NewWithConfig[int](Config{Size: 4000, TTL: time.Minute, Jitter: 0.5})
+	putN(cache, 1000)
+
+	// No entry lives past its TTL, or expires before half of it, and entries
+	// put together expire apart.
+	advance(30*time.Second - 1)
+	if n := cache.Sweep(); n != 0 {
+		t.Errorf("Entries expired before half their TTL: %v", n)
+	}
+	advance(15 * time.Second)
+	if n := cache.Sweep(); n == 0 || n == 1000 {
+		t.Errorf("Entries should expire apart, expired %v", n)
+	}
+	advance(15 * time.Second)
+	cache.Sweep()
+	if s := cache.Stats(); s.Expiries != 1000 {
+		t.Errorf("All entries should have expired, expired %v", s.Expiries)
+	}
+}
+
+func TestStartSweeper(t *testing.T) {
+	cache := NewWithConfig[int](Config{Size: 10, TTL: time.Millisecond})
+	putN(cache, 10)
+	stop := StartSweeper(cache, time.Millisecond)
+	defer stop()
+	for i := 0; i < 1000 && cache.Stats().Expiries < 10; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if s := cache.Stats(); s.Expiries != 10 {
+		t.Errorf("Entries should be swept in the background, swept %v", s.Expiries)
+	}
+}
+
+func TestStale(t *testing.T) {
+	advance := clock(t)
+	cache := NewWithConfig[int](Config{Size: 5, TTL: time.Minute, Stale: time.Minute})
+	cache.Put("a", 1)
+
+	advance(time.Minute)
+	if _, err := cache.Get("a"); err == nil {
+		t.Errorf("Key a should have expired")
+	}
+	if v, fresh, err := cache.GetStale("a"); err != nil || fresh || v != 1 {
+		t.Errorf("Key a should be served stale, got %v %v %v", v, fresh, err)
+	}
+	if n := cache.Sweep(); n != 0 {
+		t.Errorf("Stale entries should not be swept, swept %v", n)
+	}
+
+	// Putting again refreshes it.
+	cache.Put("a", 2)
+	if v, fresh, err := cache.GetStale("a"); err != nil || !fresh || v != 2 {
+		t.Errorf("Key a should be fresh, got %v %v %v", v, fresh, err)
+	}
+
+	advance(2 * time.Minute)
+	if _, _, err := cache.GetStale("a"); err == nil {
+		t.Errorf("Key a should be past the stale window")
+	}
+	expected := Stats{Hits: 1, Misses: 2, Expiries: 1, Stale: 1}
+	if s := cache.Stats(); s != expected {
+		t.Errorf("Incorrect stats %+v, expected %+v", s, expected)
+	}
+}
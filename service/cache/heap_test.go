@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/ml8/tinyr/service/util"
+)
+
+type KVEntry[T any] struct {
+	Key       string
+	Value     T
+	Timestamp int64
+	Deadline  int64
+	entry     *qentry
+}
+
+type qentry struct {
+	value     uint64
+	timestamp int64
+	index     int // as an optimization we store the current index; this allows us to fix the heap in O(log n) vs. O(n)
+}
+
+type queue []*qentry
+
+type cache[T any] struct {
+	sync.Mutex
+	counters
+	generations
+	size    int
+	entries map[uint64]*KVEntry[T]
+	pq      queue
+}
+
+// Implement sort.Interface for queue
+func (pq queue) Len() int {
+	return len(pq)
+}
+func (pq queue) Less(i, j int) bool {
+	return pq[i].timestamp < pq[j].timestamp
+}
+func (pq queue) Swap(i, j int) {
+	t := pq[i]
+	pq[i] = pq[j]
+	pq[j] = t
+	pq[i].index = i
+	pq[j].index = j
+}
+
+// Implement heap.Interface for queue
+func (pq *queue) Push(x any) {
+	x.(*qentry).index = len(*pq)
+	*pq = append(*pq, x.(*qentry))
+}
+func (pq *queue) Pop() any {
+	el := (*pq)[len(*pq)-1]
+	*pq = (*pq)[0 : len(*pq)-1]
+	return el
+}
+
+// newHeap returns an LRU cache ordered by a heap of access times, under one
+// lock. It was the cache before New; it is kept only for tests, as a baseline
+// for benchmarks.
+func newHeap[T any](size int) KVCache[T] {
+	return &cache[T]{
+		size:    size,
+		entries: make(map[uint64]*KVEntry[T]),
+		pq:      make([]*qentry, 0, size)}
+}
+
+func (c *cache[T]) maybeEvict() {
+	if len(c.entries) < c.size {
+		return
+	}
+	el := heap.Pop(&c.pq).(*qentry)
+	delete(c.entries, el.value)
+	c.evictions.Add(1)
+}
+
+func (c *cache[T]) access(key uint64, ts int64) {
+	// Update timestamp for pq and fix heap
+	e := c.entries[key]
+	e.entry.timestamp = ts
+	heap.Fix(&c.pq, e.entry.index)
+}
+
+func (c *cache[T]) remove(key uint64) {
+	// remove entry from pq and map
+	e := c.entries[key]
+	heap.Remove(&c.pq, e.entry.index)
+	delete(c.entries, key)
+}
+
+func (c *cache[T]) Put(key string, value T) (previous T, err error) {
+	return c.PutWithTTL(key, value, 0)
+}
+
+func (c *cache[T]) PutWithTTL(key string, value T, ttl time.Duration) (previous T, err error) {
+	c.Lock()
+	defer c.Unlock()
+	previous = c.put(key, value, ttl)
+	return
+}
+
+func (c *cache[T]) Generation(key string) uint64 {
+	return c.generations.of(util.Hash(key)).Load()
+}
+
+// PutIfGeneration puts value as PutWithTTL does.
+func (c *cache[T]) PutIfGeneration(key string, value T, ttl time.Duration, generation uint64) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.generations.of(util.Hash(key)).Load() != generation {
+		return false
+	}
+	c.put(key, value, ttl)
+	return true
+}
+
+// put stores value for ttl, and returns the value it replaced. The heap cache
+// has no TTL of its own, so DefaultTTL keeps it until it is evicted. Callers
+// must hold the lock.
+func (c *cache[T]) put(key string, value T, ttl time.Duration) (previous T) {
+	h := util.Hash(key)
+	ts := time.Now().UnixNano()
+	if ttl == DefaultTTL {
+		ttl = 0
+	}
+	d := deadline(ttl, 0)
+	if entry, ok := c.entries[h]; ok {
+		// no eviction; replace value.
+		previous = entry.Value
+		entry.Timestamp = ts
+		entry.Deadline = d
+		entry.Value = value
+		c.access(h, ts)
+		return
+	}
+
+	// new key.
+	c.maybeEvict()
+	n := &KVEntry[T]{
+		Key:       key,
+		Value:     value,
+		Timestamp: ts,
+		Deadline:  d,
+		entry:     &qentry{h, ts, 0}}
+	c.entries[h] = n
+	heap.Push(&c.pq, n.entry)
+	return
+}
+
+func (c *cache[T]) Get(key string) (value T, err error) {
+	c.Lock()
+	defer c.Unlock()
+	h := util.Hash(key)
+	if entry, ok := c.entries[h]; ok && !expired(entry.Deadline, now().UnixNano()) {
+		value = entry.Value
+		c.access(h, time.Now().UnixNano())
+		c.hits.Add(1)
+	} else {
+		if ok {
+			c.remove(h)
+			c.expiries.Add(1)
+		}
+		err = util.NoSuchKeyError(key)
+		c.misses.Add(1)
+	}
+	return
+}
+
+// GetStale is Get; the heap cache has no stale window.
+func (c *cache[T]) GetStale(key string) (value T, fresh bool, err error) {
+	value, err = c.Get(key)
+	return value, err == nil, err
+}
+
+func (c *cache[T]) Invalidate(key string) (value T, err error) {
+	c.Lock()
+	defer c.Unlock()
+	h := util.Hash(key)
+	c.generations.of(h).Add(1)
+	if entry, ok := c.entries[h]; ok {
+		value = entry.Value
+		c.remove(h)
+		return
+	}
+	return
+}
+
+func (c *cache[T]) Expire(key string) (value T, err error) {
+	c.Lock()
+	defer c.Unlock()
+	h := util.Hash(key)
+	if entry, ok := c.entries[h]; ok {
+		value = entry.Value
+		c.remove(h)
+		c.expiries.Add(1)
+	}
+	return
+}
+
+func (c *cache[T]) Sweep() (count int) {
+	c.Lock()
+	defer c.Unlock()
+	t := now().UnixNano()
+	for h, entry := range c.entries {
+		if expired(entry.Deadline, t) {
+			c.remove(h)
+			count++
+		}
+	}
+	c.expiries.Add(uint64(count))
+	return
+}
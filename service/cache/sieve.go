@@ -0,0 +1,305 @@
+package cache
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ml8/tinyr/service/util"
+)
+
+// The cache is split into shards by key hash, each with its own lock, and
+// each evicts with SIEVE: entries are kept in insertion order, and a hit only
+// marks its entry visited. To evict, a hand sweeps from the oldest entry
+// towards the newest, clearing visited marks, and evicts the first entry that
+// was not visited since the hand last passed. Marking is atomic, so hits take
+// only a read lock and redirects do not serialize on the cache.
+//
+// Entries expired by their TTL, and past the stale window, are removed when
+// they are next read, or by Sweep, whichever is first.
+
+const (
+	maxShards = 64
+	// Shards are not split below this many entries, so that small caches
+	// evict close to the order a single shard would.
+	minShardSize = 64
+)
+
+type sharded[T any] struct {
+	seed   maphash.Seed
+	shards []shard[T]
+	mask   uint64
+	config Config
+}
+
+type shard[T any] struct {
+	sync.RWMutex
+	// Counted per shard, so that hits on different shards share nothing.
+	counters
+	generations
+	size    int
+	entries map[string]*node[T]
+	// newest and oldest ends of the list, and the eviction hand, which moves
+	// from oldest to newest.
+	head, tail, hand *node[T]
+}
+
+type node[T any] struct {
+	key        string
+	value      T
+	deadline   int64 // unix nanoseconds, or zero if it does not expire
+	visited    atomic.Bool
+	prev, next *node[T] // towards the tail and the head
+}
+
+// New returns a cache of about size entries, split into shards, which do not
+// expire unless put with PutWithTTL.
+func New[T any](size int) KVCache[T] {
+	return NewWithConfig[T](Config{Size: size})
+}
+
+// NewWithConfig returns a cache as New does, configured by config.
+func NewWithConfig[T any](config Config) KVCache[T] {
+	size, n := config.Size, 1
+	for n < maxShards && size/(n*2) >= minShardSize {
+		n *= 2
+	}
+	c := &sharded[T]{seed: maphash.MakeSeed(), shards: make([]shard[T], n), mask: uint64(n - 1), config: config}
+	for i := range c.shards {
+		c.shards[i].size = max((size+n-1)/n, 1)
+		c.shards[i].entries = make(map[string]*node[T])
+	}
+	return c
+}
+
+func (c *sharded[T]) shard(key string) *shard[T] {
+	return &c.shards[maphash.String(c.seed, key)&c.mask]
+}
+
+// generation returns key's generation in s, its shard. Shards are chosen by
+// the low bits of the hash, so generations are by the high ones.
+func (c *sharded[T]) generation(s *shard[T], key string) *atomic.Uint64 {
+	return s.generations.of(maphash.String(c.seed, key) >> 32)
+}
+
+func (c *sharded[T]) Put(key string, value T) (previous T, err error) {
+	return c.PutWithTTL(key, value, c.config.TTL)
+}
+
+func (c *sharded[T]) PutWithTTL(key string, value T, ttl time.Duration) (previous T, err error) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	previous = s.put(key, value, c.deadline(ttl))
+	return
+}
+
+// deadline returns when an entry put now for ttl expires, as deadline does,
+// with DefaultTTL as the cache's TTL.
+func (c *sharded[T]) deadline(ttl time.Duration) int64 {
+	if ttl == DefaultTTL {
+		ttl = c.config.TTL
+	}
+	return deadline(ttl, c.config.Jitter)
+}
+
+func (c *sharded[T]) Generation(key string) uint64 {
+	return c.generation(c.shard(key), key).Load()
+}
+
+func (c *sharded[T]) PutIfGeneration(key string, value T, ttl time.Duration, generation uint64) bool {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	// Generations advance under the lock, so none can between this and put.
+	if c.generation(s, key).Load() != generation {
+		return false
+	}
+	s.put(key, value, c.deadline(ttl))
+	return true
+}
+
+// put stores value until deadline d, evicting if s is full, and returns the
+// value it replaced. Callers must hold the lock.
+func (s *shard[T]) put(key string, value T, d int64) (previous T) {
+	if n, ok := s.entries[key]; ok {
+		previous, n.value, n.deadline = n.value, value, d
+		n.visit()
+		return
+	}
+	if len(s.entries) >= s.size {
+		s.evict()
+		s.evictions.Add(1)
+	}
+	n := &node[T]{key: key, value: value, deadline: d, prev: s.head}
+	if s.head != nil {
+		s.head.next = n
+	}
+	s.head = n
+	if s.tail == nil {
+		s.tail = n
+	}
+	s.entries[key] = n
+	return
+}
+
+func (c *sharded[T]) Get(key string) (value T, err error) {
+	v, fresh, ok, s := c.lookup(key)
+	if ok && fresh {
+		s.hits.Add(1)
+		return v, nil
+	}
+	s.misses.Add(1)
+	return value, util.NoSuchKeyError(key)
+}
+
+func (c *sharded[T]) GetStale(key string) (value T, fresh bool, err error) {
+	value, fresh, ok, s := c.lookup(key)
+	switch {
+	case !ok:
+		err = util.NoSuchKeyError(key)
+		s.misses.Add(1)
+	case fresh:
+		s.hits.Add(1)
+	default:
+		s.stale.Add(1)
+	}
+	return
+}
+
+// lookup returns key's value, and its shard, if it is within its TTL or the
+// stale window. Entries past both are removed.
+func (c *sharded[T]) lookup(key string) (value T, fresh, ok bool, s *shard[T]) {
+	s = c.shard(key)
+	t := now().UnixNano()
+	s.RLock()
+	n, ok := s.entries[key]
+	gone := ok && c.gone(n.deadline, t)
+	if ok && !gone {
+		value, fresh = n.value, !expired(n.deadline, t)
+		n.visit()
+	}
+	s.RUnlock()
+	if gone {
+		// Expired entries are removed under the write lock, unless they were
+		// replaced or removed since.
+		s.Lock()
+		if s.entries[key] == n && c.gone(n.deadline, now().UnixNano()) {
+			s.unlink(n)
+			s.expiries.Add(1)
+		}
+		s.Unlock()
+		ok = false
+	}
+	return
+}
+
+// gone is true iff an entry with deadline d is past the stale window at t.
+func (c *sharded[T]) gone(d, t int64) bool {
+	return expired(d, t-int64(c.config.Stale))
+}
+
+func (c *sharded[T]) Stats() (stats Stats) {
+	for i := range c.shards {
+		s := c.shards[i].Stats()
+		stats.Hits += s.Hits
+		stats.Misses += s.Misses
+		stats.Evictions += s.Evictions
+		stats.Expiries += s.Expiries
+		stats.Stale += s.Stale
+	}
+	return
+}
+
+func (c *sharded[T]) Sweep() (count int) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		t, swept := now().UnixNano(), 0
+		for _, n := range s.entries {
+			if c.gone(n.deadline, t) {
+				s.unlink(n)
+				swept++
+			}
+		}
+		s.Unlock()
+		s.expiries.Add(uint64(swept))
+		count += swept
+	}
+	return
+}
+
+func (c *sharded[T]) Invalidate(key string) (value T, err error) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	c.generation(s, key).Add(1)
+	if n, ok := s.entries[key]; ok {
+		value = n.value
+		s.unlink(n)
+	}
+	return
+}
+
+func (c *sharded[T]) Expire(key string) (value T, err error) {
+	s := c.shard(key)
+	var ok bool
+	if value, ok = c.remove(key); ok {
+		s.expiries.Add(1)
+	}
+	return
+}
+
+func (c *sharded[T]) remove(key string) (value T, ok bool) {
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	var n *node[T]
+	if n, ok = s.entries[key]; ok {
+		value = n.value
+		s.unlink(n)
+	}
+	return
+}
+
+// visit marks n visited, writing only if it is not already, so that hits on
+// popular entries do not contend on it.
+func (n *node[T]) visit() {
+	if !n.visited.Load() {
+		n.visited.Store(true)
+	}
+}
+
+// evict removes the entry under the hand, after moving it past visited ones.
+func (s *shard[T]) evict() {
+	n := s.hand
+	if n == nil {
+		n = s.tail
+	}
+	for n.visited.Load() {
+		n.visited.Store(false)
+		if n = n.next; n == nil {
+			n = s.tail
+		}
+	}
+	s.hand = n.next
+	s.unlink(n)
+}
+
+func (s *shard[T]) unlink(n *node[T]) {
+	if s.hand == n {
+		s.hand = n.next
+	}
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
+		s.tail = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
+		s.head = n.prev
+	}
+	delete(s.entries, n.key)
+}
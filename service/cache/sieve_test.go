@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSieveKeepsVisited(t *testing.T) {
+	cache := New[int](3)
+	putN(cache, 3)
+
+	// 0 and 1 are visited, so the hand passes them and evicts 2, then 0 and 1
+	// are fair game again.
+	cache.Get("0")
+	cache.Get("1")
+	cache.Put("a", 0)
+	for _, k := range []string{"0", "1", "a"} {
+		if _, err := cache.Get(k); err != nil {
+			t.Errorf("Key %v should not have been evicted", k)
+		}
+	}
+	if _, err := cache.Get("2"); err == nil {
+		t.Errorf("Key 2 should have been evicted")
+	}
+}
+
+func TestShards(t *testing.T) {
+	if n := len(New[int](100).(*sharded[int]).shards); n != 1 {
+		t.Errorf("Small caches should have one shard, got %v", n)
+	}
+	c := New[int](1 << 20).(*sharded[int])
+	if n := len(c.shards); n != maxShards {
+		t.Errorf("Incorrect number of shards %v", n)
+	}
+
+	putN(c, 1<<20)
+	if s := c.Stats(); s.Evictions > 1<<16 {
+		t.Errorf("A cache of its size should hold most entries, evicted %v", s.Evictions)
+	}
+	entries := 0
+	for i := range c.shards {
+		entries += len(c.shards[i].entries)
+	}
+	if entries < 1<<20-1<<16 {
+		t.Errorf("Incorrect number of entries %v", entries)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	cache := New[int](256)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				k := fmt.Sprint((i * (g + 1)) % 512)
+				switch i % 4 {
+				case 0:
+					cache.Put(k, i)
+				case 1:
+					cache.Invalidate(k)
+				default:
+					cache.Get(k)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c := cache.(*sharded[int])
+	if n := len(c.shards[0].entries); n > c.shards[0].size {
+		t.Errorf("Shard over capacity: %v", n)
+	}
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Values in pebble start with a header byte naming the codec that encoded
+// them, so that a store can be read while it moves from one codec to another.
+// Headers are printable, so that values are recognisable in a dump: a JSON
+// value is its header followed by the JSON.
+
+// Codec encodes values for the pebble store.
+type Codec interface {
+	// Header is the byte that precedes values this codec encodes.
+	Header() byte
+	Marshal(v any) ([]byte, error)
+	Unmarshal(b []byte, v any) error
+}
+
+// Codec names, for PebbleConfig.
+const (
+	GobCodec     = "gob"
+	JSONCodec    = "json"
+	MsgpackCodec = "msgpack"
+)
+
+var codecs = map[string]Codec{
+	GobCodec:     gobCodec{},
+	JSONCodec:    jsonCodec{},
+	MsgpackCodec: msgpackCodec{},
+}
+
+// CodecNames returns the names of the known codecs.
+func CodecNames() (names []string) {
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// codecByName returns the named codec; gob if name is empty.
+func codecByName(name string) (Codec, error) {
+	if name == "" {
+		name = GobCodec
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q, expected one of %v", name, CodecNames())
+	}
+	return c, nil
+}
+
+func codecByHeader(h byte) (Codec, error) {
+	for _, c := range codecs {
+		if c.Header() == h {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec header %q", h)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Header() byte { return 'g' }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(b []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Header() byte                    { return 'j' }
+func (jsonCodec) Marshal(v any) ([]byte, error)   { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(b []byte, v any) error { return json.Unmarshal(b, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Header() byte                    { return 'm' }
+func (msgpackCodec) Marshal(v any) ([]byte, error)   { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(b []byte, v any) error { return msgpack.Unmarshal(b, v) }
+
+// encode encodes e with c, after c's header.
+func encode[T any](c Codec, e T) ([]byte, error) {
+	b, err := c.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %T: %w", e, err)
+	}
+	return slices.Insert(b, 0, c.Header()), nil
+}
+
+// decode decodes encoded with the codec named by its header. It returns an
+// error, rather than dying, for values that do not decode as T, so that one
+// corrupt value fails one request.
+func decode[T any](encoded []byte) (e T, err error) {
+	if len(encoded) == 0 {
+		err = fmt.Errorf("decoding %T: empty value", e)
+		return
+	}
+	c, err := codecByHeader(encoded[0])
+	if err != nil {
+		err = fmt.Errorf("decoding %T: %w", e, err)
+		return
+	}
+	if err = c.Unmarshal(encoded[1:], &e); err != nil {
+		err = fmt.Errorf("decoding %T: %w", e, err)
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func newPebble(t *testing.T, codec string) Interface {
+	return New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir(), Codec: codec}})
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range CodecNames() {
+		t.Run(codec, func(t *testing.T) {
+			testList(t, newPebble(t, codec))
+			testHits(t, newPebble(t, codec))
+			testDeleteExpired(t, newPebble(t, codec))
+			testUpdate(t, newPebble(t, codec))
+			testGroups(t, newPebble(t, codec))
+			testSharedOwnership(t, newPebble(t, codec))
+		})
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	entry := ShortData{Short: "a", Long: "b", Owner: 1 << 63, Editors: []uint64{7}, ExpiresAt: time.UnixMilli(1700000000000).UTC(), Version: 3}
+	for _, codec := range CodecNames() {
+		c, _ := codecByName(codec)
+		b, err := encode(c, entry)
+		if err != nil {
+			t.Fatalf("%v: got error %v", codec, err)
+		} else if b[0] != c.Header() {
+			t.Errorf("%v: incorrect header %q", codec, b[0])
+		}
+		got, err := decode[ShortData](b)
+		if err != nil {
+			t.Errorf("%v: got error %v", codec, err)
+		} else if !got.ExpiresAt.Equal(entry.ExpiresAt) {
+			t.Errorf("%v: incorrect expiry %v, expected %v", codec, got.ExpiresAt, entry.ExpiresAt)
+		} else if got.ExpiresAt = entry.ExpiresAt; !reflect.DeepEqual(got, entry) {
+			t.Errorf("%v: incorrect entry %v, expected %v", codec, got, entry)
+		}
+	}
+	if _, err := decode[ShortData]([]byte("x{}")); err == nil {
+		t.Errorf("Expected error for unknown header")
+	}
+	if _, err := codecByName("xml"); err == nil {
+		t.Errorf("Expected error for unknown codec")
+	}
+}
+
+func TestMixedCodecs(t *testing.T) {
+	db := newPebble(t, JSONCodec)
+	p := db.Shorts().(*pebbleShortStore)
+	old := ShortData{Short: "old", Long: "gob", Owner: 42}
+	v, err := encode(gobCodec{}, old)
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	p.db.Set([]byte(shortKeyspace+old.Short), v, pebble.Sync)
+	if err := db.Shorts().Create(ShortData{Short: "new", Long: "json", Owner: 42}); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	results, err := db.Shorts().List("", "")
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if len(results.Matching) != 2 || results.Matching[1].Long != "gob" {
+		t.Errorf("Incorrect results %v", results)
+	}
+}
+
+func TestPebbleCodecHeaderMigration(t *testing.T) {
+	dir := t.TempDir()
+	db, err := pebble.Open(dir, &pebble.Options{})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	m := &PebbleMigrator{DB: db}
+	migrate := func(args MigrationArgs) {
+		args.Migrator = m
+		if err := RunMigration(args); err != nil {
+			t.Fatalf("Got error %v", err)
+		}
+	}
+	// A store from before headers.
+	migrate(MigrationArgs{Target: 1})
+	user := UserData{Email: "ada@example.com", Name: "Ada", Id: 3}
+	db.Set([]byte(userKeyspace+"3"), gobEncode(user), pebble.Sync)
+
+	migrate(MigrationArgs{})
+	v, closer, err := db.Get([]byte(userKeyspace + "3"))
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if got, err := decode[UserData](v); err != nil || got != user {
+		t.Errorf("Incorrect user %v, %v", got, err)
+	}
+	closer.Close()
+
+	migrate(MigrationArgs{Command: MigrateDown, Target: 1})
+	v, closer, err = db.Get([]byte(userKeyspace + "3"))
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if got, err := gobDecode[UserData](v); err != nil || got != user {
+		t.Errorf("Incorrect user %v, %v", got, err)
+	}
+	closer.Close()
+	db.Close()
+}
+
+func TestPebbleCodecHeaderRerun(t *testing.T) {
+	db, err := pebble.Open(t.TempDir(), &pebble.Options{})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	defer db.Close()
+	// A store whose migration committed some batches before a crash: some
+	// values have headers and some do not.
+	users := make([]UserData, pebbleBatchSize+10)
+	for i := range users {
+		users[i] = UserData{Email: fmt.Sprintf("%d@example.com", i), Id: uint64(i)}
+		v := gobEncode(users[i])
+		if i%2 == 0 {
+			v = append([]byte{gobCodec{}.Header()}, v...)
+		}
+		db.Set([]byte(fmt.Sprintf("%s%d", userKeyspace, i)), v, pebble.Sync)
+	}
+
+	for run := 0; run < 2; run++ {
+		if err := addCodecHeaders(db); err != nil {
+			t.Fatalf("Run %v: got error %v", run, err)
+		}
+		for i, user := range users {
+			v, closer, err := db.Get([]byte(fmt.Sprintf("%s%d", userKeyspace, i)))
+			if err != nil {
+				t.Fatalf("Got error %v", err)
+			}
+			if got, err := decode[UserData](v); err != nil || got != user {
+				t.Fatalf("Run %v: incorrect user %v: %v, %v", run, i, got, err)
+			}
+			closer.Close()
+		}
+	}
+	if _, _, err := db.Get([]byte(progressPrefix + userKeyspace)); !errors.Is(err, pebble.ErrNotFound) {
+		t.Errorf("Progress should be deleted once the rewrite finishes: %v", err)
+	}
+}
+
+func TestPebbleRewriteResumes(t *testing.T) {
+	db, err := pebble.Open(t.TempDir(), &pebble.Options{})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	defer db.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		db.Set([]byte(userKeyspace+k), nil, pebble.Sync)
+	}
+	// An interrupted rewrite that committed up to b.
+	progress := progressPrefix + userKeyspace
+	db.Set([]byte(progress), []byte(userKeyspace+"b"), pebble.Sync)
+
+	var seen []string
+	err = rewriteFrom(db, userKeyspace, progress, func(b *pebble.Batch, k, v []byte) error {
+		seen = append(seen, string(k))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if !slices.Equal(seen, []string{userKeyspace + "c"}) {
+		t.Errorf("Should resume after the progress, rewrote %v", seen)
+	}
+}
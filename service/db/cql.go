@@ -2,11 +2,21 @@ package db
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
 
 	"github.com/gocql/gocql"
 	gocqlx "github.com/scylladb/gocqlx/v2"
+	"github.com/scylladb/gocqlx/v2/qb"
 	"github.com/scylladb/gocqlx/v2/table"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	schema "github.com/ml8/tinyr/service/db/cqlschema"
 	"github.com/ml8/tinyr/service/healthz"
@@ -29,25 +39,98 @@ func ToUserData(u schema.UsersStruct) UserData {
 	}
 }
 
+func (g GroupData) ToGroupsStruct() schema.GroupsStruct {
+	return schema.GroupsStruct{
+		Gid:     int64(g.Id),
+		Members: toInt64s(g.Members),
+		Name:    g.Name,
+	}
+}
+
+func ToGroupData(g schema.GroupsStruct) GroupData {
+	return GroupData{
+		Id:      uint64(g.Gid),
+		Name:    g.Name,
+		Members: toUint64s(g.Members),
+	}
+}
+
+func toInt64s(ids []uint64) (r []int64) {
+	for _, id := range ids {
+		r = append(r, int64(id))
+	}
+	return
+}
+
+func toUint64s(ids []int64) (r []uint64) {
+	for _, id := range ids {
+		r = append(r, uint64(id))
+	}
+	return
+}
+
 func (s ShortData) ToShortStruct() schema.ShortStruct {
 	return schema.ShortStruct{
-		Long:  s.Long,
-		Short: s.Short,
-		Owner: int64(s.Owner),
+		Editors:   toInt64s(s.Editors),
+		ExpiresAt: s.ExpiresAt,
+		GroupId:   int64(s.Group),
+		Long:      s.Long,
+		MaxHits:   s.MaxHits,
+		Mode:      int32(s.Mode),
+		Short:     s.Short,
+		Owner:     int64(s.Owner),
+		Version:   int32(s.Version),
 	}
 }
 
 func ToShortData(s schema.ShortStruct) ShortData {
 	return ShortData{
-		Short: s.Short,
-		Long:  s.Long,
-		Owner: uint64(s.Owner),
+		Short:     s.Short,
+		Long:      s.Long,
+		Owner:     uint64(s.Owner),
+		Group:     uint64(s.GroupId),
+		Editors:   toUint64s(s.Editors),
+		ExpiresAt: s.ExpiresAt,
+		MaxHits:   s.MaxHits,
+		Mode:      RedirectMode(s.Mode),
+		Version:   int(s.Version),
 	}
 }
 
 type cqlDB struct {
 	session  gocqlx.Session
 	keyspace string
+	logger   *slog.Logger
+	// bound is the context of the request the store serves, if any.
+	bound context.Context
+}
+
+// query builds a query in the store's context.
+func (c *cqlDB) query(stmt string, names []string) *gocqlx.Queryx {
+	q := c.session.Query(stmt, names)
+	if c.bound != nil {
+		q = q.WithContext(c.bound)
+	}
+	return q
+}
+
+// cqlTracer traces queries as children of the span in their context.
+type cqlTracer struct{}
+
+func (cqlTracer) ObserveQuery(ctx context.Context, q gocql.ObservedQuery) {
+	_, span := otel.Tracer(tracerName).Start(ctx, "cql.query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(q.Start),
+		trace.WithAttributes(
+			attribute.String("db.system", "cassandra"),
+			attribute.String("db.name", q.Keyspace),
+			attribute.String("db.statement", q.Statement),
+			attribute.Int("db.cassandra.rows", q.Rows)))
+	if q.Err != nil {
+		span.RecordError(q.Err)
+		span.SetStatus(codes.Error, q.Err.Error())
+	}
+	span.End(trace.WithTimestamp(q.End))
 }
 
 func (c *cqlDB) Healthz(ctx context.Context) error {
@@ -61,28 +144,63 @@ type CQLConfig struct {
 
 type cqlUserStore struct {
 	cqlDB
-	tbl *table.Table
+	tbl         *table.Table
+	groups      *table.Table
+	memberships *table.Table
 }
 
 type cqlShortStore struct {
 	cqlDB
-	tbl *table.Table
+	tbl   *table.Table
+	users *cqlUserStore
+	hits  *cqlHitStore
 }
 
-func NewCQLDB(config CQLConfig) Interface {
+type cqlHitStore struct {
+	cqlDB
+	counts *table.Table
+	clicks *table.Table
+}
+
+// NewCQLDB connects to the cluster in config, and registers its health check
+// with health until it is closed.
+func NewCQLDB(config CQLConfig, logger *slog.Logger, health *healthz.Registry) Interface {
 	db, err := cqlConnect(config)
 	util.OkOrDie(err)
+	db.logger = logger
 	// For health checking: session will attempt to heal.
-	healthz.Register(&db)
+	health.RegisterNamed("cql", &db)
+	c := db.container()
+	c.close = func() error {
+		health.Unregister(&db)
+		db.session.Close()
+		return nil
+	}
+	return c
+}
+
+func (c cqlDB) container() container {
+	u := &cqlUserStore{c, schema.Users, schema.Groups, schema.Memberships}
+	h := &cqlHitStore{c, schema.HitCounts, schema.Clicks}
 	return container{
-		s: &cqlShortStore{db, schema.Short},
-		u: &cqlUserStore{db, schema.Users},
+		s: &cqlShortStore{c, schema.Short, u, h},
+		u: u,
+		h: h,
+		close: func() error {
+			c.session.Close()
+			return nil
+		},
+		withContext: func(ctx context.Context) Interface {
+			c.bound = ctx
+			return c.container()
+		},
 	}
 }
 
 func cqlConnect(config CQLConfig) (db cqlDB, err error) {
 	cluster := gocql.NewCluster(config.Hosts...)
 	cluster.Keyspace = config.Keyspace
+	cluster.QueryObserver = cqlTracer{}
 	session, err := gocqlx.WrapSession(cluster.CreateSession())
 	db = cqlDB{session: session, keyspace: config.Keyspace}
 	return
@@ -93,7 +211,7 @@ func (c *cqlUserStore) LookupOrCreate(queryUser UserData) (user UserData) {
 	u := queryUser.ToUsersStruct()
 	s, n := c.tbl.Insert()
 	s += "IF NOT EXISTS"
-	q := c.session.Query(s, n).BindStruct(u)
+	q := c.query(s, n).BindStruct(u)
 	err := q.ExecRelease()
 	util.OkOrDie(err)
 	return queryUser
@@ -103,8 +221,11 @@ func (c *cqlUserStore) Get(id uint64) (user UserData, err error) {
 	u := schema.UsersStruct{
 		Uid: int64(id),
 	}
-	q := c.session.Query(c.tbl.Get()).BindStruct(u)
+	q := c.query(c.tbl.Get()).BindStruct(u)
 	err = q.GetRelease(&u)
+	if err == gocql.ErrNotFound {
+		err = util.NoSuchKeyError(fmt.Sprintf("%d", id))
+	}
 	user = ToUserData(u)
 	return
 }
@@ -113,66 +234,486 @@ func (c *cqlUserStore) Delete(id uint64) (err error) {
 	u := schema.UsersStruct{
 		Uid: int64(id),
 	}
-	q := c.session.Query(c.tbl.Delete()).BindStruct(u)
+	q := c.query(c.tbl.Delete()).BindStruct(u)
 	err = q.ExecRelease()
 	return
 }
 
+// List and ListGroups scan their tables, which are in token order, and sort.
+func (c *cqlUserStore) List() (users []UserData, err error) {
+	s, n := qb.Select(c.tbl.Name()).Columns(c.tbl.Metadata().Columns...).ToCql()
+	iter := c.query(s, n).Iter()
+	var u schema.UsersStruct
+	for iter.StructScan(&u) {
+		users = append(users, ToUserData(u))
+	}
+	if err = iter.Close(); err != nil {
+		return
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+	return
+}
+
+func (c *cqlUserStore) ListGroups() (groups []GroupData, err error) {
+	s, n := qb.Select(c.groups.Name()).Columns(c.groups.Metadata().Columns...).ToCql()
+	iter := c.query(s, n).Iter()
+	for g := (schema.GroupsStruct{}); iter.StructScan(&g); g = (schema.GroupsStruct{}) {
+		groups = append(groups, ToGroupData(g))
+	}
+	if err = iter.Close(); err != nil {
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Id < groups[j].Id
+	})
+	return
+}
+
+func (c *cqlUserStore) CreateGroup(group GroupData) (err error) {
+	s, n := c.groups.InsertBuilder().Unique().ToCql()
+	applied, err := c.query(s, n).BindStruct(group.ToGroupsStruct()).ExecCASRelease()
+	if err != nil {
+		return
+	} else if !applied {
+		return util.AlreadyExistsError(group.Name)
+	}
+	for _, uid := range group.Members {
+		if err = c.addMembership(group.Id, uid); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *cqlUserStore) GetGroup(id uint64) (group GroupData, err error) {
+	g := schema.GroupsStruct{Gid: int64(id)}
+	err = c.query(c.groups.Get()).BindStruct(g).GetRelease(&g)
+	if err == gocql.ErrNotFound {
+		err = util.NoSuchKeyError(fmt.Sprintf("%d", id))
+	}
+	group = ToGroupData(g)
+	return
+}
+
+func (c *cqlUserStore) addMembership(id, uid uint64) error {
+	m := schema.MembershipsStruct{Gid: int64(id), Uid: int64(uid)}
+	return c.query(c.memberships.Insert()).BindStruct(m).ExecRelease()
+}
+
+// AddMember and RemoveMember write the group's members, which authorize
+// writes, before the membership index, which only lists groups.
+func (c *cqlUserStore) AddMember(id, uid uint64) (err error) {
+	if _, err = c.GetGroup(id); err != nil {
+		return
+	}
+	s, n := qb.Update(c.groups.Name()).Add("members").Where(qb.Eq("gid")).ToCql()
+	q := c.query(s, n).BindMap(qb.M{"gid": int64(id), "members": []int64{int64(uid)}})
+	if err = q.ExecRelease(); err != nil {
+		return
+	}
+	return c.addMembership(id, uid)
+}
+
+func (c *cqlUserStore) RemoveMember(id, uid uint64) (err error) {
+	if _, err = c.GetGroup(id); err != nil {
+		return
+	}
+	s, n := qb.Update(c.groups.Name()).Remove("members").Where(qb.Eq("gid")).ToCql()
+	q := c.query(s, n).BindMap(qb.M{"gid": int64(id), "members": []int64{int64(uid)}})
+	if err = q.ExecRelease(); err != nil {
+		return
+	}
+	m := schema.MembershipsStruct{Gid: int64(id), Uid: int64(uid)}
+	return c.query(c.memberships.Delete()).BindStruct(m).ExecRelease()
+}
+
+func (c *cqlUserStore) GroupsOf(uid uint64) (groups []GroupData, err error) {
+	var ms []schema.MembershipsStruct
+	q := c.query(c.memberships.Select()).BindStruct(schema.MembershipsStruct{Uid: int64(uid)})
+	if err = q.SelectRelease(&ms); err != nil {
+		return
+	}
+	for _, m := range ms {
+		var group GroupData
+		if group, err = c.GetGroup(uint64(m.Gid)); err != nil {
+			return
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return
+}
+
+func (c *cqlUserStore) isMember(id, uid uint64) (bool, error) {
+	group, err := c.GetGroup(id)
+	if _, ok := err.(util.NoSuchKeyError); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return slices.Contains(group.Members, uid), nil
+}
+
 func (c *cqlShortStore) Put(data ShortData) (err error) {
-	d := data.ToShortStruct()
-	s, n := c.tbl.Update("long", "owner")
-	// Conditional mutation; requires coordination.
-	s += fmt.Sprintf("IF owner = %v", data.Owner)
-	q := c.session.Query(s, n).BindStruct(d)
-	var applied bool
-	applied, err = q.ExecCASRelease()
-	if applied {
-		logger.Info("updated", "key", data.Short, "owner", data.Owner)
-	} else {
-		logger.Info("new insert", "key", data.Short, "owner", data.Owner)
-		s, n = c.tbl.Insert()
-		// See note below. We use IF NOT EXISTS to prevent this user from
-		// overwriting another user's racing insert.
-		s += "IF NOT EXISTS"
-		q = c.session.Query(s, n).BindStruct(d)
+	prev, err := c.Get(data.Short)
+	if _, ok := err.(util.NoSuchKeyError); ok {
+		c.logger.Info("new insert", "key", data.Short, "owner", data.Owner)
+		data.Version = 1
+		s, n := c.tbl.InsertBuilder().Unique().ToCql()
+		q := c.query(s, n).BindStruct(data.ToShortStruct())
+		var applied bool
 		applied, err = q.ExecCASRelease()
 		if !applied && err == nil {
-			// This is a small race condition. If the same owner retried the
-			// insert we should either allow the insert to be idempotent. If another
-			// owner did an insert, we should give permission denied.
-			//
-			// Since we cannot distinguish between the two cases, we return a blanket
-			// error. TODO: issue read query for DB state for correct return value.
+			// Another insert won the race. We cannot tell whether it was a retry of
+			// this one or another owner's, so we return a blanket error.
 			err = util.InternalError
 		}
+		return
+	} else if err != nil {
+		return
+	}
+	if err = authorize(prev, data.Owner, false, c.users.isMember); err != nil {
+		return
+	}
+	next := prev
+	next.Long, next.Mode, next.ExpiresAt, next.MaxHits = data.Long, data.Mode, data.ExpiresAt, data.MaxHits
+	next.Version++
+	applied, err := c.compareAndSet(prev, next, "long", "mode", "expires_at", "max_hits", "version")
+	if !applied && err == nil {
+		// Versions are otherwise not compared; this only fails on a racing write.
+		err = util.VersionMismatchError{Expected: prev.Version, Actual: prev.Version + 1}
 	}
+	c.logger.Info("updated", "key", data.Short, "user", data.Owner, "err", err)
 	return
 }
 
+func (c *cqlShortStore) Restore(data ShortData) error {
+	s, n := c.tbl.InsertBuilder().ToCql()
+	return c.query(s, n).BindStruct(data.ToShortStruct()).ExecRelease()
+}
+
+func (c *cqlShortStore) Create(data ShortData) (err error) {
+	data.Version = 1
+	s, n := c.tbl.InsertBuilder().Unique().ToCql()
+	q := c.query(s, n).BindStruct(data.ToShortStruct())
+	applied, err := q.ExecCASRelease()
+	if !applied && err == nil {
+		err = util.AlreadyExistsError(data.Short)
+	}
+	return
+}
+
+func (c *cqlShortStore) Update(data ShortData) (err error) {
+	return c.versioned(data, data.Owner, false, func(next *ShortData) {
+		next.Long, next.Mode, next.ExpiresAt, next.MaxHits = data.Long, data.Mode, data.ExpiresAt, data.MaxHits
+	}, "long", "mode", "expires_at", "max_hits", "version")
+}
+
+func (c *cqlShortStore) SetOwners(caller uint64, data ShortData) (err error) {
+	return c.versioned(data, caller, true, func(next *ShortData) {
+		next.Owner, next.Group, next.Editors = data.Owner, data.Group, data.Editors
+	}, "owner", "group_id", "editors", "version")
+}
+
+// versioned applies change to the stored entry and writes cols if caller may
+// change it and its version matches data.Version.
+func (c *cqlShortStore) versioned(data ShortData, caller uint64, ownersOnly bool, change func(*ShortData), cols ...string) (err error) {
+	prev, err := c.Get(data.Short)
+	if _, ok := err.(util.NoSuchKeyError); !ok && err != nil {
+		return
+	}
+	if err = checkVersioned(prev, err == nil, data, caller, ownersOnly, c.users.isMember); err != nil {
+		return
+	}
+	next := prev
+	change(&next)
+	next.Version++
+	applied, err := c.compareAndSet(prev, next, cols...)
+	if applied || err != nil {
+		return
+	}
+	// Not applied; find out why.
+	prev, err = c.Get(data.Short)
+	if _, ok := err.(util.NoSuchKeyError); !ok && err != nil {
+		return
+	}
+	return versionedFailure(prev, err == nil, data, caller, ownersOnly, c.users.isMember)
+}
+
+// compareAndSet writes cols of next if the stored entry still has prev's owner
+// and version.
+func (c *cqlShortStore) compareAndSet(prev, next ShortData, cols ...string) (applied bool, err error) {
+	s, n := c.tbl.UpdateBuilder(cols...).
+		If(casConditions(prev)...).
+		ToCql()
+	q := c.query(s, n).BindStructMap(next.ToShortStruct(), casArgs(prev))
+	return q.ExecCASRelease()
+}
+
+// casConditions match an entry that has not changed since prev was read. The
+// owner is always set, so the conditions also fail if the entry was deleted.
+func casConditions(prev ShortData) []qb.Cmp {
+	version := qb.EqNamed("version", "prev_version")
+	if prev.Version == 0 {
+		// Rows written before versioning have no version.
+		version = qb.EqLit("version", "null")
+	}
+	return []qb.Cmp{qb.EqNamed("owner", "prev_owner"), version}
+}
+
+func casArgs(prev ShortData) qb.M {
+	return qb.M{
+		"prev_owner":   int64(prev.Owner),
+		"prev_version": int32(prev.Version),
+	}
+}
+
 func (c *cqlShortStore) Get(short string) (data ShortData, err error) {
 	d := schema.ShortStruct{
 		Short: short,
 	}
-	q := c.session.Query(c.tbl.Get()).BindStruct(d)
+	q := c.query(c.tbl.Get()).BindStruct(d)
 	err = q.GetRelease(&d)
+	if err == gocql.ErrNotFound {
+		err = util.NoSuchKeyError(short)
+	}
 	data = ToShortData(d)
 	return
 }
 
 func (c *cqlShortStore) Delete(entry ShortData) (err error) {
-	d := schema.ShortStruct{
-		Short: entry.Short,
+	prev, err := c.Get(entry.Short)
+	if _, ok := err.(util.NoSuchKeyError); ok {
+		return nil
+	} else if err != nil {
+		return
 	}
-	s, n := c.tbl.Delete()
-	s += fmt.Sprintf("IF owner=%v", entry.Owner)
-	q := c.session.Query(s, n).BindStruct(d)
-	applied, err := q.ExecCASRelease()
+	if err = authorize(prev, entry.Owner, true, c.users.isMember); err != nil {
+		return
+	}
+	applied, err := c.deleteUnchanged(prev)
 	if !applied && err == nil {
-		err = util.PermissionDeniedError
+		// Changed since it was read; it may no longer be ours to delete.
+		err = util.VersionMismatchError{Expected: prev.Version, Actual: prev.Version + 1}
+	}
+	return
+}
+
+// deleteUnchanged deletes prev and its hits if the stored entry has not
+// changed since it was read.
+func (c *cqlShortStore) deleteUnchanged(prev ShortData) (applied bool, err error) {
+	s, n := qb.Delete(c.tbl.Name()).
+		Where(qb.Eq("short")).
+		If(casConditions(prev)...).
+		ToCql()
+	args := casArgs(prev)
+	args["short"] = prev.Short
+	if applied, err = c.query(s, n).BindMap(args).ExecCASRelease(); applied && err == nil {
+		err = c.hits.delete(prev.Short)
+	}
+	return
+}
+
+// List scans the whole table: short is the partition key, so cassandra can
+// only range over its token, not its value. Filtering and ordering happen
+// here.
+func (c *cqlShortStore) List(start string, end string) (results ListResults, err error) {
+	s, n := qb.Select(c.tbl.Name()).Columns(c.tbl.Metadata().Columns...).ToCql()
+	iter := c.query(s, n).Iter()
+	var d schema.ShortStruct
+	for iter.StructScan(&d) {
+		if inRange(d.Short, start, end) {
+			results.Matching = append(results.Matching, ToShortData(d))
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return
+	}
+	sort.Slice(results.Matching, func(i, j int) bool {
+		return results.Matching[i].Short < results.Matching[j].Short
+	})
+	return
+}
+
+// ListPage pages through the whole table, filtering each page, so results
+// are in token order and the cursor is cassandra's paging state, as for
+// ListByOwner.
+func (c *cqlShortStore) ListPage(start, end, cursor string, limit int) (results ListResults, err error) {
+	if limit <= 0 {
+		return c.List(start, end)
+	}
+	state, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		err = util.InvalidValueError(cursor)
+		return
+	}
+	s, n := qb.Select(c.tbl.Name()).Columns(c.tbl.Metadata().Columns...).ToCql()
+	// Setting the paging state disables automatic paging.
+	iter := c.query(s, n).PageSize(limit).PageState(state).Iter()
+	var d schema.ShortStruct
+	for iter.StructScan(&d) {
+		if inRange(d.Short, start, end) {
+			results.Matching = append(results.Matching, ToShortData(d))
+		}
+	}
+	if next := iter.PageState(); len(next) > 0 {
+		results.Next = base64.URLEncoding.EncodeToString(next)
 	}
+	err = iter.Close()
 	return
 }
 
-func (c *cqlShortStore) List(start string, end string) (ListResults, error) {
-	panic("not implemented") // TODO: Implement
+// ListByOwner reads through the secondary index on owner. Results are in token
+// order, and the cursor is cassandra's paging state.
+func (c *cqlShortStore) ListByOwner(owner uint64, cursor string, limit int) (results ListResults, err error) {
+	state, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		err = util.InvalidValueError(cursor)
+		return
+	}
+	stmt, names := qb.Select(c.tbl.Name()).
+		Columns(c.tbl.Metadata().Columns...).
+		Where(qb.Eq("owner")).
+		ToCql()
+	q := c.session.Query(stmt, names).BindMap(qb.M{"owner": int64(owner)})
+	if limit > 0 {
+		// Setting the paging state disables automatic paging.
+		q = q.PageSize(limit).PageState(state)
+	}
+	iter := q.Iter()
+	var d schema.ShortStruct
+	for iter.StructScan(&d) {
+		results.Matching = append(results.Matching, ToShortData(d))
+	}
+	if next := iter.PageState(); limit > 0 && len(next) > 0 {
+		results.Next = base64.URLEncoding.EncodeToString(next)
+	}
+	err = iter.Close()
+	return
+}
+
+// DeleteExpired scans the whole table, as List does. Expiry is kept only in
+// expires_at rather than as a TTL, which would apply to just the cells a write
+// sets; until they are reaped, expired entries are read like any other and
+// the service stops resolving them. Entries changed since the scan are left
+// for the next one.
+func (c *cqlShortStore) DeleteExpired(now time.Time) (n int, err error) {
+	results, err := c.List("", "")
+	if err != nil {
+		return
+	}
+	for _, entry := range results.Matching {
+		if !entry.Expired(now, 0) {
+			continue
+		}
+		var applied bool
+		if applied, err = c.deleteUnchanged(entry); err != nil {
+			return
+		} else if applied {
+			n++
+		}
+	}
+	return
+}
+
+func (c *cqlHitStore) Record(hits []Hit) (err error) {
+	counts := make(map[string]int64)
+	stmt, names := c.clicks.Insert()
+	for _, h := range hits {
+		counts[h.Short]++
+		d := schema.ClicksStruct{
+			Host:      h.Host,
+			Id:        gocql.UUIDFromTime(h.Timestamp),
+			Referrer:  h.Referrer,
+			Short:     h.Short,
+			Ts:        h.Timestamp,
+			UserAgent: h.UserAgent,
+		}
+		if err = c.query(stmt, names).BindStruct(d).ExecRelease(); err != nil {
+			c.logger.Warn("failed to insert click", "short", h.Short, "err", err)
+			return
+		}
+	}
+	// Counter columns cannot be set, only modified.
+	stmt, names = qb.Update(c.counts.Name()).Add("hits").Where(qb.Eq("short")).ToCql()
+	for short, n := range counts {
+		q := c.session.Query(stmt, names).BindMap(qb.M{"short": short, "hits": n})
+		if err = q.ExecRelease(); err != nil {
+			c.logger.Warn("failed to increment hits", "short", short, "err", err)
+			return
+		}
+	}
+	return
+}
+
+// delete removes the clicks of short and zeroes its count, so that a short
+// created with its name starts without them. Deleted counters cannot be
+// incremented again, so the count is subtracted instead.
+func (c *cqlHitStore) delete(short string) error {
+	stmt, names := qb.Delete(c.clicks.Name()).Where(qb.Eq("short")).ToCql()
+	if err := c.query(stmt, names).BindMap(qb.M{"short": short}).ExecRelease(); err != nil {
+		return err
+	}
+	n, err := c.Count(short)
+	if err != nil || n == 0 {
+		return err
+	}
+	stmt, names = qb.Update(c.counts.Name()).Remove("hits").Where(qb.Eq("short")).ToCql()
+	return c.query(stmt, names).BindMap(qb.M{"short": short, "hits": n}).ExecRelease()
+}
+
+func (c *cqlHitStore) Count(short string) (count int64, err error) {
+	d := schema.HitCountsStruct{Short: short}
+	err = c.query(c.counts.Get()).BindStruct(d).GetRelease(&d)
+	if err == gocql.ErrNotFound {
+		err = nil
+	}
+	count = int64(d.Hits)
+	return
+}
+
+// cqlCountsBatchSize bounds the partitions read per query.
+const cqlCountsBatchSize = 100
+
+func (c *cqlHitStore) Counts(shorts []string) (counts map[string]int64, err error) {
+	counts = make(map[string]int64, len(shorts))
+	stmt, names := qb.Select(c.counts.Name()).Columns("short", "hits").Where(qb.In("short")).ToCql()
+	for i := 0; i < len(shorts); i += cqlCountsBatchSize {
+		batch := shorts[i:min(i+cqlCountsBatchSize, len(shorts))]
+		iter := c.query(stmt, names).BindMap(qb.M{"short": batch}).Iter()
+		var d schema.HitCountsStruct
+		for iter.StructScan(&d) {
+			counts[d.Short] = int64(d.Hits)
+		}
+		if err = iter.Close(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *cqlHitStore) Clicks(short string, since, until time.Time) (hits []Hit, err error) {
+	stmt, names := qb.Select(c.clicks.Name()).
+		Columns(c.clicks.Metadata().Columns...).
+		Where(qb.Eq("short"), qb.GtOrEqNamed("ts", "since"), qb.LtNamed("ts", "until")).
+		ToCql()
+	iter := c.query(stmt, names).
+		BindMap(qb.M{"short": short, "since": since, "until": until}).
+		Iter()
+	var d schema.ClicksStruct
+	for iter.StructScan(&d) {
+		hits = append(hits, Hit{
+			Short:     d.Short,
+			Timestamp: d.Ts,
+			Host:      d.Host,
+			Referrer:  d.Referrer,
+			UserAgent: d.UserAgent,
+		})
+	}
+	err = iter.Close()
+	return
 }
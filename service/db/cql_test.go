@@ -0,0 +1,25 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gocql/gocql"
+	"github.com/scylladb/gocqlx/v2"
+)
+
+func TestCQLQuery(t *testing.T) {
+	// Queries are only built, so the session need not be connected.
+	c := cqlDB{session: gocqlx.Session{Session: &gocql.Session{}, Mapper: gocqlx.DefaultMapper}}
+	q := c.query("SELECT * FROM short WHERE short=?", []string{"short"})
+	if q.Statement() != "SELECT * FROM short WHERE short=?" || q.Context() != context.Background() {
+		t.Errorf("Incorrect query %v in %v", q.Statement(), q.Context())
+	}
+
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, true)
+	c.bound = ctx
+	if q = c.query("SELECT * FROM short", nil); q.Context() != ctx {
+		t.Errorf("Query not bound to %v: %v", ctx, q.Context())
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"strings"
@@ -22,23 +23,36 @@ var (
 	schemaDir = fs.String("schema_dir", "./", "location of cql schemas")
 	dryRun    = fs.Bool("dry_run", false, "if true, output operations without affecting database")
 	basename  = fs.String("basename", "schema", "base filename, without cql extension")
+	target    = fs.Int("target", -1, "version to migrate up or down to; up defaults to the latest")
 
 	// cassandra flags
-	cqlHosts = fs.String("cqlHosts", "localhost:9042", "comma-separated list of host ips")
+	cqlHosts    = fs.String("cqlHosts", "localhost:9042", "comma-separated list of host ips")
+	cqlKeyspace = fs.String("cqlKeyspace", "tinyr", "keyspace that applied migrations are recorded in")
 )
 
 func main() {
-	ff.Parse(fs, os.Args[1:],
+	// up (the default), down or status, which comes before the flags: flags
+	// after it would not be parsed.
+	args, command := os.Args[1:], ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	ff.Parse(fs, args,
 		ff.WithEnvVarPrefix("TINYR"),
 		ff.WithConfigFileFlag("config"),
 		ff.WithConfigFileParser(ff.PlainParser))
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %v; usage: %v [up|down|status] [flags]\n", fs.Args(), fs.Name())
+		fs.Usage()
+		os.Exit(2)
+	}
 
 	logger = slog.New(
 		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 			AddSource: true,
 			Level:     slog.LevelInfo,
 		}))
-	logger.Info("flags", "schema_dir", *schemaDir, "basename", *basename, "dry_run", *dryRun, "cqlHosts", *cqlHosts)
+	logger.Info("flags", "command", command, "target", *target, "schema_dir", *schemaDir, "basename", *basename, "dry_run", *dryRun, "cqlHosts", *cqlHosts)
 
 	util.OkOrDie(db.RunMigration(
 		db.MigrationArgs{
@@ -46,10 +60,13 @@ func main() {
 			SchemaDir: *schemaDir,
 			Basename:  *basename,
 			DryRun:    *dryRun,
+			Command:   command,
+			Target:    *target,
 			Extension: "cql",
 			Migrator: &migrate.CQLMigrator{
-				Hosts:  strings.Split(*cqlHosts, ","),
-				Logger: logger,
+				Hosts:    strings.Split(*cqlHosts, ","),
+				Keyspace: *cqlKeyspace,
+				Logger:   logger,
 			},
 		}))
 }
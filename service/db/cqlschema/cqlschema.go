@@ -3,17 +3,83 @@
 package cqlschema
 
 import (
+	"time"
+
 	"github.com/scylladb/gocqlx/v2/table"
 )
 
 // Table models.
 var (
+	Clicks = table.New(table.Metadata{
+		Name: "clicks",
+		Columns: []string{
+			"host",
+			"id",
+			"referrer",
+			"short",
+			"ts",
+			"user_agent",
+		},
+		PartKey: []string{
+			"short",
+		},
+		SortKey: []string{
+			"ts",
+			"id",
+		},
+	})
+
+	Groups = table.New(table.Metadata{
+		Name: "groups",
+		Columns: []string{
+			"gid",
+			"members",
+			"name",
+		},
+		PartKey: []string{
+			"gid",
+		},
+		SortKey: []string{},
+	})
+
+	HitCounts = table.New(table.Metadata{
+		Name: "hit_counts",
+		Columns: []string{
+			"hits",
+			"short",
+		},
+		PartKey: []string{
+			"short",
+		},
+		SortKey: []string{},
+	})
+
+	Memberships = table.New(table.Metadata{
+		Name: "memberships",
+		Columns: []string{
+			"gid",
+			"uid",
+		},
+		PartKey: []string{
+			"uid",
+		},
+		SortKey: []string{
+			"gid",
+		},
+	})
+
 	Short = table.New(table.Metadata{
 		Name: "short",
 		Columns: []string{
+			"editors",
+			"expires_at",
+			"group_id",
 			"long",
+			"max_hits",
+			"mode",
 			"owner",
 			"short",
+			"version",
 		},
 		PartKey: []string{
 			"short",
@@ -35,11 +101,38 @@ var (
 	})
 )
 
-type ShortStruct struct {
-	Long  string
-	Owner int64
+type ClicksStruct struct {
+	Host      string
+	Id        [16]byte
+	Referrer  string
+	Short     string
+	Ts        time.Time
+	UserAgent string
+}
+type GroupsStruct struct {
+	Gid     int64
+	Members []int64
+	Name    string
+}
+type HitCountsStruct struct {
+	Hits  int
 	Short string
 }
+type MembershipsStruct struct {
+	Gid int64
+	Uid int64
+}
+type ShortStruct struct {
+	Editors   []int64
+	ExpiresAt time.Time
+	GroupId   int64
+	Long      string
+	MaxHits   int64
+	Mode      int32
+	Owner     int64
+	Short     string
+	Version   int32
+}
 type UsersStruct struct {
 	Email string
 	Name  string
@@ -1,17 +1,54 @@
 package migrate
 
 import (
+	"fmt"
 	"log/slog"
+	"sort"
 	"strings"
 
 	"github.com/gocql/gocql"
 	"github.com/ml8/tinyr/service/db"
 )
 
+// CQL has no IF NOT EXISTS for added columns, so rerunning a schema that adds
+// them fails with one of these errors (cassandra, scylla). They are safe to
+// ignore.
+var alreadyApplied = []string{
+	"conflicts with an existing column",
+	"already exists",
+}
+
+func isAlreadyApplied(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, msg := range alreadyApplied {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Applied migrations are recorded in a table in the keyspace, which is created
+// with the first record, as the keyspace only exists once the base schema is
+// applied.
+const (
+	migrationsTable   = "schema_migrations"
+	createMigrationsQ = "CREATE TABLE IF NOT EXISTS %s.schema_migrations (version int, filename text, checksum text, applied_at timestamp, PRIMARY KEY (version))"
+	existsMigrationsQ = "SELECT table_name FROM system_schema.tables WHERE keyspace_name=? AND table_name=?"
+	listMigrationsQ   = "SELECT version, filename, checksum, applied_at FROM %s.schema_migrations"
+	insertMigrationQ  = "INSERT INTO %s.schema_migrations (version, filename, checksum, applied_at) VALUES (?, ?, ?, ?)"
+	deleteMigrationQ  = "DELETE FROM %s.schema_migrations WHERE version=?"
+)
+
 type CQLMigrator struct {
-	Hosts   []string
-	Logger  *slog.Logger
-	session *gocql.Session
+	Hosts []string
+	// Keyspace is where applied migrations are recorded; it defaults to tinyr,
+	// which the schemas create.
+	Keyspace string
+	Logger   *slog.Logger
+	session  *gocql.Session
 }
 
 func (c *CQLMigrator) InitDB() (err error) {
@@ -21,6 +58,47 @@ func (c *CQLMigrator) InitDB() (err error) {
 	return
 }
 
+func (c *CQLMigrator) keyspace() string {
+	if c.Keyspace == "" {
+		return "tinyr"
+	}
+	return c.Keyspace
+}
+
+func (c *CQLMigrator) Applied() (applied []db.Migration, err error) {
+	var name string
+	err = c.session.Query(existsMigrationsQ, c.keyspace(), migrationsTable).Scan(&name)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	iter := c.session.Query(fmt.Sprintf(listMigrationsQ, c.keyspace())).Iter()
+	var m db.Migration
+	for iter.Scan(&m.Version, &m.Filename, &m.Checksum, &m.AppliedAt) {
+		applied = append(applied, m)
+	}
+	if err = iter.Close(); err != nil {
+		return
+	}
+	// Rows are in token order.
+	sort.Slice(applied, func(i, j int) bool {
+		return applied[i].Version < applied[j].Version
+	})
+	return
+}
+
+func (c *CQLMigrator) Record(m db.Migration) (err error) {
+	if err = c.session.Query(fmt.Sprintf(createMigrationsQ, c.keyspace())).Exec(); err != nil {
+		return
+	}
+	return c.session.Query(fmt.Sprintf(insertMigrationQ, c.keyspace()), m.Version, m.Filename, m.Checksum, m.AppliedAt).Exec()
+}
+
+func (c *CQLMigrator) Forget(version int) error {
+	return c.session.Query(fmt.Sprintf(deleteMigrationQ, c.keyspace()), version).Exec()
+}
+
 func (c *CQLMigrator) Complete() {
 	c.session.Close()
 	c.Logger.Info("closed session")
@@ -37,6 +115,10 @@ func (c *CQLMigrator) ApplySchema(s db.Schema, dry_run bool) (err error) {
 			c.Logger.Info("query", "idx", i, "query", next)
 		} else {
 			err = c.session.Query(next).Exec()
+			if isAlreadyApplied(err) {
+				c.Logger.Info("already applied", "idx", i, "query", next)
+				err = nil
+			}
 		}
 		if err != nil {
 			break
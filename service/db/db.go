@@ -1,12 +1,18 @@
 package db
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
+	"github.com/ml8/tinyr/service/healthz"
 	"github.com/ml8/tinyr/service/util"
 )
 
@@ -17,9 +23,18 @@ const (
 	SQL
 )
 
-var (
-	logger *slog.Logger
-)
+// tracerName names the tracer of database drivers.
+const tracerName = "github.com/ml8/tinyr/service/db"
+
+var typeNames = []string{"memory", "pebble", "cql", "sql"}
+
+// TypeName names a database type, e.g. for metrics.
+func TypeName(t int) string {
+	if t < 0 || t >= len(typeNames) {
+		return fmt.Sprintf("unknown(%d)", t)
+	}
+	return typeNames[t]
+}
 
 type Config struct {
 	Type   int
@@ -27,19 +42,88 @@ type Config struct {
 	CQL    CQLConfig
 	SQL    SQLConfig
 	Logger *slog.Logger
+	// Health is the registry that the SQL and CQL backends register their
+	// health checks with, until they are closed; nil is healthz.Default.
+	Health *healthz.Registry
 }
 
+// RedirectMode is how a short's long url is combined with the rest of a
+// request's path, e.g. "some/page" in a request for "/docs/some/page".
+type RedirectMode int
+
+const (
+	// RedirectPrefix appends the rest of the path to the long url.
+	RedirectPrefix RedirectMode = iota
+	// RedirectTemplate fills placeholders {1}, {2}, ... in the long url with
+	// successive segments of the rest of the path.
+	RedirectTemplate
+)
+
 type ShortData struct {
-	Short string `json:"Short"`
-	Long  string `json:"Long"`
-	Owner uint64 `json:"Owner"`
+	Short string `json:"Short" yaml:"Short"`
+	Long  string `json:"Long" yaml:"Long"`
+	Owner uint64 `json:"Owner" yaml:"Owner"`
+	// Group, if nonzero, is a group whose members share ownership.
+	Group uint64 `json:"Group" yaml:"Group,omitempty"`
+	// Editors may change the long url and limits, but not ownership.
+	Editors []uint64 `json:"Editors" yaml:"Editors,omitempty"`
+	// Mode is how Long is combined with any path following the short.
+	Mode RedirectMode `json:"Mode" yaml:"Mode,omitempty"`
+	// ExpiresAt is the time after which the short no longer resolves; zero
+	// never expires.
+	ExpiresAt time.Time `json:"ExpiresAt" yaml:"ExpiresAt,omitempty"`
+	// MaxHits is the number of redirects after which the short no longer
+	// resolves; zero is unlimited.
+	MaxHits int64 `json:"MaxHits" yaml:"MaxHits,omitempty"`
+	// Version is incremented on every write.
+	Version int `json:"Version" yaml:"Version,omitempty"`
+}
+
+// Expired is true iff the entry has passed its expiry time or hit limit.
+func (s ShortData) Expired(now time.Time, hits int64) bool {
+	return (!s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)) || (s.MaxHits > 0 && hits >= s.MaxHits)
 }
 
+// Writes are authorized against data.Owner, which is the user making the
+// change. An existing entry may be changed by its owner, members of its group
+// and its editors; only the first two may change its ownership or delete it.
 type ShortStore interface {
+	// Put stores data, replacing any entry the owner may edit regardless of its
+	// version. The ownership of a replaced entry is kept.
 	Put(data ShortData) error
+	// Create stores data only if its short is not already in use, and returns
+	// util.AlreadyExistsError otherwise.
+	Create(data ShortData) error
+	// Update replaces the long url and limits of an existing entry. data.Version
+	// must match the stored version, or util.VersionMismatchError is returned.
+	// The stored version is incremented.
+	Update(data ShortData) error
+	// SetOwners replaces the owner, group and editors of an existing entry with
+	// those in data, on behalf of caller. data.Version must match the stored
+	// version, which is incremented.
+	SetOwners(caller uint64, data ShortData) error
 	Get(short string) (ShortData, error)
+	// Delete removes an entry and its hits, so that a short created with its
+	// name starts without them.
 	Delete(data ShortData) error
+	// List returns all entries with start <= short <= end, ordered by short. An
+	// empty start or end leaves that side of the range unbounded.
 	List(start, end string) (ListResults, error)
+	// ListPage returns up to limit entries of List(start, end), starting after
+	// cursor, with the cursor for the following page as ListByOwner does. Pages
+	// before the last may hold fewer than limit entries.
+	ListPage(start, end, cursor string, limit int) (ListResults, error)
+	// ListByOwner returns up to limit entries owned by owner, starting after
+	// cursor. Results carry the cursor for the following page, which is empty
+	// once all entries have been returned. A limit <= 0 returns everything.
+	ListByOwner(owner uint64, cursor string, limit int) (ListResults, error)
+	// DeleteExpired removes entries whose expiry time is at or before now, with
+	// their hits, and returns how many were removed. Hit limits are not
+	// considered.
+	DeleteExpired(now time.Time) (int, error)
+	// Restore stores data exactly as given, version included, replacing any
+	// entry without checks. It is for copying data between stores.
+	Restore(data ShortData) error
 }
 
 type UserData struct {
@@ -48,39 +132,130 @@ type UserData struct {
 	Id    uint64 `json:"Id"`
 }
 
+type GroupData struct {
+	Id      uint64   `json:"Id"`
+	Name    string   `json:"Name"`
+	Members []uint64 `json:"Members"`
+}
+
+// GroupId returns the id of the group with the given name.
+func GroupId(name string) uint64 {
+	return util.Hash("group:" + name)
+}
+
 type UserStore interface {
 	LookupOrCreate(queryUser UserData) (user UserData)
 	Get(id uint64) (user UserData, err error)
 	Delete(id uint64) (err error)
+
+	// CreateGroup stores a new group, or returns util.AlreadyExistsError.
+	CreateGroup(group GroupData) error
+	GetGroup(id uint64) (GroupData, error)
+	// AddMember and RemoveMember are idempotent.
+	AddMember(group, uid uint64) error
+	RemoveMember(group, uid uint64) error
+	// GroupsOf returns the groups that uid is a member of.
+	GroupsOf(uid uint64) ([]GroupData, error)
+
+	// List and ListGroups return every user and group, ordered by id.
+	List() ([]UserData, error)
+	ListGroups() ([]GroupData, error)
+}
+
+// Hit records a single redirect through a short.
+type Hit struct {
+	Short     string    `json:"Short"`
+	Timestamp time.Time `json:"Timestamp"`
+	Host      string    `json:"Host"`
+	Referrer  string    `json:"Referrer"`
+	UserAgent string    `json:"UserAgent"`
+}
+
+// The longest Host, Referrer and UserAgent that are stored, which are the
+// sizes of their SQL columns.
+const (
+	maxHitHost      = 256
+	maxHitReferrer  = 2048
+	maxHitUserAgent = 1024
+)
+
+// Truncate returns h with its client-supplied fields cut to the lengths that
+// are stored.
+func (h Hit) Truncate() Hit {
+	h.Host = truncate(h.Host, maxHitHost)
+	h.Referrer = truncate(h.Referrer, maxHitReferrer)
+	h.UserAgent = truncate(h.UserAgent, maxHitUserAgent)
+	return h
+}
+
+// truncate cuts s to at most n bytes of valid UTF-8, without splitting a rune.
+func truncate(s string, n int) string {
+	s = strings.ToValidUTF8(s, "")
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+type HitStore interface {
+	// Record persists a batch of hits and adds them to the per-short counts.
+	Record(hits []Hit) error
+	// Count returns the total number of hits recorded for short.
+	Count(short string) (int64, error)
+	// Counts returns the totals of shorts, as Count does, in as few queries
+	// as the backend allows. Shorts without hits may be omitted.
+	Counts(shorts []string) (map[string]int64, error)
+	// Clicks returns the hits for short with since <= Timestamp < until, ordered
+	// by time.
+	Clicks(short string, since, until time.Time) ([]Hit, error)
 }
 
 type Interface interface {
 	Shorts() ShortStore
 	Users() UserStore
+	Hits() HitStore
+	// Close releases the database. The stores must not be used after.
+	Close() error
 }
 
-func (s ShortData) Encode() (b []byte, err error) {
-	return json.Marshal(s)
+// Contexter is implemented by databases whose stores can pass the context of
+// the request they serve to their driver, for tracing and cancellation.
+type Contexter interface {
+	// WithContext returns the database with its stores bound to ctx.
+	WithContext(ctx context.Context) Interface
 }
 
-func Decode(b []byte) (d ShortData, err error) {
-	d = ShortData{}
-	err = json.Unmarshal(b, &d)
-	return
+// WithContext binds the stores of d to ctx, if d supports it, and otherwise
+// returns d.
+func WithContext(ctx context.Context, d Interface) Interface {
+	if c, ok := d.(Contexter); ok {
+		return c.WithContext(ctx)
+	}
+	return d
 }
 
 func New(config Config) Interface {
-	logger = config.Logger
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
 	logger.Info("database config", "config", config)
+	health := config.Health
+	if health == nil {
+		health = healthz.Default
+	}
 	switch config.Type {
 	case InMemory:
 		return NewInMemory()
 	case Pebble:
-		return NewPebble(config.Pebble)
+		return NewPebble(config.Pebble, logger)
 	case CQL:
-		return NewCQLDB(config.CQL)
+		return NewCQLDB(config.CQL, logger, health)
 	case SQL:
-		return NewSQLDB(config.SQL)
+		return NewSQLDB(config.SQL, logger, health)
 	default:
 		logger.Error("Invalid type", "type", config.Type)
 		panic(errors.New(fmt.Sprintf("%v is not a valid database type", config.Type)))
@@ -89,27 +264,45 @@ func New(config Config) Interface {
 
 type ListResults struct {
 	Matching []ShortData
+	Next     string
 }
 
 type container struct {
 	s ShortStore
 	u UserStore
+	h HitStore
+	// close releases the backend, if it holds anything.
+	close func() error
+	// withContext binds the stores to a context, if they can use one.
+	withContext func(ctx context.Context) Interface
 }
 
 type ephemeralShortStore struct {
 	sync.RWMutex
-	sdb map[string]ShortData
+	sdb   map[string]ShortData
+	users *ephemeralUserStore
+	hits  *ephemeralHitStore
 }
 
 type ephemeralUserStore struct {
 	sync.RWMutex
 	udb map[uint64]UserData
+	gdb map[uint64]GroupData
+}
+
+type ephemeralHitStore struct {
+	sync.RWMutex
+	counts map[string]int64
+	clicks map[string][]Hit
 }
 
 func NewInMemory() Interface {
+	u := &ephemeralUserStore{sync.RWMutex{}, make(map[uint64]UserData), make(map[uint64]GroupData)}
+	h := &ephemeralHitStore{sync.RWMutex{}, make(map[string]int64), make(map[string][]Hit)}
 	return container{
-		s: &ephemeralShortStore{sync.RWMutex{}, make(map[string]ShortData)},
-		u: &ephemeralUserStore{sync.RWMutex{}, make(map[uint64]UserData)}}
+		s: &ephemeralShortStore{sync.RWMutex{}, make(map[string]ShortData), u, h},
+		u: u,
+		h: h}
 }
 
 func (c container) Shorts() ShortStore {
@@ -120,6 +313,24 @@ func (c container) Users() UserStore {
 	return c.u
 }
 
+func (c container) Close() error {
+	if c.close == nil {
+		return nil
+	}
+	return c.close()
+}
+
+func (c container) WithContext(ctx context.Context) Interface {
+	if c.withContext == nil {
+		return c
+	}
+	return c.withContext(ctx)
+}
+
+func (c container) Hits() HitStore {
+	return c.h
+}
+
 func (db *ephemeralShortStore) Get(key string) (entry ShortData, err error) {
 	db.RLock()
 	defer db.RUnlock()
@@ -135,38 +346,190 @@ func (db *ephemeralShortStore) Put(entry ShortData) (err error) {
 	db.Lock() // Do not interleave writes.
 	defer db.Unlock()
 	prev, ok := db.sdb[entry.Short]
-	if ok && prev.Owner != entry.Owner {
-		err = util.PermissionDeniedError
+	if ok {
+		if err = authorize(prev, entry.Owner, false, db.users.isMember); err != nil {
+			return
+		}
+		entry.Owner, entry.Group, entry.Editors = prev.Owner, prev.Group, prev.Editors
+	}
+	entry.Version = prev.Version + 1
+	db.sdb[entry.Short] = entry
+	return
+}
+
+func (db *ephemeralShortStore) Restore(entry ShortData) (err error) {
+	db.Lock()
+	defer db.Unlock()
+	db.sdb[entry.Short] = entry
+	return
+}
+
+func (db *ephemeralShortStore) Create(entry ShortData) (err error) {
+	db.Lock() // Do not interleave writes.
+	defer db.Unlock()
+	if _, ok := db.sdb[entry.Short]; ok {
+		err = util.AlreadyExistsError(entry.Short)
 		return
 	}
+	entry.Version = 1
 	db.sdb[entry.Short] = entry
 	return
 }
 
-func (db *ephemeralShortStore) Delete(entry ShortData) (err error) {
+func (db *ephemeralShortStore) Update(entry ShortData) (err error) {
 	db.Lock() // Do not interleave writes.
 	defer db.Unlock()
 	prev, ok := db.sdb[entry.Short]
-	if ok && prev.Owner != entry.Owner {
-		err = util.PermissionDeniedError
+	if err = checkVersioned(prev, ok, entry, entry.Owner, false, db.users.isMember); err != nil {
 		return
 	}
+	prev.Long, prev.Mode, prev.ExpiresAt, prev.MaxHits = entry.Long, entry.Mode, entry.ExpiresAt, entry.MaxHits
+	prev.Version++
+	db.sdb[entry.Short] = prev
+	return
+}
+
+func (db *ephemeralShortStore) SetOwners(caller uint64, entry ShortData) (err error) {
+	db.Lock() // Do not interleave writes.
+	defer db.Unlock()
+	prev, ok := db.sdb[entry.Short]
+	if err = checkVersioned(prev, ok, entry, caller, true, db.users.isMember); err != nil {
+		return
+	}
+	prev.Owner, prev.Group, prev.Editors = entry.Owner, entry.Group, entry.Editors
+	prev.Version++
+	db.sdb[entry.Short] = prev
+	return
+}
+
+// memberFunc reports whether uid is a member of group.
+type memberFunc func(group, uid uint64) (bool, error)
+
+// authorize returns util.PermissionDeniedError unless uid may change prev:
+// its owner, a member of its group or, unless ownersOnly, one of its editors.
+func authorize(prev ShortData, uid uint64, ownersOnly bool, member memberFunc) error {
+	if prev.Owner == uid || (!ownersOnly && slices.Contains(prev.Editors, uid)) {
+		return nil
+	}
+	if prev.Group != 0 {
+		if ok, err := member(prev.Group, uid); err != nil || ok {
+			return err
+		}
+	}
+	return util.PermissionDeniedError
+}
+
+// Authorize returns util.PermissionDeniedError unless uid may change data: its
+// owner, a member of its group or, unless ownersOnly, one of its editors.
+func Authorize(data ShortData, uid uint64, ownersOnly bool, users UserStore) error {
+	return authorize(data, uid, ownersOnly, func(group, uid uint64) (bool, error) {
+		g, err := users.GetGroup(group)
+		if _, ok := err.(util.NoSuchKeyError); ok {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return slices.Contains(g.Members, uid), nil
+	})
+}
+
+// checkVersioned returns the error, if any, for caller changing prev (which
+// exists iff ok) to entry.
+func checkVersioned(prev ShortData, ok bool, entry ShortData, caller uint64, ownersOnly bool, member memberFunc) error {
+	if !ok {
+		return util.NoSuchKeyError(entry.Short)
+	} else if err := authorize(prev, caller, ownersOnly, member); err != nil {
+		return err
+	} else if prev.Version != entry.Version {
+		return util.VersionMismatchError{Expected: entry.Version, Actual: prev.Version}
+	}
+	return nil
+}
+
+// versionedFailure explains why a conditional write of entry did not apply,
+// given the entry's state read afterwards. If that state allows the write, it
+// raced with another write.
+func versionedFailure(prev ShortData, ok bool, entry ShortData, caller uint64, ownersOnly bool, member memberFunc) error {
+	if err := checkVersioned(prev, ok, entry, caller, ownersOnly, member); err != nil {
+		return err
+	}
+	return util.VersionMismatchError{Expected: entry.Version, Actual: prev.Version}
+}
+
+func (db *ephemeralShortStore) Delete(entry ShortData) (err error) {
+	db.Lock() // Do not interleave writes.
+	defer db.Unlock()
+	prev, ok := db.sdb[entry.Short]
+	if ok {
+		if err = authorize(prev, entry.Owner, true, db.users.isMember); err != nil {
+			return
+		}
+	}
 	delete(db.sdb, entry.Short)
+	db.hits.delete(entry.Short)
 	return
 }
 
 func (db *ephemeralShortStore) List(start, end string) (results ListResults, err error) {
+	return db.ListPage(start, end, "", 0)
+}
+
+func (db *ephemeralShortStore) ListPage(start, end, cursor string, limit int) (results ListResults, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	results = ListResults{}
+	for k, v := range db.sdb {
+		if inRange(k, start, end) && k > cursor {
+			results.Matching = append(results.Matching, v)
+		}
+	}
+	sort.Slice(results.Matching, func(i, j int) bool {
+		return results.Matching[i].Short < results.Matching[j].Short
+	})
+	if limit > 0 && len(results.Matching) > limit {
+		results.Matching = results.Matching[:limit]
+		results.Next = results.Matching[limit-1].Short
+	}
+	return
+}
+
+func (db *ephemeralShortStore) ListByOwner(owner uint64, cursor string, limit int) (results ListResults, err error) {
 	db.RLock()
 	defer db.RUnlock()
 	results = ListResults{}
 	for k, v := range db.sdb {
-		if k >= start && k <= end {
+		if v.Owner == owner && k > cursor {
 			results.Matching = append(results.Matching, v)
 		}
 	}
+	sort.Slice(results.Matching, func(i, j int) bool {
+		return results.Matching[i].Short < results.Matching[j].Short
+	})
+	if limit > 0 && len(results.Matching) > limit {
+		results.Matching = results.Matching[:limit]
+		results.Next = results.Matching[limit-1].Short
+	}
 	return
 }
 
+func (db *ephemeralShortStore) DeleteExpired(now time.Time) (n int, err error) {
+	db.Lock()
+	defer db.Unlock()
+	for k, v := range db.sdb {
+		if v.Expired(now, 0) {
+			delete(db.sdb, k)
+			db.hits.delete(k)
+			n++
+		}
+	}
+	return
+}
+
+// inRange is true iff start <= k <= end, where empty bounds are unbounded.
+func inRange(k, start, end string) bool {
+	return (start == "" || k >= start) && (end == "" || k <= end)
+}
+
 func (db *ephemeralUserStore) LookupOrCreate(queryUser UserData) (user UserData) {
 	db.Lock()
 	defer db.Unlock()
@@ -197,3 +560,146 @@ func (db *ephemeralUserStore) Delete(id uint64) (err error) {
 	delete(db.udb, id)
 	return
 }
+
+func (db *ephemeralUserStore) List() (users []UserData, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	for _, u := range db.udb {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+	return
+}
+
+func (db *ephemeralUserStore) ListGroups() (groups []GroupData, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	for _, g := range db.gdb {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Id < groups[j].Id
+	})
+	return
+}
+
+func (db *ephemeralUserStore) CreateGroup(group GroupData) (err error) {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.gdb[group.Id]; ok {
+		err = util.AlreadyExistsError(group.Name)
+		return
+	}
+	db.gdb[group.Id] = group
+	return
+}
+
+func (db *ephemeralUserStore) GetGroup(id uint64) (group GroupData, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	var ok bool
+	if group, ok = db.gdb[id]; !ok {
+		err = util.NoSuchKeyError(fmt.Sprintf("%d", id))
+	}
+	return
+}
+
+func (db *ephemeralUserStore) AddMember(id, uid uint64) (err error) {
+	db.Lock()
+	defer db.Unlock()
+	group, ok := db.gdb[id]
+	if !ok {
+		err = util.NoSuchKeyError(fmt.Sprintf("%d", id))
+		return
+	}
+	if !slices.Contains(group.Members, uid) {
+		group.Members = append(slices.Clone(group.Members), uid)
+		db.gdb[id] = group
+	}
+	return
+}
+
+func (db *ephemeralUserStore) RemoveMember(id, uid uint64) (err error) {
+	db.Lock()
+	defer db.Unlock()
+	group, ok := db.gdb[id]
+	if !ok {
+		err = util.NoSuchKeyError(fmt.Sprintf("%d", id))
+		return
+	}
+	group.Members = slices.DeleteFunc(slices.Clone(group.Members), func(m uint64) bool { return m == uid })
+	db.gdb[id] = group
+	return
+}
+
+func (db *ephemeralUserStore) GroupsOf(uid uint64) (groups []GroupData, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	for _, group := range db.gdb {
+		if slices.Contains(group.Members, uid) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return
+}
+
+func (db *ephemeralUserStore) isMember(id, uid uint64) (bool, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return slices.Contains(db.gdb[id].Members, uid), nil
+}
+
+func (db *ephemeralHitStore) Record(hits []Hit) (err error) {
+	db.Lock()
+	defer db.Unlock()
+	for _, h := range hits {
+		db.counts[h.Short]++
+		db.clicks[h.Short] = append(db.clicks[h.Short], h)
+	}
+	return
+}
+
+// delete removes the hits of short, so that a short created with its name
+// starts without them.
+func (db *ephemeralHitStore) delete(short string) {
+	db.Lock()
+	defer db.Unlock()
+	delete(db.counts, short)
+	delete(db.clicks, short)
+}
+
+func (db *ephemeralHitStore) Count(short string) (count int64, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	count = db.counts[short]
+	return
+}
+
+func (db *ephemeralHitStore) Counts(shorts []string) (counts map[string]int64, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	counts = make(map[string]int64, len(shorts))
+	for _, short := range shorts {
+		counts[short] = db.counts[short]
+	}
+	return
+}
+
+func (db *ephemeralHitStore) Clicks(short string, since, until time.Time) (hits []Hit, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	for _, h := range db.clicks[short] {
+		if !h.Timestamp.Before(since) && h.Timestamp.Before(until) {
+			hits = append(hits, h)
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Timestamp.Before(hits[j].Timestamp)
+	})
+	return
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/db/dbcopy"
+	"github.com/ml8/tinyr/service/util"
+)
+
+var (
+	logger *slog.Logger
+	fs     = flag.NewFlagSet("dbcopy", flag.ExitOnError)
+
+	// copy flags
+	_          = fs.String("config", "", "config file")
+	checkpoint = fs.String("checkpoint", "dbcopy.checkpoint", "file to save progress to and resume from; empty disables")
+	batchSize  = fs.Int("batchSize", dbcopy.DefaultBatchSize, "records copied between checkpoints")
+	verifyOnly = fs.Bool("verify_only", false, "if true, only compare source and destination")
+
+	src = backendFlags("src")
+	dst = backendFlags("dst")
+)
+
+type backend struct {
+	typ, pebblePath, pebbleCodec, cqlHosts, cqlKeyspace, connStr, sqlDriver *string
+}
+
+func backendFlags(prefix string) backend {
+	return backend{
+		typ:         fs.String(prefix+"Type", "", "database type: pebble, cql or sql"),
+		pebblePath:  fs.String(prefix+"PebblePath", "", "path to PebbleDB directory"),
+		pebbleCodec: fs.String(prefix+"PebbleCodec", db.GobCodec, "codec for PebbleDB values: gob, json or msgpack"),
+		cqlHosts:    fs.String(prefix+"CqlHosts", "", "comma-separated list of cql hosts"),
+		cqlKeyspace: fs.String(prefix+"CqlKeyspace", "tinyr", "keyspace for cql"),
+		connStr:     fs.String(prefix+"ConnStr", "", "sql connection string"),
+		sqlDriver:   fs.String(prefix+"SqlDriver", "mysql", "sql database driver"),
+	}
+}
+
+func (b backend) config() (cfg db.Config, err error) {
+	cfg.Logger = logger
+	switch *b.typ {
+	case "pebble":
+		cfg.Type = db.Pebble
+		cfg.Pebble.Path = *b.pebblePath
+		cfg.Pebble.Codec = *b.pebbleCodec
+	case "cql":
+		cfg.Type = db.CQL
+		cfg.CQL.Hosts = strings.Split(*b.cqlHosts, ",")
+		cfg.CQL.Keyspace = *b.cqlKeyspace
+	case "sql":
+		cfg.Type = db.SQL
+		cfg.SQL.ConnString = *b.connStr
+		cfg.SQL.Driver = *b.sqlDriver
+	default:
+		err = util.InvalidValueError(*b.typ)
+	}
+	return
+}
+
+// identity names the database b configures, for checkpoints. Connection
+// strings, which may hold passwords, are digested.
+func (b backend) identity() string {
+	switch *b.typ {
+	case "pebble":
+		return "pebble:" + *b.pebblePath
+	case "cql":
+		return "cql:" + *b.cqlHosts + "/" + *b.cqlKeyspace
+	case "sql":
+		sum := sha256.Sum256([]byte(*b.connStr))
+		return "sql:" + *b.sqlDriver + ":" + hex.EncodeToString(sum[:8])
+	}
+	return *b.typ
+}
+
+func main() {
+	ff.Parse(fs, os.Args[1:],
+		ff.WithEnvVarPrefix("TINYR"),
+		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(ff.PlainParser))
+
+	logger = slog.New(
+		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			AddSource: true,
+			Level:     slog.LevelInfo,
+		}))
+	logger.Info("flags", "src", *src.typ, "dst", *dst.typ, "checkpoint", *checkpoint, "verify_only", *verifyOnly)
+
+	srcConfig, err := src.config()
+	util.OkOrDie(err)
+	dstConfig, err := dst.config()
+	util.OkOrDie(err)
+	from, to := db.New(srcConfig), db.New(dstConfig)
+
+	if !*verifyOnly {
+		_, err = dbcopy.Copy(from, to, dbcopy.Options{
+			Checkpoint:  *checkpoint,
+			Source:      src.identity(),
+			Destination: dst.identity(),
+			BatchSize:   *batchSize,
+			Logger:      logger,
+		})
+		util.OkOrDie(err)
+	}
+
+	report, err := dbcopy.Verify(from, to)
+	util.OkOrDie(err)
+	// Pebble must be closed cleanly; the destination is used next.
+	util.OkOrDie(from.Close())
+	util.OkOrDie(to.Close())
+	for _, s := range []struct {
+		name string
+		dbcopy.Summary
+	}{{"users", report.Users}, {"groups", report.Groups}, {"shorts", report.Shorts}} {
+		logger.Info("Verified", "records", s.name, "ok", s.OK(), "src", s.Src, "dst", s.Dst, "srcSum", s.SrcSum, "dstSum", s.DstSum, "mismatched", s.Mismatched)
+	}
+	if !report.OK() {
+		fmt.Fprintln(os.Stderr, "copy does not match source")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,399 @@
+// Package dbcopy copies users, groups and shorts from one database to another,
+// e.g. to move between backends, and verifies the copy.
+//
+// Copies are offline: nothing else should write to either database meanwhile.
+// Hit counts and clicks are not copied.
+package dbcopy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// Copy phases, in order.
+const (
+	PhaseUsers  = "users"
+	PhaseGroups = "groups"
+	PhaseShorts = "shorts"
+	PhaseDone   = "done"
+)
+
+// DefaultBatchSize is the number of records copied between checkpoints.
+const DefaultBatchSize = 500
+
+// maxMismatches bounds the keys listed in a Summary.
+const maxMismatches = 100
+
+type Options struct {
+	// Checkpoint is the file that progress is saved to, and resumed from if it
+	// exists. If empty, copies always start from the beginning.
+	Checkpoint string
+	// Source and Destination identify the databases, so that a checkpoint is
+	// only resumed by the copy that saved it.
+	Source, Destination string
+	BatchSize           int
+	Logger              *slog.Logger
+}
+
+// Checkpoint records how far a copy got: every record in earlier phases, and
+// every record in Phase up to and including Last, has been copied.
+type Checkpoint struct {
+	Source      string
+	Destination string
+	Phase       string
+	Last        string
+	Users       int
+	Groups      int
+	Shorts      int
+}
+
+// Copy copies every user, group and short from src to dst, resuming from
+// opts.Checkpoint if there is one. Shorts are stored as they are, versions and
+// ownership included, replacing any already in dst.
+func Copy(src, dst db.Interface, opts Options) (cp Checkpoint, err error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if cp, err = loadCheckpoint(opts.Checkpoint, opts.Source, opts.Destination); err != nil {
+		return
+	}
+	if cp.Phase != PhaseUsers {
+		opts.Logger.Info("Resuming", "phase", cp.Phase, "last", cp.Last)
+	}
+	c := copier{src: src, dst: dst, opts: opts, cp: &cp}
+	for _, phase := range []func() error{c.users, c.groups, c.shorts} {
+		if err = phase(); err != nil {
+			return
+		}
+	}
+	opts.Logger.Info("Copied", "users", cp.Users, "groups", cp.Groups, "shorts", cp.Shorts)
+	return
+}
+
+type copier struct {
+	src, dst db.Interface
+	opts     Options
+	cp       *Checkpoint
+	pending  int
+}
+
+func (c *copier) users() error {
+	if c.cp.Phase != PhaseUsers {
+		return nil
+	}
+	users, err := c.src.Users().List()
+	if err != nil {
+		return err
+	}
+	after, err := c.lastId()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.Id <= after && c.cp.Last != "" {
+			continue
+		}
+		c.dst.Users().LookupOrCreate(u)
+		c.cp.Users++
+		if err = c.copied(strconv.FormatUint(u.Id, 10)); err != nil {
+			return err
+		}
+	}
+	return c.next(PhaseGroups)
+}
+
+func (c *copier) groups() error {
+	if c.cp.Phase != PhaseGroups {
+		return nil
+	}
+	groups, err := c.src.Users().ListGroups()
+	if err != nil {
+		return err
+	}
+	after, err := c.lastId()
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Id <= after && c.cp.Last != "" {
+			continue
+		}
+		err = c.dst.Users().CreateGroup(g)
+		if _, exists := err.(util.AlreadyExistsError); exists {
+			// Left by an interrupted copy, or already in dst.
+			err = nil
+			for _, uid := range g.Members {
+				if err = c.dst.Users().AddMember(g.Id, uid); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("group %v: %w", g.Name, err)
+		}
+		c.cp.Groups++
+		if err = c.copied(strconv.FormatUint(g.Id, 10)); err != nil {
+			return err
+		}
+	}
+	return c.next(PhaseShorts)
+}
+
+func (c *copier) shorts() error {
+	if c.cp.Phase != PhaseShorts {
+		return nil
+	}
+	start := ""
+	if c.cp.Last != "" {
+		// List is inclusive; no short sorts between Last and this.
+		start = c.cp.Last + "\x00"
+	}
+	results, err := c.src.Shorts().List(start, "")
+	if err != nil {
+		return err
+	}
+	for _, data := range results.Matching {
+		if err = c.dst.Shorts().Restore(data); err != nil {
+			return fmt.Errorf("short %v: %w", data.Short, err)
+		}
+		c.cp.Shorts++
+		if err = c.copied(data.Short); err != nil {
+			return err
+		}
+	}
+	return c.next(PhaseDone)
+}
+
+// lastId parses the checkpointed id of the current phase.
+func (c *copier) lastId() (uint64, error) {
+	if c.cp.Last == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(c.cp.Last, 10, 64)
+	if err != nil {
+		return 0, util.InvalidValueError(c.cp.Last)
+	}
+	return id, nil
+}
+
+// copied notes that key was copied, saving a checkpoint every batch.
+func (c *copier) copied(key string) error {
+	c.cp.Last = key
+	if c.pending++; c.pending < c.opts.BatchSize {
+		return nil
+	}
+	c.opts.Logger.Info("Checkpoint", "phase", c.cp.Phase, "last", key)
+	return c.save()
+}
+
+func (c *copier) next(phase string) error {
+	c.cp.Phase, c.cp.Last = phase, ""
+	return c.save()
+}
+
+func (c *copier) save() error {
+	c.pending = 0
+	return saveCheckpoint(c.opts.Checkpoint, *c.cp)
+}
+
+// loadCheckpoint reads the checkpoint at path, which must be for copying src to
+// dst, or returns a new one.
+func loadCheckpoint(path, src, dst string) (cp Checkpoint, err error) {
+	cp.Source, cp.Destination, cp.Phase = src, dst, PhaseUsers
+	if path == "" {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cp, nil
+	} else if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &cp); err != nil {
+		return
+	}
+	if !slices.Contains([]string{PhaseUsers, PhaseGroups, PhaseShorts, PhaseDone}, cp.Phase) {
+		err = util.InvalidValueError(cp.Phase)
+	} else if cp.Source != src || cp.Destination != dst {
+		err = fmt.Errorf("checkpoint %v is for copying %q to %q, not %q to %q", path, cp.Source, cp.Destination, src, dst)
+	}
+	return
+}
+
+// saveCheckpoint replaces the checkpoint at path by renaming, so that it is
+// never left half written.
+func saveCheckpoint(path string, cp Checkpoint) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Summary compares one kind of record in the source and destination. Sums are
+// checksums over every record; Mismatched lists keys, up to a limit, that are
+// missing from either side or differ.
+type Summary struct {
+	Src, Dst       int
+	SrcSum, DstSum string
+	Mismatched     []string
+}
+
+func (s Summary) OK() bool {
+	return s.Src == s.Dst && s.SrcSum == s.DstSum
+}
+
+type Report struct {
+	Users  Summary
+	Groups Summary
+	Shorts Summary
+}
+
+func (r Report) OK() bool {
+	return r.Users.OK() && r.Groups.OK() && r.Shorts.OK()
+}
+
+// Verify compares every user, group and short in src and dst.
+func Verify(src, dst db.Interface) (r Report, err error) {
+	var s, d map[string]string
+	if s, err = userDigests(src); err != nil {
+		return
+	} else if d, err = userDigests(dst); err != nil {
+		return
+	}
+	r.Users = summarize(s, d)
+	if s, err = groupDigests(src); err != nil {
+		return
+	} else if d, err = groupDigests(dst); err != nil {
+		return
+	}
+	r.Groups = summarize(s, d)
+	if s, err = shortDigests(src); err != nil {
+		return
+	} else if d, err = shortDigests(dst); err != nil {
+		return
+	}
+	r.Shorts = summarize(s, d)
+	return
+}
+
+func userDigests(d db.Interface) (map[string]string, error) {
+	users, err := d.Users().List()
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string)
+	for _, u := range users {
+		digests[strconv.FormatUint(u.Id, 10)] = digest(u)
+	}
+	return digests, nil
+}
+
+func groupDigests(d db.Interface) (map[string]string, error) {
+	groups, err := d.Users().ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string)
+	for _, g := range groups {
+		g.Members = sorted(g.Members)
+		digests[strconv.FormatUint(g.Id, 10)] = digest(g)
+	}
+	return digests, nil
+}
+
+func shortDigests(d db.Interface) (map[string]string, error) {
+	results, err := d.Shorts().List("", "")
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string)
+	for _, data := range results.Matching {
+		data.Editors = sorted(data.Editors)
+		// Backends store expiry at different precisions and zones.
+		if data.ExpiresAt.IsZero() {
+			data.ExpiresAt = time.Time{}
+		} else {
+			data.ExpiresAt = data.ExpiresAt.UTC().Truncate(time.Millisecond)
+		}
+		digests[data.Short] = digest(data)
+	}
+	return digests, nil
+}
+
+// sorted copies ids in order, so that backends that store sets compare equal,
+// and makes empty and nil alike.
+func sorted(ids []uint64) []uint64 {
+	if len(ids) == 0 {
+		return nil
+	}
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	return ids
+}
+
+func digest(v any) string {
+	b, err := json.Marshal(v)
+	util.OkOrDie(err)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func summarize(src, dst map[string]string) (s Summary) {
+	s.Src, s.Dst = len(src), len(dst)
+	s.SrcSum, s.DstSum = checksum(src), checksum(dst)
+	keys := make(map[string]bool)
+	for k := range src {
+		keys[k] = true
+	}
+	for k := range dst {
+		keys[k] = true
+	}
+	for k := range keys {
+		if src[k] != dst[k] {
+			s.Mismatched = append(s.Mismatched, k)
+		}
+	}
+	sort.Strings(s.Mismatched)
+	if len(s.Mismatched) > maxMismatches {
+		s.Mismatched = s.Mismatched[:maxMismatches]
+	}
+	return
+}
+
+// checksum combines digests in key order.
+func checksum(digests map[string]string) string {
+	keys := make([]string, 0, len(digests))
+	for k := range digests {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s\x00%s\n", k, digests[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,101 @@
+package dbcopy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ml8/tinyr/service/db"
+)
+
+func populate(t *testing.T, d db.Interface) {
+	alice := d.Users().LookupOrCreate(db.UserData{Email: "alice@example.com", Name: "Alice"})
+	bob := d.Users().LookupOrCreate(db.UserData{Email: "bob@example.com", Name: "Bob"})
+	group := db.GroupData{Id: db.GroupId("team"), Name: "team", Members: []uint64{bob.Id, alice.Id}}
+	if err := d.Users().CreateGroup(group); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	for _, data := range []db.ShortData{
+		{Short: "a", Long: "http://a", Owner: alice.Id},
+		{Short: "b", Long: "http://b", Owner: bob.Id, Group: group.Id, Editors: []uint64{alice.Id}},
+		{Short: "b/c", Long: "http://c/{1}", Owner: bob.Id, Mode: db.RedirectTemplate, MaxHits: 3},
+		{Short: "d", Long: "http://d", Owner: alice.Id, ExpiresAt: time.Now().Add(time.Hour)},
+	} {
+		if err := d.Shorts().Create(data); err != nil {
+			t.Fatalf("Got error %v", err)
+		}
+	}
+	// Versions should be copied as they are.
+	a, _ := d.Shorts().Get("a")
+	a.Long = "http://aa"
+	if err := d.Shorts().Update(a); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	src := db.New(db.Config{Type: db.InMemory})
+	dst := db.New(db.Config{Type: db.Pebble, Pebble: db.PebbleConfig{Path: t.TempDir()}})
+	populate(t, src)
+
+	cp, err := Copy(src, dst, Options{Checkpoint: filepath.Join(t.TempDir(), "checkpoint"), BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if cp.Phase != PhaseDone || cp.Users != 2 || cp.Groups != 1 || cp.Shorts != 4 {
+		t.Errorf("Incorrect checkpoint %+v", cp)
+	}
+	report, err := Verify(src, dst)
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if !report.OK() {
+		t.Errorf("Copy does not match: %+v", report)
+	}
+	if a, err := dst.Shorts().Get("a"); err != nil || a.Version != 2 {
+		t.Errorf("Incorrect copy %v, %v", a, err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	src := db.New(db.Config{Type: db.InMemory})
+	dst := db.New(db.Config{Type: db.InMemory})
+	populate(t, src)
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	if err := saveCheckpoint(path, Checkpoint{Phase: PhaseShorts, Last: "b"}); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+
+	cp, err := Copy(src, dst, Options{Checkpoint: path})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if cp.Users != 0 || cp.Shorts != 2 {
+		t.Errorf("Incorrect checkpoint %+v", cp)
+	}
+	if _, err = dst.Shorts().Get("a"); err == nil {
+		t.Errorf("Copied short before checkpoint")
+	}
+	if _, err = dst.Shorts().Get("b/c"); err != nil {
+		t.Errorf("Got error %v", err)
+	}
+
+	report, err := Verify(src, dst)
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if report.OK() || report.Users.Dst != 0 {
+		t.Errorf("Incorrect report %+v", report)
+	} else if m := report.Shorts.Mismatched; len(m) != 2 || m[0] != "a" || m[1] != "b" {
+		t.Errorf("Incorrect mismatches %v", m)
+	}
+
+	// A finished copy does nothing more.
+	if cp, err = Copy(src, dst, Options{Checkpoint: path}); err != nil || cp.Shorts != 2 {
+		t.Errorf("Incorrect checkpoint %+v, %v", cp, err)
+	}
+
+	// Checkpoints are not resumed by copies between other databases.
+	if _, err = Copy(src, dst, Options{Checkpoint: path, Source: "other"}); err == nil {
+		t.Errorf("Expected error for checkpoint of another copy")
+	}
+	if _, err = Copy(src, dst, Options{Checkpoint: path, Destination: "other"}); err == nil {
+		t.Errorf("Expected error for checkpoint of another copy")
+	}
+}
@@ -1,14 +1,17 @@
 package db
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ml8/tinyr/service/util"
 )
 
 func TestPutGet(t *testing.T) {
 	db := New(Config{Type: InMemory})
-	db.Shorts().Put(ShortData{"miserable", "pigeon", 0})
+	db.Shorts().Put(ShortData{Short: "miserable", Long: "pigeon"})
 	v, err := db.Shorts().Get("miserable")
 	if err != nil {
 		t.Errorf("Got error %v", err)
@@ -19,8 +22,8 @@ func TestPutGet(t *testing.T) {
 
 func TestPutDeleteGet(t *testing.T) {
 	db := New(Config{Type: InMemory})
-	db.Shorts().Put(ShortData{"miserable", "pigeon", 0})
-	err := db.Shorts().Delete("miserable")
+	db.Shorts().Put(ShortData{Short: "miserable", Long: "pigeon"})
+	err := db.Shorts().Delete(ShortData{Short: "miserable"})
 	if err != nil {
 		t.Errorf("Got error %v", err)
 	}
@@ -32,3 +35,419 @@ func TestPutDeleteGet(t *testing.T) {
 		t.Errorf("Incorrect error %v", err)
 	}
 }
+
+func TestList(t *testing.T) {
+	testList(t, New(Config{Type: InMemory}))
+}
+
+func testList(t *testing.T, db Interface) {
+	for _, short := range []string{"d", "b", "a", "c", "e", "c/x", "c/y/z"} {
+		db.Shorts().Put(ShortData{Short: short, Long: "long-" + short})
+	}
+
+	cases := []struct {
+		start, end string
+		expected   []string
+	}{
+		{"", "", []string{"a", "b", "c", "c/x", "c/y/z", "d", "e"}},
+		{"b", "d", []string{"b", "c", "c/x", "c/y/z", "d"}},
+		{"c", "", []string{"c", "c/x", "c/y/z", "d", "e"}},
+		{"", "b", []string{"a", "b"}},
+		{"bb", "cc", []string{"c", "c/x", "c/y/z"}},
+		{"c/", "c/\U0010FFFF", []string{"c/x", "c/y/z"}},
+		{"x", "z", nil},
+	}
+	for _, c := range cases {
+		results, err := db.Shorts().List(c.start, c.end)
+		if err != nil {
+			t.Errorf("List(%q, %q) got error %v", c.start, c.end, err)
+			continue
+		}
+		var got []string
+		for _, m := range results.Matching {
+			got = append(got, m.Short)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.expected) {
+			t.Errorf("List(%q, %q) = %v; expected %v", c.start, c.end, got, c.expected)
+		}
+	}
+}
+
+func TestHits(t *testing.T) {
+	testHits(t, New(Config{Type: InMemory}))
+}
+
+func testHits(t *testing.T, db Interface) {
+	now := time.Now()
+	var hits []Hit
+	for i := 0; i < 5; i++ {
+		hits = append(hits, Hit{Short: "a", Timestamp: now.Add(time.Duration(i) * time.Minute), Host: fmt.Sprint(i)})
+	}
+	hits = append(hits, Hit{Short: "b", Timestamp: now})
+	if err := db.Hits().Record(hits[:3]); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if err := db.Hits().Record(hits[3:]); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+
+	if n, err := db.Hits().Count("a"); err != nil || n != 5 {
+		t.Errorf("Count(a) = %v, %v; expected 5", n, err)
+	}
+	if n, err := db.Hits().Count("c"); err != nil || n != 0 {
+		t.Errorf("Count(c) = %v, %v; expected 0", n, err)
+	}
+	if counts, err := db.Hits().Counts([]string{"a", "b", "c"}); err != nil || counts["a"] != 5 || counts["b"] != 1 || counts["c"] != 0 {
+		t.Errorf("Counts(a, b, c) = %v, %v", counts, err)
+	}
+	if counts, err := db.Hits().Counts(nil); err != nil || len(counts) != 0 {
+		t.Errorf("Counts() = %v, %v", counts, err)
+	}
+
+	clicks, err := db.Hits().Clicks("a", now.Add(time.Minute), now.Add(4*time.Minute))
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	var got []string
+	for _, c := range clicks {
+		got = append(got, c.Host)
+	}
+	if fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("Incorrect clicks %v", got)
+	}
+}
+
+func TestHitTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		s, truncated string
+		n            int
+	}{
+		{"abc", "abc", 3},
+		{"abcd", "abc", 3},
+		{"aé", "aé", 3},
+		{"aéb", "aé", 3},
+		{"ééé", "é", 3},
+		{"a\xffb", "ab", 3},
+	} {
+		if truncated := truncate(tc.s, tc.n); truncated != tc.truncated {
+			t.Errorf("truncate(%q, %v) = %q, expected %q", tc.s, tc.n, truncated, tc.truncated)
+		}
+	}
+	long := strings.Repeat("x", 4096)
+	h := Hit{Host: long, Referrer: long, UserAgent: long}.Truncate()
+	if len(h.Host) != maxHitHost || len(h.Referrer) != maxHitReferrer || len(h.UserAgent) != maxHitUserAgent {
+		t.Errorf("Incorrect lengths %v, %v, %v", len(h.Host), len(h.Referrer), len(h.UserAgent))
+	}
+}
+
+func TestListByOwner(t *testing.T) {
+	testListByOwner(t, New(Config{Type: InMemory}))
+}
+
+func testListByOwner(t *testing.T, db Interface) {
+	for i, short := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		db.Shorts().Put(ShortData{Short: short, Long: "long-" + short, Owner: uint64(i % 2)})
+	}
+
+	var pages []string
+	cursor := ""
+	for {
+		results, err := db.Shorts().ListByOwner(0, cursor, 2)
+		if err != nil {
+			t.Fatalf("Got error %v", err)
+		}
+		var page []string
+		for _, m := range results.Matching {
+			page = append(page, m.Short)
+		}
+		pages = append(pages, fmt.Sprint(page))
+		if cursor = results.Next; cursor == "" {
+			break
+		}
+	}
+	if fmt.Sprint(pages) != "[[a c] [e g]]" {
+		t.Errorf("Incorrect pages %v", pages)
+	}
+
+	results, err := db.Shorts().ListByOwner(1, "", 0)
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if len(results.Matching) != 3 || results.Next != "" {
+		t.Errorf("Incorrect results %v", results)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	testListPage(t, New(Config{Type: InMemory}))
+}
+
+func testListPage(t *testing.T, db Interface) {
+	for _, short := range []string{"a", "b/1", "b/2", "b/3", "c"} {
+		db.Shorts().Put(ShortData{Short: short, Long: "long-" + short})
+	}
+
+	var pages []string
+	cursor := ""
+	for {
+		results, err := db.Shorts().ListPage("b/", "b/~", cursor, 2)
+		if err != nil {
+			t.Fatalf("Got error %v", err)
+		}
+		var page []string
+		for _, m := range results.Matching {
+			page = append(page, m.Short)
+		}
+		pages = append(pages, fmt.Sprint(page))
+		if cursor = results.Next; cursor == "" {
+			break
+		}
+	}
+	if fmt.Sprint(pages) != "[[b/1 b/2] [b/3]]" {
+		t.Errorf("Incorrect pages %v", pages)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	testCreate(t, New(Config{Type: InMemory}))
+}
+
+func testCreate(t *testing.T, db Interface) {
+	if err := db.Shorts().Create(ShortData{Short: "miserable", Long: "pigeon", Owner: 1}); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	err := db.Shorts().Create(ShortData{Short: "miserable", Long: "crow", Owner: 1})
+	if err != util.AlreadyExistsError("miserable") {
+		t.Errorf("Incorrect error %v", err)
+	}
+	if v, err := db.Shorts().Get("miserable"); err != nil || v.Long != "pigeon" {
+		t.Errorf("Incorrect value %v, %v", v, err)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	testDeleteExpired(t, New(Config{Type: InMemory}))
+}
+
+func testDeleteExpired(t *testing.T, db Interface) {
+	now := time.Now()
+	db.Shorts().Put(ShortData{Short: "forever", Long: "l"})
+	db.Shorts().Put(ShortData{Short: "expired", Long: "l", ExpiresAt: now.Add(-time.Minute)})
+	db.Shorts().Put(ShortData{Short: "later", Long: "l", ExpiresAt: now.Add(time.Minute)})
+	db.Shorts().Put(ShortData{Short: "limited", Long: "l", MaxHits: 1})
+
+	n, err := db.Shorts().DeleteExpired(now)
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if n != 1 {
+		t.Errorf("Incorrect count %v", n)
+	}
+	results, err := db.Shorts().List("", "")
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	var got []string
+	for _, m := range results.Matching {
+		got = append(got, m.Short)
+	}
+	if fmt.Sprint(got) != "[forever later limited]" {
+		t.Errorf("Incorrect remaining shorts %v", got)
+	}
+}
+
+func TestDeleteHits(t *testing.T) {
+	testDeleteHits(t, New(Config{Type: InMemory}))
+}
+
+// testDeleteHits checks that deleted and reaped shorts take their hits with
+// them, and that others keep theirs.
+func testDeleteHits(t *testing.T, db Interface) {
+	now := time.Now()
+	db.Shorts().Create(ShortData{Short: "deleted", Long: "l", Owner: 1})
+	db.Shorts().Create(ShortData{Short: "expired", Long: "l", ExpiresAt: now.Add(-time.Minute)})
+	db.Shorts().Create(ShortData{Short: "kept", Long: "l"})
+	var hits []Hit
+	for _, short := range []string{"deleted", "expired", "kept"} {
+		hits = append(hits, Hit{Short: short, Timestamp: now.Add(-time.Hour), Host: "h"})
+	}
+	if err := db.Hits().Record(hits); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+
+	if err := db.Shorts().Delete(ShortData{Short: "deleted", Owner: 1}); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if _, err := db.Shorts().DeleteExpired(now); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	for short, expected := range map[string]int64{"deleted": 0, "expired": 0, "kept": 1} {
+		if n, err := db.Hits().Count(short); err != nil || n != expected {
+			t.Errorf("Count(%v) = %v, %v; expected %v", short, n, err, expected)
+		}
+		if clicks, err := db.Hits().Clicks(short, now.Add(-2*time.Hour), now); err != nil || int64(len(clicks)) != expected {
+			t.Errorf("Clicks(%v) = %v, %v; expected %v", short, clicks, err, expected)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		data     ShortData
+		hits     int64
+		expected bool
+	}{
+		{ShortData{}, 100, false},
+		{ShortData{ExpiresAt: now}, 0, true},
+		{ShortData{ExpiresAt: now.Add(time.Second)}, 0, false},
+		{ShortData{MaxHits: 2}, 1, false},
+		{ShortData{MaxHits: 2}, 2, true},
+	}
+	for _, c := range cases {
+		if got := c.data.Expired(now, c.hits); got != c.expected {
+			t.Errorf("%+v.Expired(now, %v) = %v", c.data, c.hits, got)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	testUpdate(t, New(Config{Type: InMemory}))
+}
+
+func testUpdate(t *testing.T, db Interface) {
+	if err := db.Shorts().Create(ShortData{Short: "miserable", Long: "pigeon", Owner: 1}); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if err := db.Shorts().Update(ShortData{Short: "miserable", Long: "crow/{1}", Mode: RedirectTemplate, Owner: 1, Version: 1}); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if v, err := db.Shorts().Get("miserable"); err != nil || v.Long != "crow/{1}" || v.Mode != RedirectTemplate || v.Version != 2 {
+		t.Errorf("Incorrect value %v, %v", v, err)
+	}
+
+	// A second writer with the old version loses.
+	err := db.Shorts().Update(ShortData{Short: "miserable", Long: "raven", Owner: 1, Version: 1})
+	if err != (util.VersionMismatchError{Expected: 1, Actual: 2}) {
+		t.Errorf("Incorrect error %v", err)
+	}
+	err = db.Shorts().Update(ShortData{Short: "miserable", Long: "raven", Owner: 2, Version: 2})
+	if err != util.PermissionDeniedError {
+		t.Errorf("Incorrect error %v", err)
+	}
+	err = db.Shorts().Update(ShortData{Short: "happy", Long: "raven", Owner: 1, Version: 1})
+	if err != util.NoSuchKeyError("happy") {
+		t.Errorf("Incorrect error %v", err)
+	}
+	if v, err := db.Shorts().Get("miserable"); err != nil || v.Long != "crow/{1}" || v.Version != 2 {
+		t.Errorf("Incorrect value %v, %v", v, err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	testGroups(t, New(Config{Type: InMemory}))
+}
+
+func testGroups(t *testing.T, db Interface) {
+	birds := GroupData{Id: GroupId("birds"), Name: "birds", Members: []uint64{1}}
+	if err := db.Users().CreateGroup(birds); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if err := db.Users().CreateGroup(birds); err != util.AlreadyExistsError("birds") {
+		t.Errorf("Incorrect error %v", err)
+	}
+	if err := db.Users().AddMember(birds.Id, 2); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if err := db.Users().AddMember(birds.Id, 2); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if g, err := db.Users().GetGroup(birds.Id); err != nil || len(g.Members) != 2 {
+		t.Errorf("Incorrect group %v, %v", g, err)
+	}
+	if groups, err := db.Users().GroupsOf(2); err != nil || len(groups) != 1 || groups[0].Name != "birds" {
+		t.Errorf("Incorrect groups %v, %v", groups, err)
+	}
+	if err := db.Users().RemoveMember(birds.Id, 2); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if groups, err := db.Users().GroupsOf(2); err != nil || len(groups) != 0 {
+		t.Errorf("Incorrect groups %v, %v", groups, err)
+	}
+	if err := db.Users().AddMember(GroupId("fish"), 2); err == nil {
+		t.Errorf("Added member to missing group")
+	}
+}
+
+func TestSharedOwnership(t *testing.T) {
+	testSharedOwnership(t, New(Config{Type: InMemory}))
+}
+
+func testSharedOwnership(t *testing.T, db Interface) {
+	// 1 owns through the group, 2 is an editor and 3 is neither.
+	birds := GroupData{Id: GroupId("birds"), Name: "birds", Members: []uint64{1}}
+	if err := db.Users().CreateGroup(birds); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	entry := ShortData{Short: "miserable", Long: "pigeon", Owner: 4, Group: birds.Id, Editors: []uint64{2}}
+	if err := db.Shorts().Create(entry); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+
+	if err := db.Shorts().Update(ShortData{Short: "miserable", Long: "crow", Owner: 2, Version: 1}); err != nil {
+		t.Errorf("Editor could not update: %v", err)
+	}
+	if err := db.Shorts().Put(ShortData{Short: "miserable", Long: "raven", Owner: 1}); err != nil {
+		t.Errorf("Group member could not put: %v", err)
+	}
+	if err := db.Shorts().Put(ShortData{Short: "miserable", Long: "gull", Owner: 3}); err != util.PermissionDeniedError {
+		t.Errorf("Incorrect error %v", err)
+	}
+	v, err := db.Shorts().Get("miserable")
+	if err != nil || v.Long != "raven" || v.Owner != 4 || v.Group != birds.Id || v.Version != 3 {
+		t.Errorf("Incorrect value %v, %v", v, err)
+	}
+
+	// Editors cannot change ownership or delete.
+	transfer := ShortData{Short: "miserable", Owner: 2, Version: 3}
+	if err := db.Shorts().SetOwners(2, transfer); err != util.PermissionDeniedError {
+		t.Errorf("Incorrect error %v", err)
+	}
+	if err := db.Shorts().Delete(ShortData{Short: "miserable", Owner: 2}); err != util.PermissionDeniedError {
+		t.Errorf("Incorrect error %v", err)
+	}
+	if err := db.Shorts().SetOwners(1, transfer); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if v, err := db.Shorts().Get("miserable"); err != nil || v.Owner != 2 || v.Group != 0 || len(v.Editors) != 0 || v.Version != 4 {
+		t.Errorf("Incorrect value %v, %v", v, err)
+	}
+	if results, err := db.Shorts().ListByOwner(2, "", 0); err != nil || len(results.Matching) != 1 {
+		t.Errorf("Incorrect results %v, %v", results, err)
+	}
+	if results, err := db.Shorts().ListByOwner(4, "", 0); err != nil || len(results.Matching) != 0 {
+		t.Errorf("Incorrect results %v, %v", results, err)
+	}
+	if err := db.Shorts().Delete(ShortData{Short: "miserable", Owner: 1}); err != util.PermissionDeniedError {
+		t.Errorf("Incorrect error %v", err)
+	}
+	if err := db.Shorts().Delete(ShortData{Short: "miserable", Owner: 2}); err != nil {
+		t.Errorf("Got error %v", err)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	testNotFound(t, New(Config{Type: InMemory}))
+}
+
+// testNotFound checks that every backend reports missing keys as
+// NoSuchKeyError, rather than its driver's error.
+func testNotFound(t *testing.T, db Interface) {
+	if _, err := db.Shorts().Get("missing"); err != util.NoSuchKeyError("missing") {
+		t.Errorf("Incorrect error for a missing short %v", err)
+	}
+	if _, err := db.Users().Get(42); util.StatusCode(err) != 404 {
+		t.Errorf("Incorrect error for a missing user %v", err)
+	}
+	if _, err := db.Users().GetGroup(42); util.StatusCode(err) != 404 {
+		t.Errorf("Incorrect error for a missing group %v", err)
+	}
+}
@@ -1,16 +1,59 @@
 package db
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Schemas are applied in version order: the base schema is version 0, and
+// every other schema file is named NNN_name_<basename>.<extension>, with
+// version NNN. Each may be paired with NNN_name_<basename>.down.<extension>,
+// which undoes it.
+//
+// Migrators record the versions they apply, with the checksum of each file, so
+// that only pending schemas are applied. Applied files must not be edited; add
+// a new schema instead.
+
+// Migration commands.
+const (
+	MigrateUp     = "up"
+	MigrateDown   = "down"
+	MigrateStatus = "status"
+)
+
+// Schema states, as reported by status.
+const (
+	StatePending  = "pending"
+	StateApplied  = "applied"
+	StateModified = "modified"
+	StateMissing  = "missing"
 )
 
 type Schema struct {
 	Schema   string
 	Filename string
+	Version  int
+	Checksum string
+	// Down is true for schemas that undo version Version.
+	Down bool
+}
+
+// Migration is a record of an applied schema.
+type Migration struct {
+	Version   int
+	Filename  string
+	Checksum  string
+	AppliedAt time.Time
 }
 
 type MigrationArgs struct {
@@ -20,17 +63,72 @@ type MigrationArgs struct {
 	Extension string
 	DryRun    bool
 	Migrator  Migrator
+
+	// Command is MigrateUp, the default, MigrateDown or MigrateStatus.
+	Command string
+	// Target is the version to migrate up to, or down to. Up migrates to the
+	// latest version if Target is 0 or less; down requires a target of at
+	// least 0.
+	Target int
+	// Status is written to Out, or os.Stdout.
+	Out io.Writer
 }
 
 type Migrator interface {
 	InitDB() (err error)
 	ApplySchema(schema Schema, dry_run bool) (err error)
 	Complete()
+
+	// Applied returns the applied migrations, or none if nothing has been
+	// recorded yet.
+	Applied() ([]Migration, error)
+	// Record records an applied migration, creating the record if need be.
+	Record(m Migration) error
+	// Forget removes the record of a migration that was undone.
+	Forget(version int) error
+}
+
+// SchemaSource is implemented by migrators whose schemas are code rather than
+// files, such as pebble's. Others read schemas from MigrationArgs.SchemaDir.
+type SchemaSource interface {
+	Schemas() ([]Schema, error)
+	// DownSchema returns the schema that undoes s.
+	DownSchema(s Schema) (Schema, error)
+}
+
+type fileSource struct {
+	dir       string
+	basename  string
+	extension string
+	logger    *slog.Logger
+}
+
+func (f fileSource) Schemas() ([]Schema, error) {
+	files, err := getSchemas(f.logger, f.dir, f.basename, f.extension)
+	if err != nil {
+		return nil, err
+	}
+	return readSchemas(f.logger, f.dir, files, f.basename, f.extension)
+}
+
+func (f fileSource) DownSchema(s Schema) (Schema, error) {
+	fn := downFile(s.Filename, f.extension)
+	b, err := os.ReadFile(path.Join(f.dir, fn))
+	if err != nil {
+		return Schema{}, fmt.Errorf("cannot roll back %v: %w", s.Filename, err)
+	}
+	return Schema{Schema: string(b), Filename: fn, Version: s.Version, Checksum: checksum(b), Down: true}, nil
 }
 
 func RunMigration(args MigrationArgs) (err error) {
-	logger = args.Logger
-	schemas, err := getSchemas(args.SchemaDir, args.Basename, args.Extension)
+	if args.Logger == nil {
+		args.Logger = slog.Default()
+	}
+	source, ok := args.Migrator.(SchemaSource)
+	if !ok {
+		source = fileSource{args.SchemaDir, args.Basename, args.Extension, args.Logger}
+	}
+	schemas, err := source.Schemas()
 	if err != nil {
 		return
 	}
@@ -42,11 +140,25 @@ func RunMigration(args MigrationArgs) (err error) {
 	}
 	defer args.Migrator.Complete()
 
-	err = applyAll(args.Migrator, args.SchemaDir, schemas, args.DryRun)
+	applied, err := args.Migrator.Applied()
 	if err != nil {
 		return
 	}
 
+	switch args.Command {
+	case MigrateUp, "":
+		err = migrateUp(args, schemas, applied)
+	case MigrateDown:
+		err = migrateDown(args, source, schemas, applied)
+	case MigrateStatus:
+		out := args.Out
+		if out == nil {
+			out = os.Stdout
+		}
+		err = writeStatus(out, schemas, applied)
+	default:
+		err = fmt.Errorf("unknown migration command %q", args.Command)
+	}
 	return
 }
 
@@ -57,8 +169,13 @@ func dot(s string) string {
 	return s
 }
 
+// downFile is the name of the schema that undoes fn.
+func downFile(fn string, extension string) string {
+	return strings.TrimSuffix(fn, dot(extension)) + ".down" + dot(extension)
+}
+
 // Get list of schema files in given directory, sorted according to apply order.
-func getSchemas(dir string, basename string, extension string) (schemas []string, err error) {
+func getSchemas(logger *slog.Logger, dir string, basename string, extension string) (schemas []string, err error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return
@@ -74,12 +191,13 @@ func getSchemas(dir string, basename string, extension string) (schemas []string
 		schemas = append(schemas, e.Name())
 	}
 
+	base := basename + dot(extension)
 	sort.Slice(schemas, func(i, j int) bool {
 		// make sure that base schema comes first. rest are sorted
 		// lexicographically.
-		if schemas[i] == basename+extension {
+		if schemas[i] == base {
 			return true
-		} else if schemas[j] == basename+extension {
+		} else if schemas[j] == base {
 			return false
 		}
 
@@ -88,8 +206,26 @@ func getSchemas(dir string, basename string, extension string) (schemas []string
 	return
 }
 
-func applyAll(m Migrator, dir string, files []string, dry_run bool) (err error) {
-	var schemas []Schema
+// schemaVersion parses the version from fn, which is 0 for the base schema.
+func schemaVersion(fn string, basename string, extension string) (int, error) {
+	if fn == basename+dot(extension) {
+		return 0, nil
+	}
+	prefix, _, ok := strings.Cut(fn, "_")
+	v, err := strconv.Atoi(prefix)
+	if !ok || err != nil || v <= 0 {
+		return 0, fmt.Errorf("schema %v has no version", fn)
+	}
+	return v, nil
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func readSchemas(logger *slog.Logger, dir string, files []string, basename string, extension string) (schemas []Schema, err error) {
+	seen := make(map[int]string)
 	for _, fn := range files {
 		var b []byte
 		b, err = os.ReadFile(path.Join(dir, fn))
@@ -97,16 +233,125 @@ func applyAll(m Migrator, dir string, files []string, dry_run bool) (err error)
 			logger.Error("Error parsing", "filename", fn, "error", err)
 			return
 		}
-		schemas = append(schemas, Schema{Schema: string(b), Filename: fn})
+		s := Schema{Schema: string(b), Filename: fn, Checksum: checksum(b)}
+		if s.Version, err = schemaVersion(fn, basename, extension); err != nil {
+			return
+		}
+		if prev, ok := seen[s.Version]; ok {
+			err = fmt.Errorf("schemas %v and %v have the same version", prev, fn)
+			return
+		}
+		seen[s.Version] = fn
+		schemas = append(schemas, s)
 	}
+	sort.Slice(schemas, func(i, j int) bool {
+		return schemas[i].Version < schemas[j].Version
+	})
+	return
+}
 
-	// now apply
+// checkApplied returns an error if any applied schema has been edited since.
+func checkApplied(schemas []Schema, applied map[int]Migration) error {
 	for _, s := range schemas {
-		logger.Info("applying", "file", s.Filename)
-		err = m.ApplySchema(s, dry_run)
-		if err != nil {
+		if m, ok := applied[s.Version]; ok && m.Checksum != s.Checksum {
+			return fmt.Errorf("schema %v was edited after it was applied; add a new schema instead", s.Filename)
+		}
+	}
+	return nil
+}
+
+func byVersion(applied []Migration) map[int]Migration {
+	m := make(map[int]Migration)
+	for _, a := range applied {
+		m[a.Version] = a
+	}
+	return m
+}
+
+func migrateUp(args MigrationArgs, schemas []Schema, records []Migration) (err error) {
+	applied := byVersion(records)
+	if err = checkApplied(schemas, applied); err != nil {
+		return
+	}
+	for _, s := range schemas {
+		if _, ok := applied[s.Version]; ok {
+			continue
+		} else if args.Target > 0 && s.Version > args.Target {
+			break
+		}
+		args.Logger.Info("applying", "file", s.Filename, "version", s.Version)
+		if err = args.Migrator.ApplySchema(s, args.DryRun); err != nil {
+			return
+		}
+		if args.DryRun {
+			continue
+		}
+		m := Migration{Version: s.Version, Filename: s.Filename, Checksum: s.Checksum, AppliedAt: time.Now()}
+		if err = args.Migrator.Record(m); err != nil {
 			return
 		}
 	}
 	return
 }
+
+func migrateDown(args MigrationArgs, source SchemaSource, schemas []Schema, records []Migration) (err error) {
+	if args.Target < 0 {
+		return fmt.Errorf("rolling back needs a target version")
+	}
+	applied := byVersion(records)
+	if err = checkApplied(schemas, applied); err != nil {
+		return
+	}
+	// Read every down schema first, so that a missing one stops the rollback
+	// before it starts.
+	var downs []Schema
+	for i := len(schemas) - 1; i >= 0 && schemas[i].Version > args.Target; i-- {
+		s := schemas[i]
+		if _, ok := applied[s.Version]; !ok {
+			continue
+		}
+		var down Schema
+		if down, err = source.DownSchema(s); err != nil {
+			return
+		}
+		downs = append(downs, down)
+	}
+	for _, s := range downs {
+		args.Logger.Info("rolling back", "file", s.Filename, "version", s.Version)
+		if err = args.Migrator.ApplySchema(s, args.DryRun); err != nil {
+			return
+		}
+		if args.DryRun {
+			continue
+		}
+		if err = args.Migrator.Forget(s.Version); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func writeStatus(out io.Writer, schemas []Schema, records []Migration) error {
+	applied := byVersion(records)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tFILE\tSTATE\tAPPLIED")
+	found := make(map[int]bool)
+	for _, s := range schemas {
+		found[s.Version] = true
+		state, when := StatePending, ""
+		if m, ok := applied[s.Version]; ok {
+			state, when = StateApplied, m.AppliedAt.Format(time.RFC3339)
+			if m.Checksum != s.Checksum {
+				state = StateModified
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, s.Filename, state, when)
+	}
+	// Applied schemas whose files are gone.
+	for _, m := range records {
+		if !found[m.Version] {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", m.Version, m.Filename, StateMissing, m.AppliedAt.Format(time.RFC3339))
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeMigrator records the schemas it applies.
+type fakeMigrator struct {
+	ran     []string
+	applied map[int]Migration
+}
+
+func (f *fakeMigrator) InitDB() error { return nil }
+func (f *fakeMigrator) Complete()     {}
+
+func (f *fakeMigrator) ApplySchema(s Schema, dryRun bool) error {
+	f.ran = append(f.ran, s.Filename)
+	return nil
+}
+
+func (f *fakeMigrator) Applied() (applied []Migration, err error) {
+	for v := 0; v < 100; v++ {
+		if m, ok := f.applied[v]; ok {
+			applied = append(applied, m)
+		}
+	}
+	return
+}
+
+func (f *fakeMigrator) Record(m Migration) error {
+	f.applied[m.Version] = m
+	return nil
+}
+
+func (f *fakeMigrator) Forget(version int) error {
+	delete(f.applied, version)
+	return nil
+}
+
+func writeSchemas(t *testing.T, files ...string) string {
+	dir := t.TempDir()
+	for _, fn := range files {
+		if err := os.WriteFile(filepath.Join(dir, fn), []byte("-- "+fn), 0o644); err != nil {
+			t.Fatalf("Got error %v", err)
+		}
+	}
+	return dir
+}
+
+func migrate(f *fakeMigrator, dir string, command string, target int) error {
+	f.ran = nil
+	return RunMigration(MigrationArgs{
+		Logger:    slog.Default(),
+		SchemaDir: dir,
+		Basename:  "schema",
+		Extension: "sql",
+		Migrator:  f,
+		Command:   command,
+		Target:    target,
+		Out:       &bytes.Buffer{},
+	})
+}
+
+func TestMigrateUp(t *testing.T) {
+	dir := writeSchemas(t, "schema.sql", "001_a_schema.sql", "002_b_schema.sql", "002_b_schema.down.sql")
+	f := &fakeMigrator{applied: make(map[int]Migration)}
+	if err := migrate(f, dir, MigrateUp, 1); err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if strings.Join(f.ran, " ") != "schema.sql 001_a_schema.sql" {
+		t.Errorf("Incorrect schemas applied %v", f.ran)
+	}
+	// Only pending schemas are applied.
+	if err := migrate(f, dir, MigrateUp, 0); err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if strings.Join(f.ran, " ") != "002_b_schema.sql" {
+		t.Errorf("Incorrect schemas applied %v", f.ran)
+	}
+	if err := migrate(f, dir, MigrateUp, 0); err != nil || len(f.ran) != 0 {
+		t.Errorf("Applied %v, %v", f.ran, err)
+	}
+
+	// Edited schemas are rejected.
+	os.WriteFile(filepath.Join(dir, "001_a_schema.sql"), []byte("-- edited"), 0o644)
+	if err := migrate(f, dir, MigrateUp, 0); err == nil {
+		t.Errorf("Expected error for edited schema")
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	dir := writeSchemas(t, "schema.sql", "001_a_schema.sql", "002_b_schema.sql", "002_b_schema.down.sql", "003_c_schema.sql", "003_c_schema.down.sql")
+	f := &fakeMigrator{applied: make(map[int]Migration)}
+	if err := migrate(f, dir, MigrateUp, 0); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if err := migrate(f, dir, MigrateDown, -1); err == nil {
+		t.Errorf("Expected error without target")
+	}
+	// 001 has no down schema, so nothing is undone.
+	if err := migrate(f, dir, MigrateDown, 0); err == nil || len(f.ran) != 0 {
+		t.Errorf("Rolled back %v, %v", f.ran, err)
+	}
+	if err := migrate(f, dir, MigrateDown, 1); err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if strings.Join(f.ran, " ") != "003_c_schema.down.sql 002_b_schema.down.sql" {
+		t.Errorf("Incorrect schemas rolled back %v", f.ran)
+	}
+	if _, ok := f.applied[2]; ok || len(f.applied) != 2 {
+		t.Errorf("Incorrect applied %v", f.applied)
+	}
+}
+
+func TestMigrateStatus(t *testing.T) {
+	dir := writeSchemas(t, "schema.sql", "001_a_schema.sql", "002_b_schema.sql")
+	f := &fakeMigrator{applied: make(map[int]Migration)}
+	if err := migrate(f, dir, MigrateUp, 1); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	f.applied[7] = Migration{Version: 7, Filename: "007_gone_schema.sql"}
+	var out bytes.Buffer
+	err := RunMigration(MigrationArgs{Logger: slog.Default(), SchemaDir: dir, Basename: "schema", Extension: "sql", Migrator: f, Command: MigrateStatus, Out: &out})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	states := make(map[string]string)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 3 {
+			states[fields[1]] = fields[2]
+		}
+	}
+	for fn, want := range map[string]string{"001_a_schema.sql": StateApplied, "002_b_schema.sql": StatePending, "007_gone_schema.sql": StateMissing} {
+		if states[fn] != want {
+			t.Errorf("%v is %q, expected %q:\n%v", fn, states[fn], want, out.String())
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package db
 
 import (
-	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/ml8/tinyr/service/util"
@@ -16,49 +20,93 @@ type pebDB struct {
 }
 
 type pebbleShortStore struct {
-	sync.Mutex // Do not interleave writes; put is not atomic.
-	keyspace   string
-	db         *pebble.DB
+	sync.Mutex    // Do not interleave writes; put is not atomic.
+	keyspace      string
+	ownerKeyspace string
+	codec         Codec
+	users         *pebbleUserStore
+	hits          *pebbleHitStore
+	db            *pebble.DB
 }
 
 type pebbleUserStore struct {
-	keyspace string
-	db       *pebble.DB
+	sync.Mutex         // Do not interleave group writes; membership is read-modify-write.
+	keyspace           string
+	groupKeyspace      string
+	membershipKeyspace string
+	codec              Codec
+	db                 *pebble.DB
+	logger             *slog.Logger
+}
+
+type pebbleHitStore struct {
+	sync.Mutex    // Do not interleave writes; counts are read-modify-write.
+	countKeyspace string
+	clickKeyspace string
+	codec         Codec
+	seq           uint32
+	db            *pebble.DB
 }
 
 const (
-	shortKeyspace = "s"
-	userKeyspace  = "u"
+	shortKeyspace  = "s"
+	userKeyspace   = "u"
+	countKeyspace  = "c"
+	clickKeyspace  = "h"
+	ownerKeyspace  = "o" // index of owner -> short
+	metaKeyspace   = "m"
+	groupKeyspace  = "g"
+	memberKeyspace = "n" // index of member -> group
 )
 
 type PebbleConfig struct {
 	Path string
+	// Codec names the codec for new values: gob, the default, json or msgpack.
+	// Values written with other codecs are still read.
+	Codec string
+	// RestoreFrom is a backup, a directory or tarball, that is restored to
+	// Path if Path holds no store.
+	RestoreFrom string
+	Backup      BackupConfig
 }
 
-func gobEncode[T any](e T) (encoded []byte) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	util.OkOrDie(enc.Encode(e))
-	encoded = buf.Bytes()
-	return
-}
-
-func gobDecode[T any](encoded []byte) (e T) {
-	buf := bytes.NewBuffer(encoded)
-	dec := gob.NewDecoder(buf)
-	util.OkOrDie(dec.Decode(&e))
-	return
+// set encodes e with c and sets it at k.
+func set[T any](b *pebble.Batch, c Codec, k []byte, e T) error {
+	v, err := encode(c, e)
+	if err != nil {
+		return err
+	}
+	return b.Set(k, v, nil)
 }
 
-func NewPebble(config PebbleConfig) Interface {
+func NewPebble(config PebbleConfig, logger *slog.Logger) Interface {
+	codec, err := codecByName(config.Codec)
+	util.OkOrDie(err)
+	if config.RestoreFrom != "" {
+		util.OkOrDie(restorePebble(logger, config.RestoreFrom, config.Path))
+	}
 	db, err := pebble.Open(config.Path, &pebble.Options{})
 	util.OkOrDie(err)
 	gob.Register(ShortData{})
 	gob.Register(UserData{})
-	return container{
-		s: &pebbleShortStore{Mutex: sync.Mutex{}, keyspace: shortKeyspace, db: db},
-		u: &pebbleUserStore{keyspace: userKeyspace, db: db},
+	gob.Register(Hit{})
+	gob.Register(GroupData{})
+	u := &pebbleUserStore{keyspace: userKeyspace, groupKeyspace: groupKeyspace, membershipKeyspace: memberKeyspace, codec: codec, db: db, logger: logger}
+	h := &pebbleHitStore{countKeyspace: countKeyspace, clickKeyspace: clickKeyspace, codec: codec, db: db}
+	s := &pebbleShortStore{Mutex: sync.Mutex{}, keyspace: shortKeyspace, ownerKeyspace: ownerKeyspace, codec: codec, users: u, hits: h, db: db}
+	util.OkOrDie(RunMigration(MigrationArgs{Logger: logger, Migrator: &PebbleMigrator{DB: db}}))
+	p := &pebbleContainer{
+		container: container{
+			s: s,
+			u: u,
+			h: h,
+		},
+		backup: config.Backup,
+		db:     db,
+		logger: logger,
 	}
+	p.scheduleBackups()
+	return p
 }
 
 func (p *pebbleShortStore) Get(key string) (entry ShortData, err error) {
@@ -67,12 +115,13 @@ func (p *pebbleShortStore) Get(key string) (entry ShortData, err error) {
 	if closer != nil {
 		defer closer.Close()
 	}
-	if err != nil && errors.Is(err, pebble.ErrNotFound) {
+	if errors.Is(err, pebble.ErrNotFound) {
 		err = util.NoSuchKeyError(key)
 		return
+	} else if err != nil {
+		return
 	}
-	entry = gobDecode[ShortData](val)
-	return
+	return decode[ShortData](val)
 }
 
 func (p *pebbleShortStore) Put(entry ShortData) (err error) {
@@ -83,11 +132,94 @@ func (p *pebbleShortStore) Put(entry ShortData) (err error) {
 	if _, ok := err.(util.NoSuchKeyError); !ok && err != nil {
 		return
 	}
+	if prev.Short != "" {
+		if err = authorize(prev, entry.Owner, false, p.users.isMember); err != nil {
+			return
+		}
+		entry.Owner, entry.Group, entry.Editors = prev.Owner, prev.Group, prev.Editors
+	}
+	entry.Version = prev.Version + 1
+	err = p.write(prev, entry)
+	return
+}
+
+func (p *pebbleShortStore) Restore(entry ShortData) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	prev, err := p.Get(entry.Short)
+	if _, ok := err.(util.NoSuchKeyError); !ok && err != nil {
+		return
+	}
+	err = p.write(prev, entry)
+	return
+}
+
+func (p *pebbleShortStore) Create(entry ShortData) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	_, err = p.Get(entry.Short)
+	if err == nil {
+		err = util.AlreadyExistsError(entry.Short)
+		return
+	} else if _, ok := err.(util.NoSuchKeyError); !ok {
+		return
+	}
+	entry.Version = 1
+	err = p.write(ShortData{}, entry)
+	return
+}
+
+func (p *pebbleShortStore) Update(entry ShortData) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	prev, err := p.Get(entry.Short)
+	if _, ok := err.(util.NoSuchKeyError); !ok && err != nil {
+		return
+	}
+	if err = checkVersioned(prev, err == nil, entry, entry.Owner, false, p.users.isMember); err != nil {
+		return
+	}
+	next := prev
+	next.Long, next.Mode, next.ExpiresAt, next.MaxHits = entry.Long, entry.Mode, entry.ExpiresAt, entry.MaxHits
+	next.Version++
+	err = p.write(prev, next)
+	return
+}
+
+func (p *pebbleShortStore) SetOwners(caller uint64, entry ShortData) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	prev, err := p.Get(entry.Short)
+	if _, ok := err.(util.NoSuchKeyError); !ok && err != nil {
+		return
+	}
+	if err = checkVersioned(prev, err == nil, entry, caller, true, p.users.isMember); err != nil {
+		return
+	}
+	next := prev
+	next.Owner, next.Group, next.Editors = entry.Owner, entry.Group, entry.Editors
+	next.Version++
+	err = p.write(prev, next)
+	return
+}
+
+// write replaces prev, which is empty for new entries, with entry and indexes
+// it by owner. Callers must hold the lock.
+func (p *pebbleShortStore) write(prev, entry ShortData) (err error) {
+	b := p.db.NewBatch()
+	defer b.Close()
+	if err = set(b, p.codec, []byte(p.keyspace+entry.Short), entry); err != nil {
+		return
+	}
 	if prev.Short != "" && prev.Owner != entry.Owner {
-		err = util.PermissionDeniedError
+		if err = b.Delete(p.ownerKey(prev.Owner, prev.Short), nil); err != nil {
+			return
+		}
+	}
+	if err = b.Set(p.ownerKey(entry.Owner, entry.Short), nil, nil); err != nil {
 		return
 	}
-	err = p.db.Set([]byte(p.keyspace+entry.Short), gobEncode(entry), pebble.Sync)
+	err = b.Commit(pebble.Sync)
 	return
 }
 
@@ -99,22 +231,43 @@ func (p *pebbleShortStore) Delete(entry ShortData) (err error) {
 	if _, ok := err.(util.NoSuchKeyError); !ok && err != nil {
 		return
 	}
-	if prev.Short != "" && prev.Owner != entry.Owner {
-		err = util.PermissionDeniedError
+	if prev.Short != "" {
+		if err = authorize(prev, entry.Owner, true, p.users.isMember); err != nil {
+			return
+		}
+	}
+	p.hits.Lock()
+	defer p.hits.Unlock()
+	b := p.db.NewBatch()
+	defer b.Close()
+	if err = b.Delete([]byte(p.keyspace+entry.Short), nil); err != nil {
+		return
+	}
+	if err = b.Delete(p.ownerKey(prev.Owner, entry.Short), nil); err != nil {
+		return
+	}
+	if err = p.hits.delete(b, entry.Short); err != nil {
 		return
 	}
-	err = p.db.Delete([]byte(p.keyspace+entry.Short), pebble.Sync)
+	err = b.Commit(pebble.Sync)
 	return
 }
 
 func (p *pebbleShortStore) List(start, end string) (results ListResults, err error) {
+	return p.ListPage(start, end, "", 0)
+}
+
+func (p *pebbleShortStore) ListPage(start, end, cursor string, limit int) (results ListResults, err error) {
 	lb := []byte(p.keyspace)
 	ub := []byte(string(p.keyspace[0] + 1))
-	if start != "" {
+	if cursor != "" && cursor >= start {
+		lb = []byte(p.keyspace + cursor + "\x00")
+	} else if start != "" {
 		lb = []byte(p.keyspace + start)
 	}
 	if end != "" {
-		ub = []byte(p.keyspace + end)
+		// Upper bound is exclusive; the smallest key after end keeps it inclusive.
+		ub = []byte(p.keyspace + end + "\x00")
 	}
 
 	it, err := p.db.NewIter(&pebble.IterOptions{
@@ -125,10 +278,86 @@ func (p *pebbleShortStore) List(start, end string) (results ListResults, err err
 		return
 	}
 
+	defer func() { util.OkOrDie(it.Close()) }()
+
+	for it.First(); it.Valid(); it.Next() {
+		if limit > 0 && len(results.Matching) == limit {
+			results.Next = results.Matching[limit-1].Short
+			return
+		}
+		var entry ShortData
+		if entry, err = decode[ShortData](it.Value()); err != nil {
+			return
+		}
+		results.Matching = append(results.Matching, entry)
+	}
+	return
+}
+
+func (p *pebbleShortStore) ownerPrefix(owner uint64) string {
+	return p.ownerKeyspace + fmt.Sprintf("%016x", owner)
+}
+
+func (p *pebbleShortStore) ownerKey(owner uint64, short string) []byte {
+	return []byte(p.ownerPrefix(owner) + short)
+}
+
+func (p *pebbleShortStore) ListByOwner(owner uint64, cursor string, limit int) (results ListResults, err error) {
+	prefix := p.ownerPrefix(owner)
+	lb := []byte(prefix)
+	if cursor != "" {
+		lb = []byte(prefix + cursor + "\x00")
+	}
+	it, err := p.db.NewIter(&pebble.IterOptions{
+		LowerBound: lb,
+		UpperBound: []byte(prefix + "\xff"),
+	})
+	if err != nil {
+		return
+	}
+	defer func() { util.OkOrDie(it.Close()) }()
+
 	for it.First(); it.Valid(); it.Next() {
-		results.Matching = append(results.Matching, gobDecode[ShortData](it.Value()))
+		if limit > 0 && len(results.Matching) == limit {
+			results.Next = results.Matching[limit-1].Short
+			return
+		}
+		var entry ShortData
+		if entry, err = p.Get(string(it.Key()[len(prefix):])); err != nil {
+			return
+		}
+		results.Matching = append(results.Matching, entry)
 	}
-	util.OkOrDie(it.Close())
+	return
+}
+
+func (p *pebbleShortStore) DeleteExpired(now time.Time) (n int, err error) {
+	p.Lock()
+	defer p.Unlock()
+	results, err := p.List("", "")
+	if err != nil {
+		return
+	}
+	p.hits.Lock()
+	defer p.hits.Unlock()
+	b := p.db.NewBatch()
+	defer b.Close()
+	for _, entry := range results.Matching {
+		if !entry.Expired(now, 0) {
+			continue
+		}
+		if err = b.Delete([]byte(p.keyspace+entry.Short), nil); err != nil {
+			return
+		}
+		if err = b.Delete(p.ownerKey(entry.Owner, entry.Short), nil); err != nil {
+			return
+		}
+		if err = p.hits.delete(b, entry.Short); err != nil {
+			return
+		}
+		n++
+	}
+	err = b.Commit(pebble.Sync)
 	return
 }
 
@@ -142,9 +371,9 @@ func (p *pebbleUserStore) keyFromId(id uint64) string {
 
 func (p *pebbleUserStore) LookupOrCreate(queryUser UserData) (user UserData) {
 	var err error
-	logger.Info("Query user", "user", queryUser)
+	p.logger.Info("Query user", "user", queryUser)
 	user, err = p.Get(util.Hash(queryUser.Email))
-	if err != nil {
+	if err == nil {
 		return
 	}
 	if _, ok := err.(util.NoSuchKeyError); !ok {
@@ -152,7 +381,9 @@ func (p *pebbleUserStore) LookupOrCreate(queryUser UserData) (user UserData) {
 	}
 	user = queryUser
 	user.Id = util.Hash(queryUser.Email)
-	err = p.db.Set([]byte(p.keyFromId(user.Id)), gobEncode(user), pebble.Sync)
+	v, err := encode(p.codec, user)
+	util.OkOrDie(err)
+	util.OkOrDie(p.db.Set([]byte(p.keyFromId(user.Id)), v, pebble.Sync))
 	return
 }
 
@@ -162,15 +393,280 @@ func (p *pebbleUserStore) Get(id uint64) (user UserData, err error) {
 	if closer != nil {
 		defer closer.Close()
 	}
-	if err != nil && errors.Is(err, pebble.ErrNotFound) {
+	if errors.Is(err, pebble.ErrNotFound) {
 		err = util.NoSuchKeyError(p.keyFromId(id))
 		return
+	} else if err != nil {
+		return
 	}
-	user = gobDecode[UserData](val)
-	return
+	return decode[UserData](val)
 }
 
 func (p *pebbleUserStore) Delete(id uint64) (err error) {
 	err = p.db.Delete([]byte(p.keyFromId(id)), pebble.Sync)
 	return
 }
+
+func (p *pebbleUserStore) List() (users []UserData, err error) {
+	it, err := p.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(p.keyspace),
+		UpperBound: []byte(string(p.keyspace[0] + 1)),
+	})
+	if err != nil {
+		return
+	}
+	defer func() { util.OkOrDie(it.Close()) }()
+	for it.First(); it.Valid(); it.Next() {
+		var user UserData
+		if user, err = decode[UserData](it.Value()); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	// Keys hold ids in decimal, which does not sort numerically.
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+	return
+}
+
+func (p *pebbleUserStore) ListGroups() (groups []GroupData, err error) {
+	it, err := p.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(p.groupKeyspace),
+		UpperBound: []byte(string(p.groupKeyspace[0] + 1)),
+	})
+	if err != nil {
+		return
+	}
+	defer func() { util.OkOrDie(it.Close()) }()
+	for it.First(); it.Valid(); it.Next() {
+		var group GroupData
+		if group, err = decode[GroupData](it.Value()); err != nil {
+			return
+		}
+		groups = append(groups, group)
+	}
+	return
+}
+
+func (p *pebbleUserStore) groupKey(id uint64) []byte {
+	return []byte(p.groupKeyspace + fmt.Sprintf("%016x", id))
+}
+
+func (p *pebbleUserStore) membershipPrefix(uid uint64) string {
+	return p.membershipKeyspace + fmt.Sprintf("%016x", uid)
+}
+
+func (p *pebbleUserStore) membershipKey(uid, id uint64) []byte {
+	return []byte(p.membershipPrefix(uid) + fmt.Sprintf("%016x", id))
+}
+
+func (p *pebbleUserStore) CreateGroup(group GroupData) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	if _, err = p.GetGroup(group.Id); err == nil {
+		err = util.AlreadyExistsError(group.Name)
+		return
+	} else if _, ok := err.(util.NoSuchKeyError); !ok {
+		return
+	}
+	b := p.db.NewBatch()
+	defer b.Close()
+	if err = set(b, p.codec, p.groupKey(group.Id), group); err != nil {
+		return
+	}
+	for _, uid := range group.Members {
+		if err = b.Set(p.membershipKey(uid, group.Id), nil, nil); err != nil {
+			return
+		}
+	}
+	err = b.Commit(pebble.Sync)
+	return
+}
+
+func (p *pebbleUserStore) GetGroup(id uint64) (group GroupData, err error) {
+	val, closer, err := p.db.Get(p.groupKey(id))
+	if closer != nil {
+		defer closer.Close()
+	}
+	if errors.Is(err, pebble.ErrNotFound) {
+		err = util.NoSuchKeyError(fmt.Sprintf("%d", id))
+		return
+	} else if err != nil {
+		return
+	}
+	return decode[GroupData](val)
+}
+
+func (p *pebbleUserStore) AddMember(id, uid uint64) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	group, err := p.GetGroup(id)
+	if err != nil || slices.Contains(group.Members, uid) {
+		return
+	}
+	group.Members = append(group.Members, uid)
+	b := p.db.NewBatch()
+	defer b.Close()
+	if err = set(b, p.codec, p.groupKey(id), group); err != nil {
+		return
+	}
+	if err = b.Set(p.membershipKey(uid, id), nil, nil); err != nil {
+		return
+	}
+	err = b.Commit(pebble.Sync)
+	return
+}
+
+func (p *pebbleUserStore) RemoveMember(id, uid uint64) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	group, err := p.GetGroup(id)
+	if err != nil {
+		return
+	}
+	group.Members = slices.DeleteFunc(group.Members, func(m uint64) bool { return m == uid })
+	b := p.db.NewBatch()
+	defer b.Close()
+	if err = set(b, p.codec, p.groupKey(id), group); err != nil {
+		return
+	}
+	if err = b.Delete(p.membershipKey(uid, id), nil); err != nil {
+		return
+	}
+	err = b.Commit(pebble.Sync)
+	return
+}
+
+func (p *pebbleUserStore) GroupsOf(uid uint64) (groups []GroupData, err error) {
+	prefix := p.membershipPrefix(uid)
+	it, err := p.db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefix),
+		UpperBound: []byte(prefix + "\xff"),
+	})
+	if err != nil {
+		return
+	}
+	defer func() { util.OkOrDie(it.Close()) }()
+
+	for it.First(); it.Valid(); it.Next() {
+		var id uint64
+		if _, err = fmt.Sscanf(string(it.Key()[len(prefix):]), "%016x", &id); err != nil {
+			return
+		}
+		var group GroupData
+		if group, err = p.GetGroup(id); err != nil {
+			return
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return
+}
+
+func (p *pebbleUserStore) isMember(id, uid uint64) (ok bool, err error) {
+	_, closer, err := p.db.Get(p.membershipKey(uid, id))
+	if err == nil {
+		return true, closer.Close()
+	} else if errors.Is(err, pebble.ErrNotFound) {
+		err = nil
+	}
+	return
+}
+
+// Clicks are keyed by short, then timestamp, then a sequence number that
+// disambiguates hits within the same nanosecond.
+func (p *pebbleHitStore) clickPrefix(short string, ts time.Time) []byte {
+	k := []byte(p.clickKeyspace + short + "\x00")
+	return binary.BigEndian.AppendUint64(k, uint64(ts.UnixNano()))
+}
+
+// delete removes the count and clicks of short in b, so that a short created
+// with its name starts without them. Callers must hold the lock, so that a
+// concurrent Record does not write the count back.
+func (p *pebbleHitStore) delete(b *pebble.Batch, short string) error {
+	if err := b.Delete([]byte(p.countKeyspace+short), nil); err != nil {
+		return err
+	}
+	prefix := p.clickKeyspace + short
+	return b.DeleteRange([]byte(prefix+"\x00"), []byte(prefix+"\x01"), nil)
+}
+
+func (p *pebbleHitStore) count(short string) (count int64, err error) {
+	val, closer, err := p.db.Get([]byte(p.countKeyspace + short))
+	if closer != nil {
+		defer closer.Close()
+	}
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			err = nil
+		}
+		return
+	}
+	count = int64(binary.BigEndian.Uint64(val))
+	return
+}
+
+func (p *pebbleHitStore) Record(hits []Hit) (err error) {
+	p.Lock()
+	defer p.Unlock()
+	b := p.db.NewBatch()
+	defer b.Close()
+	counts := make(map[string]int64)
+	for _, h := range hits {
+		p.seq++
+		k := binary.BigEndian.AppendUint32(p.clickPrefix(h.Short, h.Timestamp), p.seq)
+		if err = set(b, p.codec, k, h); err != nil {
+			return
+		}
+		counts[h.Short]++
+	}
+	for short, n := range counts {
+		var prev int64
+		if prev, err = p.count(short); err != nil {
+			return
+		}
+		v := binary.BigEndian.AppendUint64(nil, uint64(prev+n))
+		if err = b.Set([]byte(p.countKeyspace+short), v, nil); err != nil {
+			return
+		}
+	}
+	err = b.Commit(pebble.Sync)
+	return
+}
+
+func (p *pebbleHitStore) Count(short string) (count int64, err error) {
+	return p.count(short)
+}
+
+// Counts reads each count; pebble is local, so there is nothing to batch.
+func (p *pebbleHitStore) Counts(shorts []string) (counts map[string]int64, err error) {
+	counts = make(map[string]int64, len(shorts))
+	for _, short := range shorts {
+		if counts[short], err = p.count(short); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (p *pebbleHitStore) Clicks(short string, since, until time.Time) (hits []Hit, err error) {
+	it, err := p.db.NewIter(&pebble.IterOptions{
+		LowerBound: p.clickPrefix(short, since),
+		UpperBound: p.clickPrefix(short, until),
+	})
+	if err != nil {
+		return
+	}
+	defer func() { util.OkOrDie(it.Close()) }()
+	for it.First(); it.Valid(); it.Next() {
+		var h Hit
+		if h, err = decode[Hit](it.Value()); err != nil {
+			return
+		}
+		hits = append(hits, h)
+	}
+	return
+}
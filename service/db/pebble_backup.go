@@ -0,0 +1,348 @@
+package db
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Backups are pebble checkpoints: consistent copies of the store, taken while
+// it is in use, that share immutable files with it where the filesystem
+// allows. They are kept in BackupConfig.Dir as directories or gzipped
+// tarballs, either of which can be restored with PebbleConfig.RestoreFrom.
+
+// Backuper is implemented by stores that can back themselves up while in use.
+type Backuper interface {
+	// Backup writes a backup to the backup directory and returns its path.
+	Backup() (string, error)
+	// WriteBackup writes a backup to w as a gzipped tarball.
+	WriteBackup(w io.Writer) error
+}
+
+type BackupConfig struct {
+	// Dir holds backups, named tinyr-<UTC time>; backups are disabled if it is
+	// empty.
+	Dir string
+	// Tar writes backups as gzipped tarballs rather than directories.
+	Tar bool
+	// Interval is the time between scheduled backups; zero disables them.
+	Interval time.Duration
+	// Retain is the number of backups kept in Dir; zero keeps all of them.
+	Retain int
+}
+
+const (
+	backupPrefix     = "tinyr-"
+	backupTimeFormat = "20060102T150405.000Z"
+	tarExtension     = ".tar.gz"
+)
+
+type pebbleContainer struct {
+	container
+	backupLock sync.Mutex // Backups are named by time; take one at a time, and none once closed.
+	backup     BackupConfig
+	db         *pebble.DB
+	logger     *slog.Logger
+	closed     bool
+	// stop ends scheduled backups, which are done once they have stopped.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// checkpoint writes a checkpoint of the store to dir, which must not exist.
+func (p *pebbleContainer) checkpoint(dir string) error {
+	return p.db.Checkpoint(dir, pebble.WithFlushedWAL())
+}
+
+func (p *pebbleContainer) Backup() (path string, err error) {
+	if p.backup.Dir == "" {
+		err = fmt.Errorf("no backup directory configured")
+		return
+	}
+	p.backupLock.Lock()
+	defer p.backupLock.Unlock()
+	if p.closed {
+		err = pebble.ErrClosed
+		return
+	} else if err = os.MkdirAll(p.backup.Dir, 0o755); err != nil {
+		return
+	}
+	path = filepath.Join(p.backup.Dir, backupPrefix+time.Now().UTC().Format(backupTimeFormat))
+	if p.backup.Tar {
+		path += tarExtension
+		err = p.writeTarball(path)
+	} else {
+		err = p.checkpoint(path)
+	}
+	if err != nil {
+		return
+	}
+	p.logger.Info("backed up store", "path", path)
+	err = pruneBackups(p.logger, p.backup.Dir, p.backup.Retain)
+	return
+}
+
+// writeTarball writes a backup to the tarball at path, which appears only
+// once it is complete.
+func (p *pebbleContainer) writeTarball(path string) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), ".backup-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	if err = p.writeBackup(f); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (p *pebbleContainer) WriteBackup(w io.Writer) (err error) {
+	p.backupLock.Lock()
+	defer p.backupLock.Unlock()
+	if p.closed {
+		return pebble.ErrClosed
+	}
+	return p.writeBackup(w)
+}
+
+// writeBackup writes a backup to w. Callers must hold the backup lock.
+func (p *pebbleContainer) writeBackup(w io.Writer) (err error) {
+	tmp, err := os.MkdirTemp("", "tinyr-checkpoint-*")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "store")
+	if err = p.checkpoint(dir); err != nil {
+		return
+	}
+	return writeTar(dir, w)
+}
+
+// scheduleBackups backs up the store every backup interval.
+func (p *pebbleContainer) scheduleBackups() {
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	if p.backup.Interval <= 0 || p.backup.Dir == "" {
+		p.logger.Info("scheduled backups disabled")
+		close(p.done)
+		return
+	}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.backup.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+			if _, err := p.Backup(); err != nil {
+				p.logger.Warn("Error backing up store", "error", err)
+			}
+		}
+	}()
+}
+
+// Close stops scheduled backups, waits for any backup in progress, and closes
+// the store.
+func (p *pebbleContainer) Close() error {
+	close(p.stop)
+	<-p.done
+	p.backupLock.Lock()
+	defer p.backupLock.Unlock()
+	p.closed = true
+	return p.db.Close()
+}
+
+// pruneBackups removes all but the newest retain backups in dir.
+func pruneBackups(logger *slog.Logger, dir string, retain int) error {
+	if retain <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), backupPrefix) {
+			backups = append(backups, e.Name())
+		}
+	}
+	// Names sort by time.
+	sort.Strings(backups)
+	for len(backups) > retain {
+		logger.Info("removing old backup", "name", backups[0])
+		if err = os.RemoveAll(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func writeTar(dir string, w io.Writer) (err error) {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		if hdr.Name, err = filepath.Rel(dir, path); err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(hdr.Name)
+		if err = tw.WriteHeader(hdr); err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	if err = tw.Close(); err != nil {
+		return
+	}
+	return zw.Close()
+}
+
+func readTar(r io.Reader, dir string) (err error) {
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return
+	}
+	tr := tar.NewReader(zr)
+	for {
+		var hdr *tar.Header
+		if hdr, err = tr.Next(); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("invalid backup entry %q", hdr.Name)
+		}
+		path := filepath.Join(dir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0o755)
+		case tar.TypeReg:
+			err = writeFile(path, tr)
+		default:
+			err = fmt.Errorf("invalid backup entry %q", hdr.Name)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeFile(path string, r io.Reader) (err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
+
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0o755)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return writeFile(filepath.Join(dst, rel), f)
+	})
+}
+
+// restorePebble restores the backup at src, a directory or tarball, to path,
+// unless path already holds a store. That leaves RestoreFrom safe to keep set
+// across restarts.
+func restorePebble(logger *slog.Logger, src, path string) (err error) {
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		logger.Info("store exists, not restoring", "path", path, "from", src)
+		return nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return
+	}
+	// Restore beside path, so that an interrupted restore leaves no store.
+	tmp := strings.TrimSuffix(path, string(filepath.Separator)) + ".restoring"
+	if err = os.RemoveAll(tmp); err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	logger.Info("restoring store", "path", path, "from", src)
+	if info.IsDir() {
+		err = copyDir(src, tmp)
+	} else {
+		var f *os.File
+		if f, err = os.Open(src); err != nil {
+			return
+		}
+		defer f.Close()
+		err = readTar(f, tmp)
+	}
+	if err != nil {
+		return
+	}
+	if err = os.RemoveAll(path); err != nil {
+		return
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPebbleBackup(t *testing.T) {
+	for _, tar := range []bool{false, true} {
+		dir := t.TempDir()
+		backups := filepath.Join(dir, "backups")
+		db := New(Config{Type: Pebble, Pebble: PebbleConfig{
+			Path:   filepath.Join(dir, "store"),
+			Backup: BackupConfig{Dir: backups, Tar: tar, Retain: 2},
+		}})
+		entry := ShortData{Short: "miserable", Long: "pigeon", Owner: 42}
+		if err := db.Shorts().Create(entry); err != nil {
+			t.Fatalf("Got error %v", err)
+		}
+		var path string
+		for i := 0; i < 3; i++ {
+			var err error
+			if path, err = db.(Backuper).Backup(); err != nil {
+				t.Fatalf("Got error %v", err)
+			}
+		}
+		if entries, _ := os.ReadDir(backups); len(entries) != 2 {
+			t.Errorf("Expected 2 backups, got %v", entries)
+		}
+
+		restored := New(Config{Type: Pebble, Pebble: PebbleConfig{Path: filepath.Join(dir, "restored"), RestoreFrom: path}})
+		if got, err := restored.Shorts().Get(entry.Short); err != nil || got.Long != entry.Long {
+			t.Errorf("tar=%v: incorrect entry %v, %v", tar, got, err)
+		}
+	}
+}
+
+func TestPebbleWriteBackup(t *testing.T) {
+	dir := t.TempDir()
+	db := New(Config{Type: Pebble, Pebble: PebbleConfig{Path: filepath.Join(dir, "store")}})
+	entry := ShortData{Short: "miserable", Long: "pigeon", Owner: 42}
+	if err := db.Shorts().Create(entry); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if _, err := db.(Backuper).Backup(); err == nil {
+		t.Errorf("Expected error without a backup directory")
+	}
+	var buf bytes.Buffer
+	if err := db.(Backuper).WriteBackup(&buf); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	tarball := filepath.Join(dir, "backup.tar.gz")
+	os.WriteFile(tarball, buf.Bytes(), 0o644)
+
+	// Existing stores are not replaced.
+	path := filepath.Join(dir, "restored")
+	if err := restorePebble(slog.Default(), tarball, path); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	os.WriteFile(tarball, []byte("not a backup"), 0o644)
+	if err := restorePebble(slog.Default(), tarball, path); err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	restored := New(Config{Type: Pebble, Pebble: PebbleConfig{Path: path}})
+	if got, err := restored.Shorts().Get(entry.Short); err != nil || got.Long != entry.Long {
+		t.Errorf("Incorrect entry %v, %v", got, err)
+	}
+	if err := restorePebble(slog.Default(), tarball, filepath.Join(dir, "empty")); err == nil {
+		t.Errorf("Expected error for corrupt backup")
+	}
+}
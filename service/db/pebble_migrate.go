@@ -0,0 +1,365 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// Pebble has no schema, but the keyspaces and the encoding of values in them
+// change. Each change is a Go migration that rewrites the store, registered in
+// pebbleMigrations in version order. Stores are migrated up when they are
+// opened, and the latest applied version is kept under formatVersionKey, so
+// that a binary refuses stores written by a newer one.
+
+const (
+	formatVersionKey = metaKeyspace + "formatVersion"
+	migrationPrefix  = metaKeyspace + "migration/"
+	// progressPrefix keeps the last key rewritten in a keyspace by a migration
+	// that has not finished, so that it resumes after it.
+	progressPrefix = metaKeyspace + "progress/"
+
+	// pebbleBatchSize is the number of keys rewritten per batch.
+	pebbleBatchSize = 1000
+)
+
+type pebbleMigration struct {
+	Version int
+	Name    string
+	Up      func(db *pebble.DB) error
+	// Down undoes Up; migrations without one cannot be rolled back.
+	Down func(db *pebble.DB) error
+}
+
+var pebbleMigrations = []pebbleMigration{
+	{Version: 1, Name: "owner_index", Up: indexOwners, Down: dropOwnerIndex},
+	{Version: 2, Name: "codec_header", Up: addCodecHeaders, Down: dropCodecHeaders},
+}
+
+func latestPebbleVersion() int {
+	return pebbleMigrations[len(pebbleMigrations)-1].Version
+}
+
+func findPebbleMigration(version int) (m pebbleMigration, err error) {
+	for _, m = range pebbleMigrations {
+		if m.Version == version {
+			return
+		}
+	}
+	err = fmt.Errorf("no pebble migration %d", version)
+	return
+}
+
+// upperBound bounds iteration over the keys that start with prefix, which
+// are all printable.
+func upperBound(prefix string) []byte {
+	return []byte(prefix + "\xff")
+}
+
+// rewrite calls f for every key in keyspace, committing f's writes every
+// pebbleBatchSize keys.
+func rewrite(db *pebble.DB, keyspace string, f func(b *pebble.Batch, k, v []byte) error) (err error) {
+	return rewriteFrom(db, keyspace, "", f)
+}
+
+// rewriteFrom is rewrite, which if progress is set records the last key
+// rewritten under it in each batch, and resumes after it, so that a rewrite
+// interrupted by a crash does not rewrite keys twice. The progress is deleted
+// with the last batch.
+func rewriteFrom(db *pebble.DB, keyspace, progress string, f func(b *pebble.Batch, k, v []byte) error) (err error) {
+	lower := []byte(keyspace)
+	if progress != "" {
+		val, closer, err := db.Get([]byte(progress))
+		if err == nil {
+			lower = append(slices.Clone(val), 0)
+			closer.Close()
+		} else if !errors.Is(err, pebble.ErrNotFound) {
+			return err
+		}
+	}
+	it, err := db.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upperBound(keyspace)})
+	if err != nil {
+		return
+	}
+	defer it.Close()
+	b := db.NewBatch()
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		if err = f(b, it.Key(), it.Value()); err != nil {
+			b.Close()
+			return
+		}
+		if n++; n%pebbleBatchSize == 0 {
+			if progress != "" {
+				if err = b.Set([]byte(progress), it.Key(), nil); err != nil {
+					b.Close()
+					return
+				}
+			}
+			if err = b.Commit(pebble.Sync); err != nil {
+				b.Close()
+				return
+			}
+			b.Close()
+			b = db.NewBatch()
+		}
+	}
+	defer b.Close()
+	if err = it.Error(); err != nil {
+		return
+	}
+	if progress != "" {
+		if err = b.Delete([]byte(progress), nil); err != nil {
+			return
+		}
+	}
+	err = b.Commit(pebble.Sync)
+	return
+}
+
+// indexOwners builds the owner index for stores written before it existed.
+func indexOwners(db *pebble.DB) error {
+	p := &pebbleShortStore{keyspace: shortKeyspace, ownerKeyspace: ownerKeyspace, db: db}
+	return rewrite(db, shortKeyspace, func(b *pebble.Batch, k, v []byte) error {
+		entry, err := gobDecode[ShortData](v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		return b.Set(p.ownerKey(entry.Owner, entry.Short), nil, nil)
+	})
+}
+
+func dropOwnerIndex(db *pebble.DB) error {
+	return db.DeleteRange([]byte(ownerKeyspace), upperBound(ownerKeyspace), pebble.Sync)
+}
+
+// Before version 2, values were gob without a codec header.
+
+func gobEncode[T any](e T) (encoded []byte) {
+	encoded, err := gobCodec{}.Marshal(e)
+	util.OkOrDie(err)
+	return
+}
+
+func gobDecode[T any](encoded []byte) (e T, err error) {
+	if err = (gobCodec{}).Unmarshal(encoded, &e); err != nil {
+		err = fmt.Errorf("decoding %T: %w", e, err)
+	}
+	return
+}
+
+// toGob re-encodes a value with a codec header as gob without one.
+func toGob[T any](v []byte) ([]byte, error) {
+	e, err := decode[T](v)
+	if err != nil {
+		return nil, err
+	}
+	return gobCodec{}.Marshal(e)
+}
+
+// hasHeader is true iff v has a codec header, and decodes with it.
+func hasHeader[T any](v []byte) bool {
+	if len(v) == 0 {
+		return false
+	}
+	if _, err := codecByHeader(v[0]); err != nil {
+		return false
+	}
+	_, err := decode[T](v)
+	return err == nil
+}
+
+// encodedKeyspaces maps the keyspaces of encoded values to the functions that
+// remove and detect their codec header.
+var encodedKeyspaces = map[string]struct {
+	toGob     func([]byte) ([]byte, error)
+	hasHeader func([]byte) bool
+}{
+	shortKeyspace: {toGob[ShortData], hasHeader[ShortData]},
+	userKeyspace:  {toGob[UserData], hasHeader[UserData]},
+	groupKeyspace: {toGob[GroupData], hasHeader[GroupData]},
+	clickKeyspace: {toGob[Hit], hasHeader[Hit]},
+}
+
+// addCodecHeaders is safe to run again after it is interrupted: it resumes
+// after the last batch it committed, and skips values that have a header.
+func addCodecHeaders(db *pebble.DB) (err error) {
+	for keyspace, e := range encodedKeyspaces {
+		err = rewriteFrom(db, keyspace, progressPrefix+keyspace, func(b *pebble.Batch, k, v []byte) error {
+			if e.hasHeader(v) {
+				return nil
+			}
+			return b.Set(k, append([]byte{gobCodec{}.Header()}, v...), nil)
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func dropCodecHeaders(db *pebble.DB) (err error) {
+	for keyspace, e := range encodedKeyspaces {
+		err = rewrite(db, keyspace, func(b *pebble.Batch, k, v []byte) error {
+			v, err := e.toGob(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			return b.Set(k, v, nil)
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// PebbleMigrator applies pebbleMigrations to DB, or to the store at Path if DB
+// is nil.
+type PebbleMigrator struct {
+	Path   string
+	DB     *pebble.DB
+	opened bool
+}
+
+func (p *PebbleMigrator) InitDB() (err error) {
+	if p.DB != nil {
+		return
+	}
+	p.DB, err = pebble.Open(p.Path, &pebble.Options{})
+	p.opened = err == nil
+	return
+}
+
+func (p *PebbleMigrator) Complete() {
+	if p.opened {
+		p.DB.Close()
+		p.DB, p.opened = nil, false
+	}
+}
+
+func (p *PebbleMigrator) Schemas() (schemas []Schema, err error) {
+	for _, m := range pebbleMigrations {
+		fn := fmt.Sprintf("%03d_%s", m.Version, m.Name)
+		schemas = append(schemas, Schema{Schema: m.Name, Filename: fn, Version: m.Version, Checksum: checksum([]byte(fn))})
+	}
+	return
+}
+
+func (p *PebbleMigrator) DownSchema(s Schema) (Schema, error) {
+	m, err := findPebbleMigration(s.Version)
+	if err != nil {
+		return Schema{}, err
+	} else if m.Down == nil {
+		return Schema{}, fmt.Errorf("cannot roll back %v", s.Filename)
+	}
+	s.Filename += ".down"
+	s.Down = true
+	return s, nil
+}
+
+func (p *PebbleMigrator) ApplySchema(s Schema, dry_run bool) (err error) {
+	m, err := findPebbleMigration(s.Version)
+	if err != nil || dry_run {
+		return
+	}
+	if s.Down {
+		return m.Down(p.DB)
+	}
+	return m.Up(p.DB)
+}
+
+// formatVersion returns the stored format version, or 0 for new stores and
+// stores written before it was kept.
+func (p *PebbleMigrator) formatVersion() (version int, err error) {
+	val, closer, err := p.DB.Get([]byte(formatVersionKey))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+	defer closer.Close()
+	return strconv.Atoi(string(val))
+}
+
+func (p *PebbleMigrator) Applied() (applied []Migration, err error) {
+	version, err := p.formatVersion()
+	if err != nil {
+		return
+	} else if version > latestPebbleVersion() {
+		err = fmt.Errorf("store has format version %d, but this binary knows only up to %d", version, latestPebbleVersion())
+		return
+	}
+	it, err := p.DB.NewIter(&pebble.IterOptions{LowerBound: []byte(migrationPrefix), UpperBound: upperBound(migrationPrefix)})
+	if err != nil {
+		return
+	}
+	defer it.Close()
+	for it.First(); it.Valid(); it.Next() {
+		var m Migration
+		if err = json.Unmarshal(it.Value(), &m); err != nil {
+			return
+		}
+		applied = append(applied, m)
+	}
+	err = it.Error()
+	return
+}
+
+func (p *PebbleMigrator) migrationKey(version int) []byte {
+	return []byte(migrationPrefix + fmt.Sprintf("%08d", version))
+}
+
+// setFormatVersion stores the latest applied version once b is applied.
+func (p *PebbleMigrator) setFormatVersion(b *pebble.Batch) error {
+	version := 0
+	it, err := b.NewIter(&pebble.IterOptions{LowerBound: []byte(migrationPrefix), UpperBound: upperBound(migrationPrefix)})
+	if err != nil {
+		return err
+	}
+	if it.Last() {
+		var m Migration
+		if err = json.Unmarshal(it.Value(), &m); err != nil {
+			it.Close()
+			return err
+		}
+		version = m.Version
+	}
+	if err = it.Close(); err != nil {
+		return err
+	}
+	return b.Set([]byte(formatVersionKey), []byte(strconv.Itoa(version)), nil)
+}
+
+func (p *PebbleMigrator) Record(m Migration) (err error) {
+	val, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	b := p.DB.NewIndexedBatch()
+	defer b.Close()
+	if err = b.Set(p.migrationKey(m.Version), val, nil); err != nil {
+		return
+	}
+	if err = p.setFormatVersion(b); err != nil {
+		return
+	}
+	return b.Commit(pebble.Sync)
+}
+
+func (p *PebbleMigrator) Forget(version int) (err error) {
+	b := p.DB.NewIndexedBatch()
+	defer b.Close()
+	if err = b.Delete(p.migrationKey(version), nil); err != nil {
+		return
+	}
+	if err = p.setFormatVersion(b); err != nil {
+		return
+	}
+	return b.Commit(pebble.Sync)
+}
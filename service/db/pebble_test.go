@@ -0,0 +1,144 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ml8/tinyr/service/util"
+)
+
+func TestPebbleList(t *testing.T) {
+	testList(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleHits(t *testing.T) {
+	testHits(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleListByOwner(t *testing.T) {
+	testListByOwner(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleListPage(t *testing.T) {
+	testListPage(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleOwnerIndexBackfill(t *testing.T) {
+	dir := t.TempDir()
+	db, err := pebble.Open(dir, &pebble.Options{})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	entry := ShortData{Short: "miserable", Long: "pigeon", Owner: 42}
+	db.Set([]byte(shortKeyspace+entry.Short), gobEncode(entry), pebble.Sync)
+	db.Close()
+
+	results, err := New(Config{Type: Pebble, Pebble: PebbleConfig{Path: dir}}).Shorts().ListByOwner(42, "", 0)
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if len(results.Matching) != 1 || !reflect.DeepEqual(results.Matching[0], entry) {
+		t.Errorf("Incorrect results %v", results)
+	}
+}
+
+func TestPebbleCreate(t *testing.T) {
+	testCreate(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleDeleteExpired(t *testing.T) {
+	testDeleteExpired(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleDeleteHits(t *testing.T) {
+	testDeleteHits(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleUpdate(t *testing.T) {
+	testUpdate(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleGroups(t *testing.T) {
+	testGroups(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleSharedOwnership(t *testing.T) {
+	testSharedOwnership(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
+
+func TestPebbleMigrate(t *testing.T) {
+	dir := t.TempDir()
+	m := &PebbleMigrator{Path: dir}
+	if err := RunMigration(MigrationArgs{Migrator: m}); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	migrate := func(args MigrationArgs) (applied []Migration, version int) {
+		args.Migrator = m
+		if err := RunMigration(args); err != nil {
+			t.Fatalf("Got error %v", err)
+		}
+		util.OkOrDie(m.InitDB())
+		defer m.Complete()
+		applied, err := m.Applied()
+		util.OkOrDie(err)
+		version, err = m.formatVersion()
+		util.OkOrDie(err)
+		return
+	}
+	if applied, version := migrate(MigrationArgs{}); len(applied) != len(pebbleMigrations) || version != latestPebbleVersion() {
+		t.Errorf("Incorrect applied %v, version %v", applied, version)
+	}
+	if applied, version := migrate(MigrationArgs{Command: MigrateDown, Target: 0}); len(applied) != 0 || version != 0 {
+		t.Errorf("Incorrect applied %v, version %v", applied, version)
+	}
+
+	// Stores written by a newer binary are refused.
+	db, err := pebble.Open(dir, &pebble.Options{})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	db.Set([]byte(formatVersionKey), []byte("999"), pebble.Sync)
+	db.Close()
+	if err := RunMigration(MigrationArgs{Migrator: m}); err == nil {
+		t.Errorf("Expected error for newer format version")
+	}
+}
+
+func TestPebbleCorruptValue(t *testing.T) {
+	db := New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}})
+	p := db.Shorts().(*pebbleShortStore)
+	p.db.Set([]byte(shortKeyspace+"corrupt"), []byte("not gob"), pebble.Sync)
+	if _, err := db.Shorts().Get("corrupt"); err == nil {
+		t.Errorf("Expected error for corrupt value")
+	}
+	if _, err := db.Shorts().List("", ""); err == nil {
+		t.Errorf("Expected error for corrupt value")
+	}
+}
+
+func TestPebbleClose(t *testing.T) {
+	dir := t.TempDir()
+	db := New(Config{Type: Pebble, Pebble: PebbleConfig{Path: dir, Backup: BackupConfig{Dir: t.TempDir(), Interval: time.Hour}}})
+	entry := ShortData{Short: "miserable", Long: "pigeon", Owner: 42}
+	if err := db.Shorts().Create(entry); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if _, err := db.(Backuper).Backup(); err == nil {
+		t.Errorf("Expected error backing up a closed store")
+	}
+
+	// Closed stores can be reopened.
+	db = New(Config{Type: Pebble, Pebble: PebbleConfig{Path: dir}})
+	defer db.Close()
+	if got, err := db.Shorts().Get(entry.Short); err != nil || got.Long != entry.Long {
+		t.Errorf("Incorrect entry %v, %v", got, err)
+	}
+}
+
+func TestPebbleNotFound(t *testing.T) {
+	testNotFound(t, New(Config{Type: Pebble, Pebble: PebbleConfig{Path: t.TempDir()}}))
+}
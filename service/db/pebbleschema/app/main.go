@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// Pebble stores are migrated up when they are opened; this reports their
+// status and rolls them back, while the service is stopped.
+
+var (
+	logger *slog.Logger
+	fs     = flag.NewFlagSet("migrate", flag.ExitOnError)
+
+	_          = fs.String("config", "", "config file")
+	dryRun     = fs.Bool("dry_run", false, "if true, output operations without affecting database")
+	target     = fs.Int("target", -1, "version to migrate up or down to; up defaults to the latest")
+	pebblePath = fs.String("pebblePath", "", "path to PebbleDB directory")
+)
+
+func main() {
+	// up (the default), down or status, which comes before the flags: flags
+	// after it would not be parsed.
+	args, command := os.Args[1:], ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	ff.Parse(fs, args,
+		ff.WithEnvVarPrefix("TINYR"),
+		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(ff.PlainParser))
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %v; usage: %v [up|down|status] [flags]\n", fs.Args(), fs.Name())
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	logger = slog.New(
+		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			AddSource: true,
+			Level:     slog.LevelInfo,
+		}))
+	logger.Info("flags", "command", command, "target", *target, "dry_run", *dryRun, "pebblePath", *pebblePath)
+
+	util.OkOrDie(db.RunMigration(
+		db.MigrationArgs{
+			Logger:   logger,
+			DryRun:   *dryRun,
+			Command:  command,
+			Target:   *target,
+			Migrator: &db.PebbleMigrator{Path: *pebblePath},
+		}))
+}
@@ -1,37 +1,222 @@
 package db
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/XSAM/otelsql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 
 	"github.com/ml8/tinyr/service/healthz"
 	"github.com/ml8/tinyr/service/util"
 )
 
 var (
-	knownDrivers = []string{"mysql"}
+	knownDrivers = []dialect{mysqlDialect, postgresDialect, sqliteDialect}
 )
 
+// Queries are written with ? placeholders, and rebound for the dialect. Those
+// that differ in more than placeholders are built by the dialect.
 const (
-	getShortQ    = "SELECT short_url, long_url, owner_id FROM shorts WHERE short_url=?"
-	insertShortQ = "REPLACE INTO shorts (short_url, long_url, owner_id) VALUES (?, ?, ?)"
-	deleteShortQ = "DELETE FROM shorts WHERE short_url=?"
+	errDupEntry        = 1062    // mysql ER_DUP_ENTRY
+	errUniqueViolation = "23505" // postgres unique_violation
 
+	shortCols      = "short_url, long_url, owner_id, expires_at, max_hits, version, group_id, editors, mode"
+	getShortQ      = "SELECT " + shortCols + " FROM shorts WHERE short_url=?"
+	createShortQ   = "INSERT INTO shorts (" + shortCols + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	updateShortQ   = "UPDATE shorts SET long_url=?, mode=?, expires_at=?, max_hits=?, version=version+1 WHERE short_url=? AND version=?"
+	setOwnersQ     = "UPDATE shorts SET owner_id=?, group_id=?, editors=?, version=version+1 WHERE short_url=? AND version=?"
+	deleteShortQ   = "DELETE FROM shorts WHERE short_url=?"
+	ownerShortQ    = "SELECT " + shortCols + " FROM shorts WHERE owner_id=? AND short_url>? ORDER BY short_url LIMIT ?"
+	listShortQ     = "SELECT " + shortCols + " FROM shorts WHERE (?='' OR short_url>=?) AND (?='' OR short_url<=?) AND short_url>? ORDER BY short_url LIMIT ?"
+	expireShortsQ  = "DELETE FROM shorts WHERE expires_at>0 AND expires_at<=?"
+	expiredShortsQ = "SELECT short_url FROM shorts WHERE expires_at>0 AND expires_at<=?"
+
+	userCols    = "user_id, email, name"
 	getUserQ    = "SELECT user_id, email, name FROM users WHERE user_id=?"
-	insertUserQ = "REPLACE INTO users (user_id, email, name) VALUES (?, ?, ?)"
 	deleteUserQ = "DELETE FROM users WHERE user_id=?"
+	listUsersQ  = "SELECT user_id, email, name FROM users ORDER BY user_id"
+
+	memberCols    = "group_id, user_id"
+	createGroupQ  = "INSERT INTO user_groups (group_id, name) VALUES (?, ?)"
+	getGroupQ     = "SELECT group_id, name FROM user_groups WHERE group_id=?"
+	groupMembersQ = "SELECT user_id FROM group_members WHERE group_id=? ORDER BY user_id"
+	removeMemberQ = "DELETE FROM group_members WHERE group_id=? AND user_id=?"
+	isMemberQ     = "SELECT COUNT(*) FROM group_members WHERE group_id=? AND user_id=?"
+	groupsOfUserQ = "SELECT group_id FROM group_members WHERE user_id=?"
+	listGroupsQ   = "SELECT group_id FROM user_groups ORDER BY group_id"
+
+	countHitsQ    = "SELECT hits FROM hit_counts WHERE short_url=?"
+	listCountsQ   = "SELECT short_url, hits FROM hit_counts WHERE short_url IN "
+	deleteCountQ  = "DELETE FROM hit_counts WHERE short_url=?"
+	deleteClicksQ = "DELETE FROM clicks WHERE short_url=?"
+	expireCountsQ = "DELETE FROM hit_counts WHERE short_url IN (" + expiredShortsQ + ")"
+	expireClicksQ = "DELETE FROM clicks WHERE short_url IN (" + expiredShortsQ + ")"
+	insertClicksQ = "INSERT INTO clicks (short_url, ts, host, referrer, user_agent) VALUES "
+	insertClickV  = "(?, ?, ?, ?, ?)"
+	listClicksQ   = "SELECT short_url, ts, host, referrer, user_agent FROM clicks WHERE short_url=? AND ts>=? AND ts<? ORDER BY ts, click_id"
 )
 
 type SQLConfig struct {
-	Driver     string // mysql
+	Driver     string // mysql, postgres or sqlite
 	ConnString string // Connection string
 }
 
+// A dialect is named for its driver.
+const (
+	mysqlDialect    dialect = "mysql"
+	postgresDialect dialect = "postgres"
+	sqliteDialect   dialect = "sqlite"
+)
+
+// dialect generates the SQL that differs between databases.
+type dialect string
+
+// rebind replaces the ? placeholders in q with the dialect's own.
+func (d dialect) rebind(q string) string {
+	if d != postgresDialect {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// id is the argument for a user or group id. Postgres and sqlite have no
+// unsigned 64-bit integer, so ids are stored as the int64 with the same bits.
+func (d dialect) id(id uint64) any {
+	if d == mysqlDialect {
+		return id
+	}
+	return int64(id)
+}
+
+// valueList is the placeholders for cols.
+func valueList(cols string) string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", len(strings.Split(cols, ", "))), ", ") + ")"
+}
+
+// upsert inserts cols into table, replacing any row with the same key.
+func (d dialect) upsert(table, key, cols string) string {
+	q := "INSERT INTO " + table + " (" + cols + ") VALUES " + valueList(cols)
+	if d == mysqlDialect {
+		return "REPLACE" + strings.TrimPrefix(q, "INSERT")
+	}
+	var set []string
+	for _, c := range strings.Split(cols, ", ") {
+		if c != key {
+			set = append(set, c+"=excluded."+c)
+		}
+	}
+	return q + " ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(set, ", ")
+}
+
+// insertIgnore inserts cols into table unless the row already exists.
+func (d dialect) insertIgnore(table, cols string) string {
+	if d == mysqlDialect {
+		return "INSERT IGNORE INTO " + table + " (" + cols + ") VALUES " + valueList(cols)
+	}
+	return "INSERT INTO " + table + " (" + cols + ") VALUES " + valueList(cols) + " ON CONFLICT DO NOTHING"
+}
+
+// increment inserts a counter for key into table, or adds to an existing one.
+func (d dialect) increment(table, key, counter string) string {
+	q := "INSERT INTO " + table + " (" + key + ", " + counter + ") VALUES (?, ?)"
+	if d == mysqlDialect {
+		return q + fmt.Sprintf(" ON DUPLICATE KEY UPDATE %[1]s=%[1]s+VALUES(%[1]s)", counter)
+	}
+	return q + fmt.Sprintf(" ON CONFLICT (%[1]s) DO UPDATE SET %[2]s=%[3]s.%[2]s+excluded.%[2]s", key, counter, table)
+}
+
+// duplicate is true iff err is from inserting a row whose key exists.
+func (d dialect) duplicate(err error) bool {
+	var merr *mysql.MySQLError
+	var perr *pq.Error
+	var serr *sqlite.Error
+	switch {
+	case errors.As(err, &merr):
+		return merr.Number == errDupEntry
+	case errors.As(err, &perr):
+		return perr.Code == errUniqueViolation
+	case errors.As(err, &serr):
+		return serr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY || serr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+	}
+	return false
+}
+
+// Rebind replaces the ? placeholders in q with those of driver.
+func Rebind(driver string, q string) string {
+	return dialect(driver).rebind(q)
+}
+
+// sqlID scans a user or group id stored by any dialect.
+type sqlID uint64
+
+func (id *sqlID) Scan(src any) error {
+	switch v := src.(type) {
+	case int64:
+		*id = sqlID(v)
+	case uint64:
+		*id = sqlID(v)
+	case []byte:
+		return id.parse(string(v))
+	case string:
+		return id.parse(v)
+	default:
+		return fmt.Errorf("cannot scan %T into an id", src)
+	}
+	return nil
+}
+
+func (id *sqlID) parse(s string) error {
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		*id = sqlID(u)
+		return nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	*id = sqlID(i)
+	return err
+}
+
 type sqlStore struct {
-	db *sql.DB
+	db     *sql.DB
+	d      dialect
+	logger *slog.Logger
+	// bound is the context of the request the store serves, if any.
+	bound context.Context
+}
+
+func (s sqlStore) ctx() context.Context {
+	if s.bound == nil {
+		return context.Background()
+	}
+	return s.bound
+}
+
+// q rebinds query for the store's dialect.
+func (s sqlStore) q(query string) string {
+	return s.d.rebind(query)
 }
 
 func (s sqlStore) Healthz(ctx context.Context) error {
@@ -46,28 +231,119 @@ type sqlShortStore struct {
 	sqlStore
 }
 
+type sqlHitStore struct {
+	sqlStore
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Expiry is stored in unix nanoseconds, with 0 for links that never expire.
+// Editors are stored as a comma-separated list of user ids.
+func scanShort(row scanner) (data ShortData, err error) {
+	var expires int64
+	var editors string
+	if err = row.Scan(&data.Short, &data.Long, (*sqlID)(&data.Owner), &expires, &data.MaxHits, &data.Version, (*sqlID)(&data.Group), &editors, &data.Mode); err != nil {
+		return
+	}
+	if expires > 0 {
+		data.ExpiresAt = time.Unix(0, expires)
+	}
+	for _, e := range strings.Split(editors, ",") {
+		if e == "" {
+			continue
+		}
+		var uid uint64
+		if uid, err = strconv.ParseUint(e, 10, 64); err != nil {
+			return
+		}
+		data.Editors = append(data.Editors, uid)
+	}
+	return
+}
+
+func editorsArg(data ShortData) string {
+	editors := make([]string, len(data.Editors))
+	for i, uid := range data.Editors {
+		editors[i] = strconv.FormatUint(uid, 10)
+	}
+	return strings.Join(editors, ",")
+}
+
+func expiresArg(data ShortData) (expires int64) {
+	if !data.ExpiresAt.IsZero() {
+		expires = data.ExpiresAt.UnixNano()
+	}
+	return
+}
+
+func (s sqlStore) shortArgs(data ShortData) []any {
+	return []any{data.Short, data.Long, s.d.id(data.Owner), expiresArg(data), data.MaxHits, data.Version, s.d.id(data.Group), editorsArg(data), data.Mode}
+}
+
+// isMember checks group membership through q, so that it may be part of a
+// transaction.
+func (s sqlStore) isMember(ctx context.Context, q querier) memberFunc {
+	return func(group, uid uint64) (ok bool, err error) {
+		var n int
+		err = q.QueryRowContext(ctx, s.q(isMemberQ), s.d.id(group), s.d.id(uid)).Scan(&n)
+		ok = n > 0
+		return
+	}
+}
+
 func OpenSQLDB(config SQLConfig) (db *sql.DB, err error) {
-	if idx := slices.Index(knownDrivers, config.Driver); idx == -1 {
-		logger.Error("unkown db driver", "driver", config.Driver, "allowed", knownDrivers)
-		panic("unknown db driver")
+	if idx := slices.Index(knownDrivers, dialect(config.Driver)); idx == -1 {
+		err = fmt.Errorf("unknown db driver %q, expected one of %v", config.Driver, knownDrivers)
+		return
+	}
+	// Queries are traced as children of the span in their context.
+	db, err = otelsql.Open(config.Driver, config.ConnString,
+		otelsql.WithAttributes(attribute.String("db.system", config.Driver)),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}))
+	if err == nil && dialect(config.Driver) == sqliteDialect {
+		// sqlite allows one writer at a time; waiting here rather than failing
+		// with SQLITE_BUSY keeps transactions simple.
+		db.SetMaxOpenConns(1)
 	}
-	db, err = sql.Open(config.Driver, config.ConnString)
 	return
 }
 
-func NewSQLDB(config SQLConfig) Interface {
+// NewSQLDB opens the database in config, and registers its health check with
+// health until it is closed.
+func NewSQLDB(config SQLConfig, logger *slog.Logger, health *healthz.Registry) Interface {
 	db, err := OpenSQLDB(config)
 	util.OkOrDie(err)
-	s := sqlStore{db}
-	healthz.Register(s)
+	s := &sqlStore{db: db, d: dialect(config.Driver), logger: logger}
+	health.RegisterNamed("sql", s)
+	c := s.container()
+	c.close = func() error {
+		health.Unregister(s)
+		return db.Close()
+	}
+	return c
+}
+
+func (s sqlStore) container() container {
 	return container{
-		s: &sqlShortStore{s},
-		u: &sqlUserStore{s},
+		s:     &sqlShortStore{s},
+		u:     &sqlUserStore{s},
+		h:     &sqlHitStore{s},
+		close: s.db.Close,
+		withContext: func(ctx context.Context) Interface {
+			s.bound = ctx
+			return s.container()
+		},
 	}
 }
 
 func (s *sqlShortStore) Put(data ShortData) error {
-	ctx := context.Background()
+	ctx := s.ctx()
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -75,35 +351,102 @@ func (s *sqlShortStore) Put(data ShortData) error {
 	defer tx.Rollback()
 	var prev ShortData
 	ok := true
-	if err = tx.QueryRowContext(ctx, getShortQ, data.Short).Scan(&prev.Short, &prev.Long, &prev.Owner); err != nil {
+	if prev, err = scanShort(tx.QueryRowContext(ctx, s.q(getShortQ), data.Short)); err != nil {
 		if err == sql.ErrNoRows {
-			logger.Info("new row", "short", data.Short)
+			s.logger.Info("new row", "short", data.Short)
 			ok = false
 		} else {
 			return err
 		}
 	}
-	if ok && prev.Owner != data.Owner {
-		logger.Info("not owned", "short", data.Short, "owner", prev.Owner, "new owner", data.Owner)
-		return util.PermissionDeniedError
+	if ok {
+		if err = authorize(prev, data.Owner, false, s.isMember(ctx, tx)); err != nil {
+			s.logger.Info("not editable", "short", data.Short, "owner", prev.Owner, "user", data.Owner)
+			return err
+		}
+		data.Owner, data.Group, data.Editors = prev.Owner, prev.Group, prev.Editors
 	}
-	_, err = tx.ExecContext(ctx, insertShortQ, data.Short, data.Long, data.Owner)
+	data.Version = prev.Version + 1
+	_, err = tx.ExecContext(ctx, s.q(s.d.upsert("shorts", "short_url", shortCols)), s.shortArgs(data)...)
 	if err != nil {
-		logger.Warn("failed to replace", "short", data.Short, "err", err)
+		s.logger.Warn("failed to replace", "short", data.Short, "err", err)
 		return err
 	}
 	err = tx.Commit()
-	logger.Info("inserted", "short", data.Short, "err", err)
+	s.logger.Info("inserted", "short", data.Short, "err", err)
+	return err
+}
+
+func (s *sqlShortStore) Restore(data ShortData) error {
+	_, err := s.db.ExecContext(s.ctx(), s.q(s.d.upsert("shorts", "short_url", shortCols)), s.shortArgs(data)...)
+	return err
+}
+
+func (s *sqlShortStore) Create(data ShortData) error {
+	data.Version = 1
+	_, err := s.db.ExecContext(s.ctx(), s.q(createShortQ), s.shortArgs(data)...)
+	if s.d.duplicate(err) {
+		return util.AlreadyExistsError(data.Short)
+	}
+	s.logger.Info("created", "short", data.Short, "err", err)
+	return err
+}
+
+func (s *sqlShortStore) Update(data ShortData) error {
+	return s.versioned(data, data.Owner, false, updateShortQ, data.Long, data.Mode, expiresArg(data), data.MaxHits, data.Short, data.Version)
+}
+
+func (s *sqlShortStore) SetOwners(caller uint64, data ShortData) error {
+	return s.versioned(data, caller, true, setOwnersQ, s.d.id(data.Owner), s.d.id(data.Group), editorsArg(data), data.Short, data.Version)
+}
+
+// versioned runs q, an update conditioned on data.Version, if caller may make
+// it.
+func (s *sqlShortStore) versioned(data ShortData, caller uint64, ownersOnly bool, q string, args ...any) error {
+	ctx := s.ctx()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	prev, err := scanShort(tx.QueryRowContext(ctx, s.q(getShortQ), data.Short))
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err = checkVersioned(prev, err == nil, data, caller, ownersOnly, s.isMember(ctx, tx)); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, s.q(q), args...)
+	if err != nil {
+		s.logger.Warn("failed to update", "short", data.Short, "err", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		// Raced with another write; find out what it did.
+		tx.Rollback()
+		prev, err := s.Get(data.Short)
+		if _, ok := err.(util.NoSuchKeyError); !ok && err != nil {
+			return err
+		}
+		return versionedFailure(prev, err == nil, data, caller, ownersOnly, s.isMember(ctx, s.db))
+	}
+	err = tx.Commit()
+	s.logger.Info("updated", "short", data.Short, "err", err)
 	return err
 }
 
 func (s *sqlShortStore) Get(short string) (data ShortData, err error) {
-	err = s.db.QueryRow(getShortQ, short).Scan(&data.Short, &data.Long, &data.Owner)
+	data, err = scanShort(s.db.QueryRowContext(s.ctx(), s.q(getShortQ), short))
+	if err == sql.ErrNoRows {
+		err = util.NoSuchKeyError(short)
+	}
 	return
 }
 
 func (s *sqlShortStore) Delete(data ShortData) error {
-	ctx := context.Background()
+	ctx := s.ctx()
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
@@ -111,46 +454,357 @@ func (s *sqlShortStore) Delete(data ShortData) error {
 	defer tx.Rollback()
 	var prev ShortData
 	ok := true
-	if err = tx.QueryRowContext(ctx, getShortQ, data.Short).Scan(&prev.Short, &prev.Long, &prev.Owner); err != nil {
+	if prev, err = scanShort(tx.QueryRowContext(ctx, s.q(getShortQ), data.Short)); err != nil {
 		if err == sql.ErrNoRows {
-			logger.Info("new row", "short", data.Short)
+			s.logger.Info("new row", "short", data.Short)
 			ok = false
 		} else {
 			return err
 		}
 	}
-	if ok && prev.Owner != data.Owner {
-		logger.Info("not owned", "short", data.Short, "owner", prev.Owner, "new owner", data.Owner)
-		return util.PermissionDeniedError
+	if ok {
+		if err = authorize(prev, data.Owner, true, s.isMember(ctx, tx)); err != nil {
+			s.logger.Info("not owned", "short", data.Short, "owner", prev.Owner, "user", data.Owner)
+			return err
+		}
 	}
-	_, err = tx.ExecContext(ctx, deleteShortQ, data.Short)
-	if err != nil {
-		logger.Warn("failed to delete", "short", data.Short, "err", err)
-		return err
+	// Hits go with the short, so that a short created with its name starts
+	// without them.
+	for _, q := range []string{deleteCountQ, deleteClicksQ, deleteShortQ} {
+		if _, err = tx.ExecContext(ctx, s.q(q), data.Short); err != nil {
+			s.logger.Warn("failed to delete", "short", data.Short, "err", err)
+			return err
+		}
 	}
 	err = tx.Commit()
-	logger.Info("deleted", "short", data.Short, "err", err)
+	s.logger.Info("deleted", "short", data.Short, "err", err)
 	return err
 }
 
-func (s *sqlShortStore) List(start string, end string) (ListResults, error) {
-	panic("not implemented") // TODO: Implement
+func (s *sqlShortStore) List(start string, end string) (results ListResults, err error) {
+	return s.ListPage(start, end, "", 0)
+}
+
+func (s *sqlShortStore) ListPage(start, end, cursor string, limit int) (results ListResults, err error) {
+	// Fetch one extra row to know whether there is a next page.
+	n := int64(limit) + 1
+	if limit <= 0 {
+		n = math.MaxInt64
+	}
+	rows, err := s.db.QueryContext(s.ctx(), s.q(listShortQ), start, start, end, end, cursor, n)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data ShortData
+		if data, err = scanShort(rows); err != nil {
+			return
+		}
+		results.Matching = append(results.Matching, data)
+	}
+	if limit > 0 && len(results.Matching) > limit {
+		results.Matching = results.Matching[:limit]
+		results.Next = results.Matching[limit-1].Short
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *sqlShortStore) ListByOwner(owner uint64, cursor string, limit int) (results ListResults, err error) {
+	// Fetch one extra row to know whether there is a next page.
+	n := int64(limit) + 1
+	if limit <= 0 {
+		n = math.MaxInt64
+	}
+	rows, err := s.db.QueryContext(s.ctx(), s.q(ownerShortQ), s.d.id(owner), cursor, n)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data ShortData
+		if data, err = scanShort(rows); err != nil {
+			return
+		}
+		results.Matching = append(results.Matching, data)
+	}
+	if limit > 0 && len(results.Matching) > limit {
+		results.Matching = results.Matching[:limit]
+		results.Next = results.Matching[limit-1].Short
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *sqlShortStore) DeleteExpired(now time.Time) (n int, err error) {
+	ctx := s.ctx()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	for _, q := range []string{expireCountsQ, expireClicksQ} {
+		if _, err = tx.ExecContext(ctx, s.q(q), now.UnixNano()); err != nil {
+			return
+		}
+	}
+	res, err := tx.ExecContext(ctx, s.q(expireShortsQ), now.UnixNano())
+	if err != nil {
+		return
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	n = int(deleted)
+	err = tx.Commit()
+	return
 }
 
 func (s *sqlUserStore) LookupOrCreate(queryUser UserData) (user UserData) {
 	queryUser.Id = util.Hash(queryUser.Email)
 	user = queryUser
-	_, err := s.db.Exec(insertUserQ, user.Id, user.Email, user.Name)
+	_, err := s.db.ExecContext(s.ctx(), s.q(s.d.upsert("users", "user_id", userCols)), s.d.id(user.Id), user.Email, user.Name)
 	util.OkOrDie(err)
 	return
 }
 
 func (s *sqlUserStore) Get(id uint64) (user UserData, err error) {
-	err = s.db.QueryRow(getUserQ, id).Scan(&user.Id, &user.Email, &user.Name)
+	err = s.db.QueryRowContext(s.ctx(), s.q(getUserQ), s.d.id(id)).Scan((*sqlID)(&user.Id), &user.Email, &user.Name)
+	if err == sql.ErrNoRows {
+		err = util.NoSuchKeyError(fmt.Sprintf("%d", id))
+	}
 	return
 }
 
 func (s *sqlUserStore) Delete(id uint64) (err error) {
-	_, err = s.db.Exec(deleteUserQ, id)
+	_, err = s.db.ExecContext(s.ctx(), s.q(deleteUserQ), s.d.id(id))
+	return
+}
+
+func (s *sqlUserStore) CreateGroup(group GroupData) error {
+	ctx := s.ctx()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, s.q(createGroupQ), s.d.id(group.Id), group.Name)
+	if s.d.duplicate(err) {
+		return util.AlreadyExistsError(group.Name)
+	} else if err != nil {
+		return err
+	}
+	for _, uid := range group.Members {
+		if _, err = tx.ExecContext(ctx, s.q(s.d.insertIgnore("group_members", memberCols)), s.d.id(group.Id), s.d.id(uid)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlUserStore) GetGroup(id uint64) (group GroupData, err error) {
+	err = s.db.QueryRowContext(s.ctx(), s.q(getGroupQ), s.d.id(id)).Scan((*sqlID)(&group.Id), &group.Name)
+	if err == sql.ErrNoRows {
+		err = util.NoSuchKeyError(fmt.Sprintf("%d", id))
+		return
+	} else if err != nil {
+		return
+	}
+	rows, err := s.db.QueryContext(s.ctx(), s.q(groupMembersQ), s.d.id(id))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid uint64
+		if err = rows.Scan((*sqlID)(&uid)); err != nil {
+			return
+		}
+		group.Members = append(group.Members, uid)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *sqlUserStore) AddMember(group, uid uint64) (err error) {
+	if _, err = s.GetGroup(group); err != nil {
+		return
+	}
+	_, err = s.db.ExecContext(s.ctx(), s.q(s.d.insertIgnore("group_members", memberCols)), s.d.id(group), s.d.id(uid))
+	return
+}
+
+func (s *sqlUserStore) RemoveMember(group, uid uint64) (err error) {
+	if _, err = s.GetGroup(group); err != nil {
+		return
+	}
+	_, err = s.db.ExecContext(s.ctx(), s.q(removeMemberQ), s.d.id(group), s.d.id(uid))
+	return
+}
+
+func (s *sqlUserStore) List() (users []UserData, err error) {
+	rows, err := s.db.QueryContext(s.ctx(), s.q(listUsersQ))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user UserData
+		if err = rows.Scan((*sqlID)(&user.Id), &user.Email, &user.Name); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	err = rows.Err()
+	// Ids may be stored signed, so sort them unsigned here.
+	slices.SortFunc(users, func(a, b UserData) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return
+}
+
+func (s *sqlUserStore) ListGroups() (groups []GroupData, err error) {
+	groups, err = s.groups(s.q(listGroupsQ))
+	slices.SortFunc(groups, func(a, b GroupData) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return
+}
+
+func (s *sqlUserStore) GroupsOf(uid uint64) (groups []GroupData, err error) {
+	if groups, err = s.groups(s.q(groupsOfUserQ), s.d.id(uid)); err != nil {
+		return
+	}
+	slices.SortFunc(groups, func(a, b GroupData) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return
+}
+
+// groups reads the groups whose ids q, which is already rebound, selects.
+func (s *sqlUserStore) groups(q string, args ...any) (groups []GroupData, err error) {
+	rows, err := s.db.QueryContext(s.ctx(), q, args...)
+	if err != nil {
+		return
+	}
+	var ids []uint64
+	for rows.Next() {
+		var id uint64
+		if err = rows.Scan((*sqlID)(&id)); err != nil {
+			rows.Close()
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, id := range ids {
+		var group GroupData
+		if group, err = s.GetGroup(id); err != nil {
+			return
+		}
+		groups = append(groups, group)
+	}
+	return
+}
+
+func (s *sqlHitStore) Record(hits []Hit) error {
+	if len(hits) == 0 {
+		return nil
+	}
+	ctx := s.ctx()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	counts := make(map[string]int64)
+	values := make([]string, 0, len(hits))
+	args := make([]any, 0, 5*len(hits))
+	for _, h := range hits {
+		h = h.Truncate()
+		counts[h.Short]++
+		values = append(values, insertClickV)
+		args = append(args, h.Short, h.Timestamp.UnixNano(), h.Host, h.Referrer, h.UserAgent)
+	}
+	if _, err = tx.ExecContext(ctx, s.q(insertClicksQ+strings.Join(values, ", ")), args...); err != nil {
+		s.logger.Warn("failed to insert clicks", "count", len(hits), "err", err)
+		return err
+	}
+	for short, n := range counts {
+		if _, err = tx.ExecContext(ctx, s.q(s.d.increment("hit_counts", "short_url", "hits")), short, n); err != nil {
+			s.logger.Warn("failed to increment hits", "short", short, "err", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlHitStore) Count(short string) (count int64, err error) {
+	err = s.db.QueryRowContext(s.ctx(), s.q(countHitsQ), short).Scan(&count)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// sqlCountsBatchSize bounds the shorts counted per query, below every
+// dialect's limit on placeholders.
+const sqlCountsBatchSize = 500
+
+func (s *sqlHitStore) Counts(shorts []string) (counts map[string]int64, err error) {
+	counts = make(map[string]int64, len(shorts))
+	for i := 0; i < len(shorts); i += sqlCountsBatchSize {
+		batch := shorts[i:min(i+sqlCountsBatchSize, len(shorts))]
+		if err = s.counts(batch, counts); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// counts adds the counts of batch to counts.
+func (s *sqlHitStore) counts(batch []string, counts map[string]int64) error {
+	args := make([]any, len(batch))
+	for i, short := range batch {
+		args[i] = short
+	}
+	in := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ") + ")"
+	rows, err := s.db.QueryContext(s.ctx(), s.q(listCountsQ+in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var short string
+		var n int64
+		if err = rows.Scan(&short, &n); err != nil {
+			return err
+		}
+		counts[short] = n
+	}
+	return rows.Err()
+}
+
+func (s *sqlHitStore) Clicks(short string, since, until time.Time) (hits []Hit, err error) {
+	rows, err := s.db.QueryContext(s.ctx(), s.q(listClicksQ), short, since.UnixNano(), until.UnixNano())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h Hit
+		var ts int64
+		if err = rows.Scan(&h.Short, &ts, &h.Host, &h.Referrer, &h.UserAgent); err != nil {
+			return
+		}
+		h.Timestamp = time.Unix(0, ts)
+		hits = append(hits, h)
+	}
+	err = rows.Err()
 	return
 }
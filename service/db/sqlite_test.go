@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ml8/tinyr/service/healthz"
+)
+
+// newSQLite opens a file-backed sqlite database with every schema applied.
+func newSQLite(t *testing.T) Interface {
+	config := SQLConfig{Driver: "sqlite", ConnString: filepath.Join(t.TempDir(), "tinyr.db")}
+	db := New(Config{Type: SQL, SQL: config})
+	conn, err := OpenSQLDB(config)
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	defer conn.Close()
+	dir := "sqlschema/schemas/sqlite"
+	files, err := getSchemas(slog.Default(), dir, "schema", "sql")
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	for _, fn := range files {
+		b, err := os.ReadFile(path.Join(dir, fn))
+		if err != nil {
+			t.Fatalf("Got error %v", err)
+		}
+		for _, stmt := range strings.Split(string(b), ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err = conn.Exec(stmt); err != nil {
+				t.Fatalf("%v: got error %v", fn, err)
+			}
+		}
+	}
+	return db
+}
+
+func TestSQLiteList(t *testing.T) {
+	testList(t, newSQLite(t))
+}
+
+func TestSQLiteHits(t *testing.T) {
+	testHits(t, newSQLite(t))
+}
+
+func TestSQLiteListByOwner(t *testing.T) {
+	testListByOwner(t, newSQLite(t))
+}
+
+func TestSQLiteDeleteHits(t *testing.T) {
+	testDeleteHits(t, newSQLite(t))
+}
+
+func TestSQLiteListPage(t *testing.T) {
+	testListPage(t, newSQLite(t))
+}
+
+func TestSQLiteCreate(t *testing.T) {
+	testCreate(t, newSQLite(t))
+}
+
+func TestSQLiteDeleteExpired(t *testing.T) {
+	testDeleteExpired(t, newSQLite(t))
+}
+
+func TestSQLiteUpdate(t *testing.T) {
+	testUpdate(t, newSQLite(t))
+}
+
+func TestSQLiteGroups(t *testing.T) {
+	testGroups(t, newSQLite(t))
+}
+
+func TestSQLiteSharedOwnership(t *testing.T) {
+	testSharedOwnership(t, newSQLite(t))
+}
+
+func TestSQLiteUsers(t *testing.T) {
+	db := newSQLite(t)
+	// Hashed ids use the high bit, which sqlite stores signed.
+	user := db.Users().LookupOrCreate(UserData{Email: "ada@example.com", Name: "Ada"})
+	got, err := db.Users().Get(user.Id)
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if got != user {
+		t.Errorf("Incorrect user %v, expected %v", got, user)
+	}
+	if users, err := db.Users().List(); err != nil || len(users) != 1 || users[0] != user {
+		t.Errorf("Incorrect users %v, %v", users, err)
+	}
+}
+
+func TestSQLiteNotFound(t *testing.T) {
+	testNotFound(t, newSQLite(t))
+}
+
+func TestSQLiteWithContext(t *testing.T) {
+	d := newSQLite(t)
+	if err := d.Shorts().Create(ShortData{Short: "a", Long: "b"}); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	bound := WithContext(ctx, d)
+	if _, err := bound.Shorts().Get("a"); err != nil {
+		t.Errorf("Got error %v", err)
+	}
+	cancel()
+	if _, err := bound.Shorts().Get("a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a canceled query, got %v", err)
+	}
+	// The unbound stores are unaffected.
+	if _, err := d.Shorts().Get("a"); err != nil {
+		t.Errorf("Got error %v", err)
+	}
+}
+
+func TestDialect(t *testing.T) {
+	for _, tc := range []struct {
+		d        dialect
+		got, exp string
+	}{
+		{mysqlDialect, mysqlDialect.rebind(getShortQ), getShortQ},
+		{postgresDialect, postgresDialect.rebind("a=? AND b=?"), "a=$1 AND b=$2"},
+		{mysqlDialect, mysqlDialect.upsert("users", "user_id", userCols), "REPLACE INTO users (user_id, email, name) VALUES (?, ?, ?)"},
+		{sqliteDialect, sqliteDialect.upsert("users", "user_id", userCols), "INSERT INTO users (user_id, email, name) VALUES (?, ?, ?) ON CONFLICT (user_id) DO UPDATE SET email=excluded.email, name=excluded.name"},
+		{mysqlDialect, mysqlDialect.insertIgnore("group_members", memberCols), "INSERT IGNORE INTO group_members (group_id, user_id) VALUES (?, ?)"},
+		{postgresDialect, postgresDialect.insertIgnore("group_members", memberCols), "INSERT INTO group_members (group_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING"},
+		{mysqlDialect, mysqlDialect.increment("hit_counts", "short_url", "hits"), "INSERT INTO hit_counts (short_url, hits) VALUES (?, ?) ON DUPLICATE KEY UPDATE hits=hits+VALUES(hits)"},
+		{postgresDialect, postgresDialect.increment("hit_counts", "short_url", "hits"), "INSERT INTO hit_counts (short_url, hits) VALUES (?, ?) ON CONFLICT (short_url) DO UPDATE SET hits=hit_counts.hits+excluded.hits"},
+	} {
+		if tc.got != tc.exp {
+			t.Errorf("%v: got %q, expected %q", tc.d, tc.got, tc.exp)
+		}
+	}
+}
+
+func TestSQLiteCountsBatches(t *testing.T) {
+	db := newSQLite(t)
+	var hits []Hit
+	var shorts []string
+	for i := 0; i < 2*sqlCountsBatchSize+1; i++ {
+		short := fmt.Sprint(i)
+		hits = append(hits, Hit{Short: short, Timestamp: time.Now()})
+		shorts = append(shorts, short)
+	}
+	if err := db.Hits().Record(hits); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	counts, err := db.Hits().Counts(shorts)
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if len(counts) != len(shorts) {
+		t.Errorf("Incorrect counts for %v of %v shorts", len(counts), len(shorts))
+	}
+}
+
+func TestSQLiteHealth(t *testing.T) {
+	reg := healthz.NewRegistry()
+	config := SQLConfig{Driver: "sqlite", ConnString: filepath.Join(t.TempDir(), "tinyr.db")}
+	db := New(Config{Type: SQL, SQL: config, Health: reg})
+	report := reg.Readiness(context.Background())
+	if len(report.Components) != 1 || report.Components[0].Name != "sql" || !report.Healthy {
+		t.Errorf("Incorrect report %+v", report)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if report = reg.Readiness(context.Background()); len(report.Components) != 0 {
+		t.Errorf("Closed store still registered: %+v", report)
+	}
+}
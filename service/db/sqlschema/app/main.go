@@ -2,8 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/peterbourgon/ff"
 
@@ -21,24 +23,36 @@ var (
 	schemaDir = fs.String("schema_dir", "./", "location of cql schemas")
 	dryRun    = fs.Bool("dry_run", false, "if true, output operations without affecting database")
 	basename  = fs.String("basename", "schema", "base filename, without cql extension")
+	target    = fs.Int("target", -1, "version to migrate up or down to; up defaults to the latest")
 
 	// sql flags
-	driver  = fs.String("driver", "mysql", "Database driver")
+	driver  = fs.String("driver", "mysql", "Database driver: mysql, postgres or sqlite")
 	connStr = fs.String("connStr", "", "Connection string")
 )
 
 func main() {
-	ff.Parse(fs, os.Args[1:],
+	// up (the default), down or status, which comes before the flags: flags
+	// after it would not be parsed.
+	args, command := os.Args[1:], ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	ff.Parse(fs, args,
 		ff.WithEnvVarPrefix("TINYR"),
 		ff.WithConfigFileFlag("config"),
 		ff.WithConfigFileParser(ff.PlainParser))
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments %v; usage: %v [up|down|status] [flags]\n", fs.Args(), fs.Name())
+		fs.Usage()
+		os.Exit(2)
+	}
 
 	logger = slog.New(
 		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 			AddSource: true,
 			Level:     slog.LevelInfo,
 		}))
-	logger.Info("flags", "schema_dir", *schemaDir, "basename", *basename, "dry_run", *dryRun, "connStr", *connStr)
+	logger.Info("flags", "command", command, "target", *target, "schema_dir", *schemaDir, "basename", *basename, "dry_run", *dryRun, "connStr", *connStr)
 
 	util.OkOrDie(db.RunMigration(
 		db.MigrationArgs{
@@ -46,6 +60,8 @@ func main() {
 			SchemaDir: *schemaDir,
 			Basename:  *basename,
 			DryRun:    *dryRun,
+			Command:   command,
+			Target:    *target,
 			Extension: "sql",
 			Migrator: &migrate.SQLMigrator{
 				Config: db.SQLConfig{
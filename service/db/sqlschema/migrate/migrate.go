@@ -2,12 +2,59 @@ package migrate
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
 
 	"github.com/ml8/tinyr/service/db"
 )
 
+// MySQL has no IF NOT EXISTS for indexes and columns, and sqlite none for
+// columns, so rerunning a schema that adds them fails with one of these errors.
+// They are safe to ignore. Postgres schemas use IF NOT EXISTS throughout.
+var (
+	alreadyApplied = []uint16{
+		1060, // ER_DUP_FIELDNAME
+		1061, // ER_DUP_KEYNAME
+	}
+	alreadyAppliedPostgres = []pq.ErrorCode{
+		"42701", // duplicate_column
+		"42P07", // duplicate_table
+	}
+	alreadyAppliedSQLite = "duplicate column name"
+)
+
+// Applied migrations are recorded in a table that is created with the first
+// record, as mysql's database only exists once the base schema is applied.
+const (
+	createMigrationsQ = "CREATE TABLE IF NOT EXISTS %s (version INT NOT NULL, filename VARCHAR(512) NOT NULL, checksum CHAR(64) NOT NULL, applied_at BIGINT NOT NULL, PRIMARY KEY (version))"
+	listMigrationsQ   = "SELECT version, filename, checksum, applied_at FROM %s ORDER BY version"
+	insertMigrationQ  = "INSERT INTO %s (version, filename, checksum, applied_at) VALUES (?, ?, ?, ?)"
+	deleteMigrationQ  = "DELETE FROM %s WHERE version=?"
+)
+
+// migrationTables finds the table of applied migrations, by driver.
+var migrationTables = map[string]struct{ table, exists string }{
+	"mysql": {
+		"tinyr.schema_migrations",
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema='tinyr' AND table_name='schema_migrations'",
+	},
+	"postgres": {
+		"schema_migrations",
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=current_schema() AND table_name='schema_migrations'",
+	},
+	"sqlite": {
+		"schema_migrations",
+		"SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='schema_migrations'",
+	},
+}
+
 type SQLMigrator struct {
 	Config db.SQLConfig
 	Logger *slog.Logger
@@ -20,6 +67,46 @@ func (c *SQLMigrator) InitDB() (err error) {
 	return
 }
 
+func (c *SQLMigrator) q(query string) string {
+	return db.Rebind(c.Config.Driver, fmt.Sprintf(query, migrationTables[c.Config.Driver].table))
+}
+
+func (c *SQLMigrator) Applied() (applied []db.Migration, err error) {
+	var n int
+	if err = c.db.QueryRow(migrationTables[c.Config.Driver].exists).Scan(&n); err != nil || n == 0 {
+		return
+	}
+	rows, err := c.db.Query(c.q(listMigrationsQ))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m db.Migration
+		var ts int64
+		if err = rows.Scan(&m.Version, &m.Filename, &m.Checksum, &ts); err != nil {
+			return
+		}
+		m.AppliedAt = time.Unix(0, ts)
+		applied = append(applied, m)
+	}
+	err = rows.Err()
+	return
+}
+
+func (c *SQLMigrator) Record(m db.Migration) (err error) {
+	if _, err = c.db.Exec(c.q(createMigrationsQ)); err != nil {
+		return
+	}
+	_, err = c.db.Exec(c.q(insertMigrationQ), m.Version, m.Filename, m.Checksum, m.AppliedAt.UnixNano())
+	return
+}
+
+func (c *SQLMigrator) Forget(version int) (err error) {
+	_, err = c.db.Exec(c.q(deleteMigrationQ), version)
+	return
+}
+
 func (c *SQLMigrator) Complete() {
 	c.db.Close()
 	c.Logger.Info("closed database")
@@ -36,6 +123,10 @@ func (c *SQLMigrator) ApplySchema(s db.Schema, dry_run bool) (err error) {
 			c.Logger.Info("query", "idx", i, "query", next)
 		} else {
 			_, err = c.db.Exec(next)
+			if isAlreadyApplied(err) {
+				c.Logger.Info("already applied", "idx", i, "query", next)
+				err = nil
+			}
 		}
 		if err != nil {
 			break
@@ -43,3 +134,17 @@ func (c *SQLMigrator) ApplySchema(s db.Schema, dry_run bool) (err error) {
 	}
 	return
 }
+
+func isAlreadyApplied(err error) bool {
+	var merr *mysql.MySQLError
+	var perr *pq.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &merr):
+		return slices.Contains(alreadyApplied, merr.Number)
+	case errors.As(err, &perr):
+		return slices.Contains(alreadyAppliedPostgres, perr.Code)
+	}
+	return strings.Contains(err.Error(), alreadyAppliedSQLite)
+}
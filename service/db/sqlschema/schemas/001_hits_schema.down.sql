@@ -0,0 +1,4 @@
+USE tinyr;
+
+DROP TABLE IF EXISTS clicks;
+DROP TABLE IF EXISTS hit_counts;
@@ -0,0 +1,20 @@
+USE tinyr;
+
+-- Per-short hit totals
+CREATE TABLE IF NOT EXISTS hit_counts (
+  short_url VARCHAR(512) NOT NULL,
+  hits BIGINT UNSIGNED NOT NULL,
+  PRIMARY KEY (short_url)
+);
+
+-- Click log; ts is in unix nanoseconds.
+CREATE TABLE IF NOT EXISTS clicks (
+  click_id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+  short_url VARCHAR(512) NOT NULL,
+  ts BIGINT NOT NULL,
+  host VARCHAR(256) NOT NULL,
+  referrer VARCHAR(2048) NOT NULL,
+  user_agent VARCHAR(1024) NOT NULL,
+  PRIMARY KEY (click_id),
+  INDEX clicks_by_short (short_url, ts)
+);
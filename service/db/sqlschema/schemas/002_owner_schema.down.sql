@@ -0,0 +1,3 @@
+USE tinyr;
+
+DROP INDEX shorts_by_owner ON shorts;
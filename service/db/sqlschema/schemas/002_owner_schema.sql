@@ -0,0 +1,4 @@
+USE tinyr;
+
+-- Index for listing shorts by owner
+CREATE INDEX shorts_by_owner ON shorts (owner_id, short_url);
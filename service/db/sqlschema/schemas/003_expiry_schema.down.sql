@@ -0,0 +1,5 @@
+USE tinyr;
+
+DROP INDEX shorts_by_expiry ON shorts;
+ALTER TABLE shorts DROP COLUMN max_hits;
+ALTER TABLE shorts DROP COLUMN expires_at;
@@ -0,0 +1,8 @@
+USE tinyr;
+
+-- Expiry, in unix nanoseconds (0 never expires), and hit limit (0 is unlimited)
+ALTER TABLE shorts ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE shorts ADD COLUMN max_hits BIGINT NOT NULL DEFAULT 0;
+
+-- Index for reaping expired shorts
+CREATE INDEX shorts_by_expiry ON shorts (expires_at);
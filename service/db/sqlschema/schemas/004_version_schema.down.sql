@@ -0,0 +1,3 @@
+USE tinyr;
+
+ALTER TABLE shorts DROP COLUMN version;
@@ -0,0 +1,4 @@
+USE tinyr;
+
+-- Version, incremented on every write
+ALTER TABLE shorts ADD COLUMN version INT NOT NULL DEFAULT 0;
@@ -0,0 +1,6 @@
+USE tinyr;
+
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS user_groups;
+ALTER TABLE shorts DROP COLUMN editors;
+ALTER TABLE shorts DROP COLUMN group_id;
@@ -0,0 +1,20 @@
+USE tinyr;
+
+-- Shared ownership: an owning group (0 for none) and comma-separated editor ids
+ALTER TABLE shorts ADD COLUMN group_id BIGINT UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE shorts ADD COLUMN editors VARCHAR(2048) NOT NULL DEFAULT '';
+
+-- Groups table
+CREATE TABLE IF NOT EXISTS user_groups (
+  group_id BIGINT UNSIGNED NOT NULL,
+  name VARCHAR(1024) NOT NULL,
+  PRIMARY KEY (group_id)
+);
+
+-- Group membership
+CREATE TABLE IF NOT EXISTS group_members (
+  group_id BIGINT UNSIGNED NOT NULL,
+  user_id BIGINT UNSIGNED NOT NULL,
+  PRIMARY KEY (group_id, user_id),
+  INDEX members_by_user (user_id, group_id)
+);
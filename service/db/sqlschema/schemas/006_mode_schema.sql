@@ -0,0 +1,4 @@
+USE tinyr;
+
+-- Redirect mode: 0 appends the rest of the path, 1 fills a template
+ALTER TABLE shorts ADD COLUMN mode TINYINT NOT NULL DEFAULT 0;
@@ -0,0 +1,18 @@
+-- Shared ownership: an owning group (0 for none) and comma-separated editor ids
+ALTER TABLE shorts ADD COLUMN IF NOT EXISTS group_id BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE shorts ADD COLUMN IF NOT EXISTS editors VARCHAR(2048) NOT NULL DEFAULT '';
+
+-- Groups table
+CREATE TABLE IF NOT EXISTS user_groups (
+  group_id BIGINT NOT NULL,
+  name VARCHAR(1024) NOT NULL,
+  PRIMARY KEY (group_id)
+);
+
+-- Group membership
+CREATE TABLE IF NOT EXISTS group_members (
+  group_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  PRIMARY KEY (group_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS members_by_user ON group_members (user_id, group_id);
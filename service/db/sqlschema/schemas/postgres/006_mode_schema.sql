@@ -0,0 +1,2 @@
+-- Redirect mode: 0 appends the rest of the path, 1 fills a template
+ALTER TABLE shorts ADD COLUMN IF NOT EXISTS mode SMALLINT NOT NULL DEFAULT 0;
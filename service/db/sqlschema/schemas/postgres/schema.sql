@@ -0,0 +1,18 @@
+-- Ids are unsigned 64-bit hashes, stored as the BIGINT with the same bits.
+-- Shorts sort bytewise, so that namespaces list as ranges.
+
+-- Short table
+CREATE TABLE IF NOT EXISTS shorts (
+  short_url VARCHAR(512) COLLATE "C" NOT NULL,
+  long_url VARCHAR(2048) NOT NULL,
+  owner_id BIGINT NOT NULL,
+  PRIMARY KEY (short_url)
+);
+
+-- Users table
+CREATE TABLE IF NOT EXISTS users (
+  user_id BIGINT NOT NULL,
+  email VARCHAR(1024) NOT NULL,
+  name VARCHAR(1024),
+  PRIMARY KEY (user_id)
+);
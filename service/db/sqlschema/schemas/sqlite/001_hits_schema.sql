@@ -0,0 +1,17 @@
+-- Per-short hit totals
+CREATE TABLE IF NOT EXISTS hit_counts (
+  short_url VARCHAR(512) NOT NULL,
+  hits BIGINT NOT NULL,
+  PRIMARY KEY (short_url)
+);
+
+-- Click log, with ts in unix nanoseconds
+CREATE TABLE IF NOT EXISTS clicks (
+  click_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  short_url VARCHAR(512) NOT NULL,
+  ts BIGINT NOT NULL,
+  host VARCHAR(256) NOT NULL,
+  referrer VARCHAR(2048) NOT NULL,
+  user_agent VARCHAR(1024) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS clicks_by_short ON clicks (short_url, ts);
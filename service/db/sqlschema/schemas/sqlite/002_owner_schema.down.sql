@@ -0,0 +1 @@
+DROP INDEX IF EXISTS shorts_by_owner;
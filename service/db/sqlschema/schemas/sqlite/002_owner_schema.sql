@@ -0,0 +1,2 @@
+-- Index for listing shorts by owner
+CREATE INDEX IF NOT EXISTS shorts_by_owner ON shorts (owner_id, short_url);
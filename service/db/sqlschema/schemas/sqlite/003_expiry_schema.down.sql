@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS shorts_by_expiry;
+ALTER TABLE shorts DROP COLUMN max_hits;
+ALTER TABLE shorts DROP COLUMN expires_at;
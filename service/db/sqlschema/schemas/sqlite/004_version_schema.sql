@@ -0,0 +1,2 @@
+-- Version, incremented on every write
+ALTER TABLE shorts ADD COLUMN version INT NOT NULL DEFAULT 0;
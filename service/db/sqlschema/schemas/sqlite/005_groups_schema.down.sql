@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS user_groups;
+ALTER TABLE shorts DROP COLUMN editors;
+ALTER TABLE shorts DROP COLUMN group_id;
@@ -0,0 +1 @@
+ALTER TABLE shorts DROP COLUMN mode;
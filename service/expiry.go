@@ -0,0 +1,40 @@
+package service
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/ml8/tinyr/service/db"
+)
+
+// startReaper periodically deletes expired shorts from store, until stop is
+// called. Stop waits for a reap in progress.
+func startReaper(store db.ShortStore, interval time.Duration, logger *slog.Logger) (stop func()) {
+	if interval <= 0 {
+		logger.Info("reaping disabled")
+		return func() {}
+	}
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			n, err := store.DeleteExpired(time.Now())
+			if err != nil {
+				logger.Warn("Error reaping expired shorts", "error", err)
+				continue
+			}
+			logger.Info("reaped expired shorts", "count", n)
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
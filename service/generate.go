@@ -0,0 +1,54 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/ml8/tinyr/service/util"
+)
+
+const (
+	// Lowercase letters and digits, minus the easily confused l, 0, 1.
+	DefaultShortAlphabet = "abcdefghijkmnopqrstuvwxyz23456789"
+	DefaultShortLength   = 6
+
+	maxGenerateAttempts = 10
+)
+
+var ExhaustedError = errors.New("Could not generate an unused short url")
+
+type generator struct {
+	alphabet []rune
+	length   int
+}
+
+func newGenerator(alphabet string, length int) (g generator, err error) {
+	if alphabet == "" {
+		alphabet = DefaultShortAlphabet
+	}
+	if length <= 0 {
+		length = DefaultShortLength
+	}
+	if !IsLetter(alphabet) {
+		err = util.InvalidValueError(alphabet)
+		return
+	}
+	g = generator{alphabet: []rune(alphabet), length: length}
+	return
+}
+
+func (g generator) next() (short string, err error) {
+	var b strings.Builder
+	n := big.NewInt(int64(len(g.alphabet)))
+	for i := 0; i < g.length; i++ {
+		var idx *big.Int
+		if idx, err = rand.Int(rand.Reader, n); err != nil {
+			return
+		}
+		b.WriteRune(g.alphabet[idx.Int64()])
+	}
+	short = b.String()
+	return
+}
@@ -2,17 +2,42 @@ package healthz
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var (
-	mu     sync.Mutex
-	checks []Component
-	dl     time.Duration
-)
+// Components are checked concurrently, each for at most the deadline. Checks
+// registered for liveness answer /livez, and all checks answer /readyz, which
+// also fails while draining. Once Start is called, the handlers serve the
+// results of the last background check rather than checking on every probe.
+//
+// The package functions use Default; processes that hold several sets of
+// components, such as tests, can keep them in separate Registries.
+
+// Registry holds components to check.
+type Registry struct {
+	mu       sync.Mutex
+	checks   []*check
+	dl       time.Duration
+	draining atomic.Bool
+	cached   atomic.Pointer[[]Result]
+}
+
+// Default is the Registry of the package functions.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// ErrDraining is returned by checks once Drain has been called.
+var ErrDraining = errors.New("draining")
 
 type DeadlineExceeded time.Duration
 
@@ -22,15 +47,72 @@ func (d DeadlineExceeded) Error() string {
 
 // Set timeout for health checks.
 func SetDeadline(deadline time.Duration) {
-	dl = deadline
+	Default.SetDeadline(deadline)
 }
 
-// Register a component for health checking. Components will be checked in the
-// order registered.
+func (r *Registry) SetDeadline(deadline time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dl = deadline
+}
+
+// Register components for readiness checking, named by their type.
 func Register(components ...Component) {
-	mu.Lock()
-	defer mu.Unlock()
-	checks = append(checks, components...)
+	Default.Register(components...)
+}
+
+func (r *Registry) Register(components ...Component) {
+	for _, c := range components {
+		r.register(fmt.Sprintf("%T", c), c, false)
+	}
+}
+
+// RegisterNamed registers a component for readiness checking.
+func RegisterNamed(name string, c Component) {
+	Default.RegisterNamed(name, c)
+}
+
+func (r *Registry) RegisterNamed(name string, c Component) {
+	r.register(name, c, false)
+}
+
+// RegisterLiveness registers a component for liveness checking: the process
+// should be restarted if it fails. Liveness checks are also readiness checks.
+func RegisterLiveness(name string, c Component) {
+	Default.RegisterLiveness(name, c)
+}
+
+func (r *Registry) RegisterLiveness(name string, c Component) {
+	r.register(name, c, true)
+}
+
+func (r *Registry) register(name string, c Component, live bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, &check{name: name, component: c, live: live})
+}
+
+// Unregister stops checking c, under every name it was registered with.
+func Unregister(c Component) {
+	Default.Unregister(c)
+}
+
+func (r *Registry) Unregister(c Component) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = slices.DeleteFunc(r.checks, func(ch *check) bool {
+		return ch.component == c
+	})
+}
+
+// Drain marks the process as shutting down: readiness checks fail from now on,
+// so that load balancers stop sending it requests while in-flight ones finish.
+func Drain() {
+	Default.Drain()
+}
+
+func (r *Registry) Drain() {
+	r.draining.Store(true)
 }
 
 // Component to be checked.
@@ -40,51 +122,272 @@ type Component interface {
 	Healthz(ctx context.Context) error
 }
 
-func Handler() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		err := Healthz()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+type check struct {
+	name      string
+	component Component
+	live      bool
+	// The last failure, reported until the next one.
+	lastError   string
+	lastFailure time.Time
+}
+
+// Result is the outcome of checking one component.
+type Result struct {
+	Name        string     `json:"Name"`
+	Healthy     bool       `json:"Healthy"`
+	Latency     string     `json:"Latency"`
+	LastError   string     `json:"LastError,omitempty"`
+	LastFailure *time.Time `json:"LastFailure,omitempty"`
+
+	live bool
+	err  error
+}
+
+// Report is the outcome of checking a set of components.
+type Report struct {
+	Healthy    bool     `json:"Healthy"`
+	Components []Result `json:"Components"`
+}
+
+// Err returns the error of the first failed component, in the order
+// registered.
+func (r Report) Err() error {
+	for _, c := range r.Components {
+		if c.err != nil {
+			return c.err
 		}
-		w.Write([]byte("ok"))
 	}
+	return nil
+}
+
+// Liveness checks the liveness components.
+func Liveness(ctx context.Context) Report {
+	return Default.Liveness(ctx)
+}
+
+func (r *Registry) Liveness(ctx context.Context) Report {
+	return liveness(r.checkAll(ctx))
+}
+
+// Readiness checks all components.
+func Readiness(ctx context.Context) Report {
+	return Default.Readiness(ctx)
+}
+
+func (r *Registry) Readiness(ctx context.Context) Report {
+	return r.readiness(r.checkAll(ctx))
 }
 
 // Check all components.
-func Healthz() (err error) {
-	mu.Lock()
-	defer mu.Unlock()
-	ctx := context.Background()
-	if dl > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(context.Background(), dl)
-		defer cancel()
-	}
-	if err = checkAllLocked(ctx); err != nil {
-		return
-	}
-	return
+func Healthz() error {
+	return Default.Healthz(context.Background())
+}
+
+// Healthz checks all components, so that a Registry is itself a Component.
+func (r *Registry) Healthz(ctx context.Context) error {
+	return r.Readiness(ctx).Err()
 }
 
 // Check all components.
 func CheckAll(ctx context.Context) error {
-	mu.Lock()
-	defer mu.Unlock()
-	return checkAllLocked(ctx)
+	return Default.Readiness(ctx).Err()
 }
 
-func checkAllLocked(ctx context.Context) (err error) {
-	for _, c := range checks {
-		err = c.Healthz(ctx)
+func liveness(results []Result) (r Report) {
+	r.Healthy = true
+	for _, c := range results {
+		if c.live {
+			r.Components = append(r.Components, c)
+			r.Healthy = r.Healthy && c.Healthy
+		}
+	}
+	return
+}
+
+func (reg *Registry) readiness(results []Result) (r Report) {
+	if reg.draining.Load() {
+		r.Components = append(r.Components, Result{
+			Name:      "shutdown",
+			Latency:   "0s",
+			LastError: ErrDraining.Error(),
+			err:       ErrDraining,
+		})
+	}
+	r.Components = append(r.Components, results...)
+	r.Healthy = true
+	for _, c := range r.Components {
+		r.Healthy = r.Healthy && c.Healthy
+	}
+	return
+}
+
+// checkAll checks every component concurrently, and returns their results in
+// the order registered. Components that outlive the deadline fail with
+// DeadlineExceeded; they are not waited for.
+func (r *Registry) checkAll(ctx context.Context) []Result {
+	r.mu.Lock()
+	cs := append([]*check(nil), r.checks...)
+	deadline := r.dl
+	r.mu.Unlock()
+
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+
+	type outcome struct {
+		i       int
+		err     error
+		latency time.Duration
+	}
+	outcomes := make(chan outcome, len(cs))
+	for i, c := range cs {
+		go func() {
+			start := time.Now()
+			err := c.component.Healthz(ctx)
+			outcomes <- outcome{i, err, time.Since(start)}
+		}()
+	}
+
+	start := time.Now()
+	results := make([]Result, len(cs))
+	done := make([]bool, len(cs))
+	for pending := len(cs); pending > 0; {
 		select {
+		case o := <-outcomes:
+			results[o.i].err, results[o.i].Latency = o.err, o.latency.String()
+			done[o.i] = true
+			pending--
 		case <-ctx.Done():
-			err = DeadlineExceeded(dl)
-		default:
+			err := ctx.Err()
+			if deadline > 0 {
+				err = DeadlineExceeded(deadline)
+			}
+			for i := range done {
+				if !done[i] {
+					results[i].err, results[i].Latency = err, time.Since(start).String()
+				}
+			}
+			pending = 0
+		}
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, c := range cs {
+		res := &results[i]
+		res.Name, res.live, res.Healthy = c.name, c.live, res.err == nil
+		if res.err != nil {
+			c.lastError, c.lastFailure = res.err.Error(), now
 		}
-		if err != nil {
-			break
+		if c.lastError != "" {
+			failed := c.lastFailure
+			res.LastError, res.LastFailure = c.lastError, &failed
 		}
 	}
-	return
+	return results
+}
+
+// Start checks all components every interval in the background, and has the
+// handlers serve the latest results. Stop ends the checks; the handlers then
+// check on demand again.
+func Start(interval time.Duration) (stop func()) {
+	return Default.Start(interval)
+}
+
+func (r *Registry) Start(interval time.Duration) (stop func()) {
+	quit, done := make(chan struct{}), make(chan struct{})
+	refresh := func() {
+		results := r.checkAll(context.Background())
+		r.cached.Store(&results)
+	}
+	refresh()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				refresh()
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+		r.cached.Store(nil)
+	}
+}
+
+// results returns the cached results, or checks the components if there are
+// none.
+func (r *Registry) results(ctx context.Context) []Result {
+	if res := r.cached.Load(); res != nil {
+		return *res
+	}
+	return r.checkAll(ctx)
+}
+
+// LivezHandler serves the liveness report, formatted as by handle.
+func LivezHandler() http.HandlerFunc {
+	return Default.LivezHandler()
+}
+
+func (reg *Registry) LivezHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handle(w, r, liveness(reg.results(r.Context())))
+	}
+}
+
+// ReadyzHandler serves the readiness report, formatted as by handle.
+func ReadyzHandler() http.HandlerFunc {
+	return Default.ReadyzHandler()
+}
+
+func (reg *Registry) ReadyzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handle(w, r, reg.readiness(reg.results(r.Context())))
+	}
+}
+
+// Handler serves the readiness report.
+func Handler() http.HandlerFunc {
+	return Default.ReadyzHandler()
+}
+
+// handle writes report as "ok" or "failed", after a line per component if the
+// request has a verbose parameter, or as JSON if it asks for it with
+// format=json or its Accept header. Failed reports are a 503.
+func handle(w http.ResponseWriter, r *http.Request, report Report) {
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	if r.URL.Query().Get("format") == "json" || r.Header.Get("Accept") == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if r.URL.Query().Has("verbose") {
+		for _, c := range report.Components {
+			if c.Healthy {
+				fmt.Fprintf(w, "[+]%v ok (%v)\n", c.Name, c.Latency)
+			} else {
+				fmt.Fprintf(w, "[-]%v failed (%v): %v\n", c.Name, c.Latency, c.LastError)
+			}
+		}
+	}
+	if report.Healthy {
+		fmt.Fprintln(w, "ok")
+	} else {
+		fmt.Fprintln(w, "failed")
+	}
 }
@@ -2,7 +2,11 @@ package healthz
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -31,6 +35,12 @@ func mock(fail bool) *mockcheck {
 	return &mockcheck{fail: fail, called: 0}
 }
 
+func reset() {
+	Default.mu.Lock()
+	defer Default.mu.Unlock()
+	Default.checks = nil
+}
+
 func TestTimeout(t *testing.T) {
 	SetDeadline(500 * time.Millisecond)
 	Register(delay(1))
@@ -79,7 +89,8 @@ func TestFail(t *testing.T) {
 	checks = append(checks, mock(true))
 	checks = append(checks, mock(false))
 
-	expected := []int{1, 1, 0}
+	// Checks are concurrent, so a failure does not stop the others.
+	expected := []int{1, 1, 1}
 
 	SetDeadline(0)
 	Register(checks...)
@@ -96,3 +107,143 @@ func TestFail(t *testing.T) {
 		}
 	}
 }
+
+func TestDrain(t *testing.T) {
+	SetDeadline(0)
+	Drain()
+	defer Default.draining.Store(false)
+
+	if err := Healthz(); !errors.Is(err, ErrDraining) {
+		t.Errorf("Should be draining, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	Handler()(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Incorrect status while draining: %v", w.Code)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	reset()
+	SetDeadline(0)
+	Register(delay(1), delay(1), delay(1))
+
+	start := time.Now()
+	if err := Healthz(); err != nil {
+		t.Errorf("Should not have failed: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Checks should run concurrently, took %v", d)
+	}
+}
+
+func TestReports(t *testing.T) {
+	reset()
+	SetDeadline(0)
+	live, ready := mock(false), mock(true)
+	RegisterLiveness("live", live)
+	RegisterNamed("ready", ready)
+
+	if r := Liveness(context.Background()); !r.Healthy || len(r.Components) != 1 {
+		t.Errorf("Incorrect liveness report %+v", r)
+	}
+	r := Readiness(context.Background())
+	if r.Healthy || len(r.Components) != 2 {
+		t.Fatalf("Incorrect readiness report %+v", r)
+	}
+	if c := r.Components[1]; c.Name != "ready" || c.Healthy || c.LastError != "uh-oh" {
+		t.Errorf("Incorrect result %+v", c)
+	}
+
+	// The last error is kept once the component recovers.
+	ready.fail = false
+	r = Readiness(context.Background())
+	if c := r.Components[1]; !r.Healthy || !c.Healthy || c.LastError != "uh-oh" || c.LastFailure == nil {
+		t.Errorf("Incorrect result after recovery %+v", c)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	reset()
+	SetDeadline(0)
+	RegisterLiveness("live", mock(false))
+	RegisterNamed("ready", mock(true))
+
+	w := httptest.NewRecorder()
+	LivezHandler()(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("Incorrect livez response %v %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ReadyzHandler()(w, httptest.NewRequest(http.MethodGet, "/readyz?verbose", nil))
+	expected := "[+]live ok"
+	if w.Code != http.StatusServiceUnavailable || !strings.HasPrefix(w.Body.String(), expected) ||
+		!strings.Contains(w.Body.String(), "[-]ready failed") {
+		t.Errorf("Incorrect verbose readyz response %v %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ReadyzHandler()(w, httptest.NewRequest(http.MethodGet, "/readyz?format=json", nil))
+	var report Report
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Error decoding report: %v", err)
+	}
+	if report.Healthy || len(report.Components) != 2 || report.Components[1].LastError != "uh-oh" {
+		t.Errorf("Incorrect json report %+v", report)
+	}
+}
+
+func TestCached(t *testing.T) {
+	reset()
+	SetDeadline(0)
+	c := mock(false)
+	RegisterNamed("cached", c)
+
+	stop := Start(time.Hour)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		ReadyzHandler()(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Incorrect status %v", w.Code)
+		}
+	}
+	stop()
+	if c.called != 1 {
+		t.Errorf("Probes should be served from the cache, got %v checks", c.called)
+	}
+}
+
+func TestRegistries(t *testing.T) {
+	reset()
+	SetDeadline(0)
+	a, b := NewRegistry(), NewRegistry()
+	failing := mock(true)
+	a.RegisterNamed("failing", failing)
+	b.RegisterNamed("ok", mock(false))
+
+	// Registries are checked separately.
+	if err := a.Healthz(context.Background()); err == nil {
+		t.Errorf("Should have failed")
+	}
+	if err := b.Healthz(context.Background()); err != nil {
+		t.Errorf("Should not have failed: %v", err)
+	}
+	if err := Healthz(); err != nil {
+		t.Errorf("Should not have failed: %v", err)
+	}
+
+	// A registry is a component of another.
+	RegisterNamed("a", a)
+	if err := Healthz(); err == nil {
+		t.Errorf("Should have failed")
+	}
+	a.Unregister(failing)
+	if err := Healthz(); err != nil {
+		t.Errorf("Should not have failed: %v", err)
+	}
+	Unregister(a)
+	if r := Readiness(context.Background()); len(r.Components) != 0 {
+		t.Errorf("Incorrect components %+v", r.Components)
+	}
+}
@@ -0,0 +1,259 @@
+package invalidation
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Path is where peers receive invalidations, under their base URLs.
+const Path = "/invalidate"
+
+const maxMessageSize = 1 << 20
+
+type HTTPConfig struct {
+	// Peers returns the base URLs of the replicas, which may include this
+	// one; see StaticPeers and DNSPeers.
+	Peers func(ctx context.Context) ([]string, error)
+	// Token, if set, is sent to peers, and required of them.
+	Token string
+
+	// Invalidations are sent in batches of up to BatchSize, or every
+	// FlushInterval. At most BufferSize are queued.
+	BufferSize    int
+	BatchSize     int
+	FlushInterval time.Duration
+	// Timeout bounds each batch's delivery to a peer.
+	Timeout time.Duration
+
+	Client *http.Client
+	Logger *slog.Logger
+}
+
+// HTTP is a Bus that posts invalidations to every peer, and serves theirs as
+// an http.Handler at Path.
+type HTTP struct {
+	config HTTPConfig
+	// origin identifies this replica, so that it ignores its own batches.
+	origin string
+	queue  chan string
+
+	sync.RWMutex
+	subscribers []func(string)
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type message struct {
+	Origin string
+	Shorts []string
+}
+
+// NewHTTP returns an HTTP bus for config, which sends in the background
+// until it is closed.
+func NewHTTP(config HTTPConfig) *HTTP {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 100 * time.Millisecond
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	b := &HTTP{
+		config: config,
+		origin: uuid.New().String(),
+		queue:  make(chan string, max(config.BufferSize, 1)),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	b.config.BatchSize = max(config.BatchSize, 1)
+	go b.run()
+	return b
+}
+
+// StaticPeers returns urls as the peers.
+func StaticPeers(urls ...string) func(context.Context) ([]string, error) {
+	return func(context.Context) ([]string, error) {
+		return urls, nil
+	}
+}
+
+// DNSPeers returns the peers listening on port at the addresses host resolves
+// to, such as a headless Service's pods. It is resolved again for every batch,
+// so that peers are discovered as they start.
+func DNSPeers(host, port string) func(context.Context) ([]string, error) {
+	return func(ctx context.Context) ([]string, error) {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		urls := make([]string, len(addrs))
+		for i, addr := range addrs {
+			urls[i] = "http://" + net.JoinHostPort(addr, port)
+		}
+		return urls, nil
+	}
+}
+
+func (b *HTTP) Publish(shorts ...string) {
+	for _, short := range shorts {
+		select {
+		case b.queue <- short:
+		default:
+			b.config.Logger.Warn("invalidation buffer full; dropping", "short", short)
+		}
+	}
+}
+
+func (b *HTTP) Subscribe(f func(short string)) {
+	b.Lock()
+	defer b.Unlock()
+	b.subscribers = append(b.subscribers, f)
+}
+
+// Close sends queued invalidations and stops sending. Invalidations published
+// after are dropped.
+func (b *HTTP) Close() error {
+	close(b.stop)
+	<-b.done
+	return nil
+}
+
+func (b *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	if b.config.Token != "" && subtle.ConstantTimeCompare(auth, []byte("Bearer "+b.config.Token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var m message
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&m); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if m.Origin != b.origin {
+		b.deliver(m.Shorts)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *HTTP) deliver(shorts []string) {
+	b.RLock()
+	defer b.RUnlock()
+	for _, f := range b.subscribers {
+		for _, short := range shorts {
+			f(short)
+		}
+	}
+}
+
+func (b *HTTP) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]string, 0, b.config.BatchSize)
+	for {
+		select {
+		case <-b.stop:
+			b.drain(batch)
+			return
+		case short := <-b.queue:
+			batch = append(batch, short)
+			if len(batch) < b.config.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		b.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// drain sends batch and the invalidations queued behind it.
+func (b *HTTP) drain(batch []string) {
+	for {
+		select {
+		case short := <-b.queue:
+			if batch = append(batch, short); len(batch) < b.config.BatchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				b.send(batch)
+			}
+			return
+		}
+		b.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send posts batch to every peer at once. Peers that fail are not retried.
+func (b *HTTP) send(batch []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.Timeout)
+	defer cancel()
+	peers, err := b.config.Peers(ctx)
+	if err != nil {
+		b.config.Logger.Warn("Error finding peers", "error", err, "dropped", len(batch))
+		return
+	}
+	body, err := json.Marshal(message{Origin: b.origin, Shorts: batch})
+	if err != nil {
+		b.config.Logger.Warn("Error encoding invalidations", "error", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.post(ctx, peer, body); err != nil {
+				b.config.Logger.Warn("Error sending invalidations", "peer", peer, "error", err, "dropped", len(batch))
+			}
+		}()
+	}
+	wg.Wait()
+	b.config.Logger.Info("sent invalidations", "count", len(batch), "peers", len(peers))
+}
+
+func (b *HTTP) post(ctx context.Context, peer string, body []byte) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+Path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if b.config.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+b.config.Token)
+	}
+	resp, err := b.config.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
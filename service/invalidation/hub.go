@@ -0,0 +1,60 @@
+package invalidation
+
+import "sync"
+
+// Hub connects replicas in one process, for tests.
+type Hub struct {
+	sync.Mutex
+	members []*member
+}
+
+func NewHub() *Hub {
+	return &Hub{}
+}
+
+// Join returns a Bus for a replica, which delivers invalidations to the
+// hub's other members as they are published.
+func (h *Hub) Join() Bus {
+	h.Lock()
+	defer h.Unlock()
+	m := &member{hub: h}
+	h.members = append(h.members, m)
+	return m
+}
+
+type member struct {
+	hub         *Hub
+	subscribers []func(string)
+	closed      bool
+}
+
+func (m *member) Publish(shorts ...string) {
+	m.hub.Lock()
+	defer m.hub.Unlock()
+	if m.closed {
+		return
+	}
+	for _, other := range m.hub.members {
+		if other == m || other.closed {
+			continue
+		}
+		for _, f := range other.subscribers {
+			for _, short := range shorts {
+				f(short)
+			}
+		}
+	}
+}
+
+func (m *member) Subscribe(f func(short string)) {
+	m.hub.Lock()
+	defer m.hub.Unlock()
+	m.subscribers = append(m.subscribers, f)
+}
+
+func (m *member) Close() error {
+	m.hub.Lock()
+	defer m.hub.Unlock()
+	m.closed = true
+	return nil
+}
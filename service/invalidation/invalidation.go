@@ -0,0 +1,16 @@
+// Package invalidation broadcasts cache invalidations between replicas, so
+// that a short changed through one is not served stale by the others until
+// their caches expire it.
+package invalidation
+
+// Bus publishes this replica's invalidations to the others, and delivers
+// theirs to its subscribers.
+type Bus interface {
+	// Publish invalidates shorts on the other replicas. It does not wait for
+	// them; invalidations that cannot be delivered are left to the cache TTL.
+	Publish(shorts ...string)
+	// Subscribe calls f with each short invalidated by another replica.
+	Subscribe(f func(short string))
+	// Close delivers invalidations already published, and stops the bus.
+	Close() error
+}
@@ -0,0 +1,126 @@
+package invalidation
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects the shorts delivered to a subscriber.
+type recorder struct {
+	sync.Mutex
+	shorts []string
+}
+
+func (r *recorder) add(short string) {
+	r.Lock()
+	defer r.Unlock()
+	r.shorts = append(r.shorts, short)
+}
+
+func (r *recorder) get() []string {
+	r.Lock()
+	defer r.Unlock()
+	return slices.Clone(r.shorts)
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	a, b, c := hub.Join(), hub.Join(), hub.Join()
+	var ra, rb, rc recorder
+	a.Subscribe(ra.add)
+	b.Subscribe(rb.add)
+	c.Subscribe(rc.add)
+
+	a.Publish("x", "y")
+	c.Close()
+	b.Publish("z")
+
+	if got := ra.get(); !slices.Equal(got, []string{"z"}) {
+		t.Errorf("Incorrect invalidations %v", got)
+	}
+	if got := rb.get(); !slices.Equal(got, []string{"x", "y"}) {
+		t.Errorf("Incorrect invalidations %v", got)
+	}
+	if got := rc.get(); !slices.Equal(got, []string{"x", "y"}) {
+		t.Errorf("Closed members should not receive, got %v", got)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var peers []string
+	var buses []*HTTP
+	var recorders [3]recorder
+	for i := range recorders {
+		b := NewHTTP(HTTPConfig{
+			Peers:      func(context.Context) ([]string, error) { return peers, nil },
+			Token:      "secret",
+			BufferSize: 16,
+			BatchSize:  2,
+		})
+		b.Subscribe(recorders[i].add)
+		server := httptest.NewServer(b)
+		defer server.Close()
+		peers = append(peers, server.URL)
+		buses = append(buses, b)
+	}
+
+	buses[0].Publish("a", "b", "c")
+	buses[1].Publish("d")
+	// Close sends what is queued.
+	for _, b := range buses {
+		b.Close()
+	}
+
+	expected := [][]string{{"d"}, {"a", "b", "c"}, {"a", "b", "c", "d"}}
+	for i := range recorders {
+		got := recorders[i].get()
+		slices.Sort(got)
+		if !slices.Equal(got, expected[i]) {
+			t.Errorf("Peer %v: incorrect invalidations %v, expected %v", i, got, expected[i])
+		}
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	b := NewHTTP(HTTPConfig{Peers: StaticPeers(), Token: "secret", FlushInterval: time.Hour})
+	defer b.Close()
+	var r recorder
+	b.Subscribe(r.add)
+
+	for _, tc := range []struct {
+		method, auth string
+		status       int
+	}{
+		{http.MethodPost, "", http.StatusUnauthorized},
+		{http.MethodPost, "Bearer wrong", http.StatusUnauthorized},
+		{http.MethodGet, "Bearer secret", http.StatusMethodNotAllowed},
+		{http.MethodPost, "Bearer secret", http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(tc.method, Path, bytes.NewBufferString(`{"Origin": "other", "Shorts": ["x"]}`))
+		req.Header.Set("Authorization", tc.auth)
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%v %q: incorrect status %v, expected %v", tc.method, tc.auth, w.Code, tc.status)
+		}
+	}
+	if got := r.get(); !slices.Equal(got, []string{"x"}) {
+		t.Errorf("Only the authorized invalidation should be delivered, got %v", got)
+	}
+}
+
+func TestDNSPeers(t *testing.T) {
+	peers, err := DNSPeers("localhost", "8081")(context.Background())
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if !slices.Contains(peers, "http://127.0.0.1:8081") {
+		t.Errorf("Incorrect peers %v", peers)
+	}
+}
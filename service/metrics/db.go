@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// DB instruments the short, user and hit stores of d, whose backend is named
+// by backend.
+func (m *Metrics) DB(d db.Interface, backend string) db.Interface {
+	if m == nil {
+		return d
+	}
+	i := instrumented{
+		Interface: d,
+		shorts:    m.observer(backend, "shorts"),
+		users:     m.observer(backend, "users"),
+		hits:      m.observer(backend, "hits"),
+	}
+	if b, ok := d.(db.Backuper); ok {
+		return backuper{i, b}
+	}
+	return i
+}
+
+type instrumented struct {
+	db.Interface
+	shorts, users, hits observer
+}
+
+func (i instrumented) Shorts() db.ShortStore { return &shortStore{i.Interface.Shorts(), i.shorts} }
+func (i instrumented) Users() db.UserStore   { return &userStore{i.Interface.Users(), i.users} }
+func (i instrumented) Hits() db.HitStore     { return &hitStore{i.Interface.Hits(), i.hits} }
+
+func (i instrumented) WithContext(ctx context.Context) db.Interface {
+	i.Interface = db.WithContext(ctx, i.Interface)
+	return i
+}
+
+// backuper keeps an instrumented store's backups available.
+type backuper struct {
+	instrumented
+	b db.Backuper
+}
+
+func (b backuper) Backup() (string, error)       { return b.b.Backup() }
+func (b backuper) WriteBackup(w io.Writer) error { return b.b.WriteBackup(w) }
+
+// observer records the operations of one store.
+type observer struct {
+	latency prometheus.ObserverVec
+	errors  *prometheus.CounterVec
+}
+
+func (m *Metrics) observer(backend, store string) observer {
+	labels := prometheus.Labels{"backend": backend, "store": store}
+	return observer{m.dbLatency.MustCurryWith(labels), m.dbErrors.MustCurryWith(labels)}
+}
+
+// observe runs op, and records its latency and whether it failed. Errors that
+// are an answer, like a missing key, rather than a failure are not counted.
+func observe[T any](o observer, op string, f func() (T, error)) (T, error) {
+	start := time.Now()
+	v, err := f()
+	o.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil && util.StatusCode(err) >= http.StatusInternalServerError {
+		o.errors.WithLabelValues(op).Inc()
+	}
+	return v, err
+}
+
+// run is observe for ops that return only an error.
+func (o observer) run(op string, f func() error) error {
+	_, err := observe(o, op, func() (struct{}, error) { return struct{}{}, f() })
+	return err
+}
+
+type shortStore struct {
+	db.ShortStore
+	o observer
+}
+
+func (s *shortStore) Put(data db.ShortData) error {
+	return s.o.run("put", func() error { return s.ShortStore.Put(data) })
+}
+
+func (s *shortStore) Create(data db.ShortData) error {
+	return s.o.run("create", func() error { return s.ShortStore.Create(data) })
+}
+
+func (s *shortStore) Update(data db.ShortData) error {
+	return s.o.run("update", func() error { return s.ShortStore.Update(data) })
+}
+
+func (s *shortStore) SetOwners(caller uint64, data db.ShortData) error {
+	return s.o.run("set_owners", func() error { return s.ShortStore.SetOwners(caller, data) })
+}
+
+func (s *shortStore) Get(short string) (db.ShortData, error) {
+	return observe(s.o, "get", func() (db.ShortData, error) { return s.ShortStore.Get(short) })
+}
+
+func (s *shortStore) Delete(data db.ShortData) error {
+	return s.o.run("delete", func() error { return s.ShortStore.Delete(data) })
+}
+
+func (s *shortStore) List(start, end string) (db.ListResults, error) {
+	return observe(s.o, "list", func() (db.ListResults, error) { return s.ShortStore.List(start, end) })
+}
+
+func (s *shortStore) ListPage(start, end, cursor string, limit int) (db.ListResults, error) {
+	return observe(s.o, "list_page", func() (db.ListResults, error) { return s.ShortStore.ListPage(start, end, cursor, limit) })
+}
+
+func (s *shortStore) ListByOwner(owner uint64, cursor string, limit int) (db.ListResults, error) {
+	return observe(s.o, "list_by_owner", func() (db.ListResults, error) { return s.ShortStore.ListByOwner(owner, cursor, limit) })
+}
+
+func (s *shortStore) DeleteExpired(now time.Time) (int, error) {
+	return observe(s.o, "delete_expired", func() (int, error) { return s.ShortStore.DeleteExpired(now) })
+}
+
+func (s *shortStore) Restore(data db.ShortData) error {
+	return s.o.run("restore", func() error { return s.ShortStore.Restore(data) })
+}
+
+type userStore struct {
+	db.UserStore
+	o observer
+}
+
+func (s *userStore) LookupOrCreate(queryUser db.UserData) db.UserData {
+	user, _ := observe(s.o, "lookup_or_create", func() (db.UserData, error) {
+		return s.UserStore.LookupOrCreate(queryUser), nil
+	})
+	return user
+}
+
+func (s *userStore) Get(id uint64) (db.UserData, error) {
+	return observe(s.o, "get", func() (db.UserData, error) { return s.UserStore.Get(id) })
+}
+
+func (s *userStore) Delete(id uint64) error {
+	return s.o.run("delete", func() error { return s.UserStore.Delete(id) })
+}
+
+func (s *userStore) CreateGroup(group db.GroupData) error {
+	return s.o.run("create_group", func() error { return s.UserStore.CreateGroup(group) })
+}
+
+func (s *userStore) GetGroup(id uint64) (db.GroupData, error) {
+	return observe(s.o, "get_group", func() (db.GroupData, error) { return s.UserStore.GetGroup(id) })
+}
+
+func (s *userStore) AddMember(group, uid uint64) error {
+	return s.o.run("add_member", func() error { return s.UserStore.AddMember(group, uid) })
+}
+
+func (s *userStore) RemoveMember(group, uid uint64) error {
+	return s.o.run("remove_member", func() error { return s.UserStore.RemoveMember(group, uid) })
+}
+
+func (s *userStore) GroupsOf(uid uint64) ([]db.GroupData, error) {
+	return observe(s.o, "groups_of", func() ([]db.GroupData, error) { return s.UserStore.GroupsOf(uid) })
+}
+
+func (s *userStore) List() ([]db.UserData, error) {
+	return observe(s.o, "list", func() ([]db.UserData, error) { return s.UserStore.List() })
+}
+
+func (s *userStore) ListGroups() ([]db.GroupData, error) {
+	return observe(s.o, "list_groups", func() ([]db.GroupData, error) { return s.UserStore.ListGroups() })
+}
+
+type hitStore struct {
+	db.HitStore
+	o observer
+}
+
+func (s *hitStore) Record(hits []db.Hit) error {
+	return s.o.run("record", func() error { return s.HitStore.Record(hits) })
+}
+
+func (s *hitStore) Count(short string) (int64, error) {
+	return observe(s.o, "count", func() (int64, error) { return s.HitStore.Count(short) })
+}
+
+func (s *hitStore) Counts(shorts []string) (map[string]int64, error) {
+	return observe(s.o, "counts", func() (map[string]int64, error) { return s.HitStore.Counts(shorts) })
+}
+
+func (s *hitStore) Clicks(short string, since, until time.Time) ([]db.Hit, error) {
+	return observe(s.o, "clicks", func() ([]db.Hit, error) { return s.HitStore.Clicks(short, since, until) })
+}
@@ -0,0 +1,110 @@
+// Package metrics instruments tinyr for Prometheus: HTTP routes, caches,
+// database stores and hit recording. A nil *Metrics instruments nothing, so callers need not
+// check whether metrics are enabled.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/ml8/tinyr/service/cache"
+)
+
+const namespace = "tinyr"
+
+type Metrics struct {
+	reg       prometheus.Registerer
+	requests  *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+	dbLatency *prometheus.HistogramVec
+	dbErrors  *prometheus.CounterVec
+}
+
+// New returns Metrics registered with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		reg: reg,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route, method and status code.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"route", "method", "code"}),
+		dbLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_operation_duration_seconds",
+			Help:      "Database operation latency by backend, store and operation.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 18),
+		}, []string{"backend", "store", "op"}),
+		dbErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "db_operation_errors_total",
+			Help:      "Database operations that failed, other than by not finding or conflicting with an entry.",
+		}, []string{"backend", "store", "op"}),
+	}
+	reg.MustRegister(m.requests, m.latency, m.dbLatency, m.dbErrors)
+	return m
+}
+
+// Handler serves the metrics in the default registry.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Route instruments h, which serves route.
+func (m *Metrics) Route(route string, h http.Handler) http.Handler {
+	if m == nil {
+		return h
+	}
+	labels := prometheus.Labels{"route": route}
+	return promhttp.InstrumentHandlerDuration(m.latency.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(m.requests.MustCurryWith(labels), h))
+}
+
+// Cache exports the stats of the cache called name.
+func (m *Metrics) Cache(name string, stats func() cache.Stats) error {
+	if m == nil {
+		return nil
+	}
+	labels := prometheus.Labels{"cache": name}
+	counter := func(event, help string, f func(cache.Stats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "cache_" + event + "_total",
+			Help:        help,
+			ConstLabels: labels,
+		}, func() float64 { return float64(f(stats())) })
+	}
+	for _, c := range []prometheus.Collector{
+		counter("hits", "Cache lookups that found an entry.", func(s cache.Stats) uint64 { return s.Hits }),
+		counter("misses", "Cache lookups that found no entry.", func(s cache.Stats) uint64 { return s.Misses }),
+		counter("evictions", "Entries evicted to make room.", func(s cache.Stats) uint64 { return s.Evictions }),
+		counter("expiries", "Entries removed as older than the TTL.", func(s cache.Stats) uint64 { return s.Expiries }),
+		counter("stale", "Expired entries served while they are refreshed.", func(s cache.Stats) uint64 { return s.Stale }),
+	} {
+		if err := m.reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DroppedHits exports the count of hits dropped because the hit buffer was
+// full.
+func (m *Metrics) DroppedHits(dropped func() uint64) error {
+	if m == nil {
+		return nil
+	}
+	return m.reg.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hits_dropped_total",
+		Help:      "Hits dropped because the hit buffer was full.",
+	}, func() float64 { return float64(dropped()) }))
+}
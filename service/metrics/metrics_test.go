@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ml8/tinyr/service/cache"
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+func TestRoute(t *testing.T) {
+	m := New(prometheus.NewRegistry())
+	h := m.Route("create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/create", nil))
+	}
+
+	if n := testutil.ToFloat64(m.requests.WithLabelValues("create", "post", "201")); n != 3 {
+		t.Errorf("Incorrect request count %v", n)
+	}
+	if n := testutil.CollectAndCount(m.latency); n != 1 {
+		t.Errorf("Incorrect number of latency series %v", n)
+	}
+}
+
+func TestCache(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+	c := cache.New[int](1)
+	if err := m.Cache("test", c.Stats); err != nil {
+		t.Fatalf("Error exporting cache: %v", err)
+	}
+	c.Put("a", 1)
+	c.Get("a")
+	c.Get("b")
+	c.Put("b", 2)
+
+	expected := map[string]float64{
+		"tinyr_cache_hits_total":      1,
+		"tinyr_cache_misses_total":    1,
+		"tinyr_cache_evictions_total": 1,
+		"tinyr_cache_expiries_total":  0,
+		"tinyr_cache_stale_total":     0,
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering: %v", err)
+	}
+	for _, f := range families {
+		if want, ok := expected[f.GetName()]; ok {
+			if got := f.GetMetric()[0].GetCounter().GetValue(); got != want {
+				t.Errorf("Incorrect %v: %v, expected %v", f.GetName(), got, want)
+			}
+			delete(expected, f.GetName())
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("Missing metrics %v", expected)
+	}
+
+	// The same cache name cannot be exported twice.
+	if err := m.Cache("test", c.Stats); err == nil {
+		t.Errorf("Should not export a cache twice")
+	}
+}
+
+func TestDroppedHits(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+	if err := m.DroppedHits(func() uint64 { return 3 }); err != nil {
+		t.Fatalf("Error exporting dropped hits: %v", err)
+	}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP tinyr_hits_dropped_total Hits dropped because the hit buffer was full.
+# TYPE tinyr_hits_dropped_total counter
+tinyr_hits_dropped_total 3
+`), "tinyr_hits_dropped_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+type failingShorts struct {
+	db.ShortStore
+}
+
+func (failingShorts) Get(short string) (db.ShortData, error) {
+	if short == "missing" {
+		return db.ShortData{}, util.NoSuchKeyError(short)
+	}
+	return db.ShortData{}, errors.New("unavailable")
+}
+
+type failingDB struct {
+	db.Interface
+}
+
+func (failingDB) Shorts() db.ShortStore { return failingShorts{} }
+
+func TestDB(t *testing.T) {
+	m := New(prometheus.NewRegistry())
+	d := m.DB(failingDB{db.NewInMemory()}, "memory")
+
+	d.Shorts().Get("missing")
+	d.Shorts().Get("other")
+	if _, err := d.Users().Get(1); err == nil {
+		t.Errorf("Should not find user")
+	}
+
+	if n := testutil.ToFloat64(m.dbErrors.WithLabelValues("memory", "shorts", "get")); n != 1 {
+		t.Errorf("Only failures should be counted, got %v", n)
+	}
+	if n := testutil.ToFloat64(m.dbErrors.WithLabelValues("memory", "users", "get")); n != 0 {
+		t.Errorf("Missing users should not be counted, got %v", n)
+	}
+	if n := testutil.CollectAndCount(m.dbLatency); n != 2 {
+		t.Errorf("Incorrect number of latency series %v", n)
+	}
+	if _, ok := d.(db.Backuper); ok {
+		t.Errorf("In-memory store should not be a Backuper")
+	}
+}
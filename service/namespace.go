@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// Shorts may be namespaced with slashes, e.g. "team/oncall" is "oncall" in the
+// namespace "team". Whoever owns "team" controls what is created under it.
+
+const (
+	// maxDepth bounds the segments in a short, and so the lookups needed to
+	// resolve a path.
+	maxDepth = 8
+
+	// lastRune sorts after every character allowed in a short.
+	lastRune = "\U0010FFFF"
+)
+
+// ancestors returns the namespaces enclosing short, nearest first: "a/b/c" has
+// ancestors "a/b" and "a".
+func ancestors(short string) (names []string) {
+	for i := strings.LastIndex(short, "/"); i > 0; i = strings.LastIndex(short, "/") {
+		short = short[:i]
+		names = append(names, short)
+	}
+	return
+}
+
+// prefixRange is the inclusive range of shorts within namespace ns, for List.
+func prefixRange(ns string) (start, end string) {
+	prefix := strings.TrimSuffix(ns, "/") + "/"
+	return prefix, prefix + lastRune
+}
+
+// reservations are names that cannot be created, by namespace. Reserving a name
+// also reserves everything under it. The root namespace is "".
+type reservations map[string]map[string]bool
+
+// newReservations reserves each of names, which may be namespaced.
+func newReservations(names ...string) reservations {
+	r := make(reservations)
+	for _, name := range names {
+		ns, leaf := "", name
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			ns, leaf = name[:i], name[i+1:]
+		}
+		if r[ns] == nil {
+			r[ns] = make(map[string]bool)
+		}
+		r[ns][leaf] = true
+	}
+	return r
+}
+
+// reserved is true iff short or any of its namespaces is reserved.
+func (r reservations) reserved(short string) bool {
+	for _, name := range append([]string{short}, ancestors(short)...) {
+		ns, leaf := "", name
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			ns, leaf = name[:i], name[i+1:]
+		}
+		if r[ns][leaf] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNamespace returns util.PermissionDeniedError unless uid owns the nearest
+// existing namespace enclosing short, if there is one. Errors other than a
+// missing namespace are returned, rather than taken to mean there is none.
+func (s *Server) checkNamespace(ctx context.Context, short string, uid uint64) error {
+	for _, ns := range ancestors(short) {
+		parent, err := s.store(ctx).Shorts().Get(ns)
+		if _, ok := err.(util.NoSuchKeyError); ok {
+			continue
+		} else if err != nil {
+			s.logger.Warn("Error checking namespace", "short", short, "namespace", ns, "error", err)
+			return err
+		}
+		if err = db.Authorize(parent, uid, true, s.store(ctx).Users()); err != nil {
+			s.logger.Info("Namespace not owned", "short", short, "namespace", ns, "owner", parent.Owner)
+			return util.PermissionDeniedError
+		}
+		return nil
+	}
+	return nil
+}
+
+// resolve finds the longest short that prefixes path, and returns it with the
+// rest of path.
+func (s *Server) resolve(ctx context.Context, path string) (short, rest string, entry cacheEntry, err error) {
+	err = util.NoSuchKeyError(path)
+	for _, name := range append([]string{path}, ancestors(path)...) {
+		if !ValidShort(name) {
+			continue
+		}
+		var e cacheEntry
+		if e, err = s.getWithCache(ctx, name); err == nil {
+			short, rest, entry = name, strings.TrimPrefix(path[len(name):], "/"), e
+			return
+		}
+	}
+	return
+}
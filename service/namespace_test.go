@@ -0,0 +1,63 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// unavailableShorts fails every lookup but those of missing.
+type unavailableShorts struct {
+	db.ShortStore
+	missing string
+}
+
+func (s unavailableShorts) Get(short string) (db.ShortData, error) {
+	if short == s.missing {
+		return db.ShortData{}, util.NoSuchKeyError(short)
+	}
+	return db.ShortData{}, errors.New("unavailable")
+}
+
+type unavailableDB struct {
+	db.Interface
+	missing string
+}
+
+func (d unavailableDB) Shorts() db.ShortStore {
+	return unavailableShorts{d.Interface.Shorts(), d.missing}
+}
+
+func TestCheckNamespace(t *testing.T) {
+	const alice, bob = 1, 2
+	d := db.NewInMemory()
+	d.Shorts().Create(db.ShortData{Short: "team", Long: "https://x", Owner: alice})
+	s := &Server{db: d, logger: slog.Default()}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		short string
+		uid   uint64
+		err   error
+	}{
+		{"team/a", alice, nil},
+		{"team/a/b", alice, nil},
+		{"team/a", bob, util.PermissionDeniedError},
+		{"other/a", bob, nil},
+		{"top", bob, nil},
+	} {
+		if err := s.checkNamespace(ctx, tc.short, tc.uid); err != tc.err {
+			t.Errorf("%v by %v: incorrect error %v, expected %v", tc.short, tc.uid, err, tc.err)
+		}
+	}
+
+	// Lookups that fail do not mean the namespace is free.
+	s.db = unavailableDB{d, "team/a"}
+	if err := s.checkNamespace(ctx, "team/a/b", bob); err == nil {
+		t.Errorf("Should fail when the namespace cannot be looked up")
+	}
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// lookupUser finds the id of a user by email. Users exist once they have
+// logged in.
+func (s *Server) lookupUser(ctx context.Context, email string) (uid uint64, err error) {
+	uid = util.Hash(email)
+	if _, err = s.store(ctx).Users().Get(uid); err != nil {
+		err = util.NoSuchKeyError(email)
+	}
+	return
+}
+
+func (s *Server) lookupUsers(ctx context.Context, emails []string) (uids []uint64, err error) {
+	for _, email := range emails {
+		var uid uint64
+		if uid, err = s.lookupUser(ctx, email); err != nil {
+			return
+		}
+		if !slices.Contains(uids, uid) {
+			uids = append(uids, uid)
+		}
+	}
+	return
+}
+
+// lookupGroup finds a group by name, which uid must be a member of.
+func (s *Server) lookupGroup(ctx context.Context, name string, uid uint64) (group db.GroupData, err error) {
+	if group, err = s.store(ctx).Users().GetGroup(db.GroupId(name)); err != nil {
+		return
+	} else if !slices.Contains(group.Members, uid) {
+		err = util.PermissionDeniedError
+	}
+	return
+}
+
+// resolveOwners converts the group name and editor emails of a request made by
+// uid to ids. An empty group name is no group.
+func (s *Server) resolveOwners(ctx context.Context, uid uint64, group string, editors []string) (gid uint64, eids []uint64, err error) {
+	if group != "" {
+		var g db.GroupData
+		if g, err = s.lookupGroup(ctx, group, uid); err != nil {
+			return
+		}
+		gid = g.Id
+	}
+	eids, err = s.lookupUsers(ctx, editors)
+	return
+}
+
+func (s *Server) groupEntry(ctx context.Context, group db.GroupData) GroupEntry {
+	e := GroupEntry{Name: group.Name, Members: make([]string, 0, len(group.Members))}
+	for _, uid := range group.Members {
+		if u, err := s.store(ctx).Users().Get(uid); err == nil {
+			e.Members = append(e.Members, u.Email)
+		} else {
+			e.Members = append(e.Members, fmt.Sprint(uid))
+		}
+	}
+	return e
+}
+
+func (s *Server) groupsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, err := s.UserFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	groups, err := s.store(ctx).Users().GroupsOf(uid)
+	if err != nil {
+		s.logger.Warn("Error listing groups", "uid", uid, "error", err)
+		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	entries := make([]GroupEntry, 0, len(groups))
+	for _, g := range groups {
+		entries = append(entries, s.groupEntry(ctx, g))
+	}
+	util.JsonResponse(w, http.StatusOK, entries)
+}
+
+func (s *Server) createGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, err := s.UserFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	req := &GroupRequest{}
+	if err := Parse(r, &req); err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.logger.Info("Create group", "name", req.Name)
+	if !IsLetter(req.Name) {
+		util.ErrorResponse(w, http.StatusBadRequest, util.InvalidValueError(req.Name).Error())
+		return
+	}
+	// Others join through /groups/add, so no one is added without a member
+	// asking.
+	group := db.GroupData{Id: db.GroupId(req.Name), Name: req.Name, Members: []uint64{uid}}
+	if err := s.store(ctx).Users().CreateGroup(group); err != nil {
+		s.logger.Info("Error creating group", "name", req.Name, "error", err)
+		util.ErrorResponse(w, util.StatusCode(err), err.Error())
+		return
+	}
+	util.JsonResponse(w, http.StatusOK, s.groupEntry(ctx, group))
+}
+
+// memberHandler adds or removes a member of a group. Only members may change
+// membership, and the last member cannot leave.
+func (s *Server) memberHandler(add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		uid, err := s.UserFrom(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		req := &MemberRequest{}
+		if err := Parse(r, &req); err != nil {
+			util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.logger.Info("Change group", "group", req.Group, "email", req.Email, "add", add)
+		group, err := s.lookupGroup(ctx, req.Group, uid)
+		if err != nil {
+			util.ErrorResponse(w, util.StatusCode(err), err.Error())
+			return
+		}
+		member, err := s.lookupUser(ctx, req.Email)
+		if err != nil {
+			util.ErrorResponse(w, util.StatusCode(err), err.Error())
+			return
+		}
+		if add {
+			err = s.store(ctx).Users().AddMember(group.Id, member)
+		} else if len(group.Members) == 1 && group.Members[0] == member {
+			err = util.InvalidValueError(req.Email)
+		} else {
+			err = s.store(ctx).Users().RemoveMember(group.Id, member)
+		}
+		if err != nil {
+			s.logger.Info("Error changing group", "group", req.Group, "error", err)
+			util.ErrorResponse(w, util.StatusCode(err), err.Error())
+			return
+		}
+		if group, err = s.store(ctx).Users().GetGroup(group.Id); err != nil {
+			util.ErrorResponse(w, util.StatusCode(err), err.Error())
+			return
+		}
+		util.JsonResponse(w, http.StatusOK, s.groupEntry(ctx, group))
+	}
+}
+
+func (s *Server) transferHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, err := s.UserFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	req := &TransferRequest{}
+	if err := Parse(r, &req); err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if v := r.Header.Get("If-Match"); v != "" {
+		version, err := parseETag(v)
+		if err != nil {
+			util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Version = &version
+	}
+	s.logger.Info("Transfer", "short", req.Short, "owner", req.Owner, "group", req.Group, "editors", req.Editors, "version", req.Version)
+	if req.Version == nil {
+		util.ErrorResponse(w, http.StatusPreconditionRequired, "A version or If-Match header is required")
+		return
+	} else if !ValidShort(req.Short) {
+		util.ErrorResponse(w, http.StatusBadRequest, "Short urls must be simple strings")
+		return
+	}
+
+	data, err := s.store(ctx).Shorts().Get(req.Short)
+	if err != nil {
+		util.ErrorResponse(w, http.StatusNotFound, util.NoSuchKeyError(req.Short).Error())
+		return
+	}
+	if req.Owner != nil {
+		if data.Owner, err = s.lookupUser(ctx, *req.Owner); err != nil {
+			util.ErrorResponse(w, util.StatusCode(err), err.Error())
+			return
+		}
+	}
+	group, editors := "", []string(nil)
+	if req.Group != nil {
+		group = *req.Group
+	}
+	if req.Editors != nil {
+		editors = *req.Editors
+	}
+	gid, eids, err := s.resolveOwners(ctx, uid, group, editors)
+	if err != nil {
+		util.ErrorResponse(w, util.StatusCode(err), err.Error())
+		return
+	}
+	// Omitted fields are unchanged.
+	if req.Group != nil {
+		data.Group = gid
+	}
+	if req.Editors != nil {
+		data.Editors = eids
+	}
+
+	data.Version = *req.Version
+	if err := s.store(ctx).Shorts().SetOwners(uid, data); err != nil {
+		s.logger.Info("Error transferring", "short", req.Short, "error", err)
+		util.ErrorResponse(w, util.StatusCode(err), err.Error())
+		return
+	}
+	data.Version++
+	s.logger.Info("Transferred", "short", req.Short, "owner", data.Owner, "group", data.Group, "version", data.Version)
+	w.Header().Set("ETag", etag(data.Version))
+	util.JsonResponse(w, http.StatusOK, UpdateResponse{Short: data.Short, Version: data.Version})
+}
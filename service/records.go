@@ -0,0 +1,269 @@
+package service
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// Shorts are imported and exported as a stream of records in one of these
+// formats.
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+	FormatYAML  = "yaml"
+)
+
+// maxRecordSize bounds a single JSON line.
+const maxRecordSize = 1 << 20
+
+var csvHeader = []string{"Short", "Long", "Owner", "Group", "Editors", "Mode", "ExpiresAt", "MaxHits", "Version"}
+
+var contentTypes = map[string]string{
+	FormatJSONL: "application/x-ndjson",
+	FormatCSV:   "text/csv",
+	FormatYAML:  "application/yaml",
+}
+
+// recordReader reads records until io.EOF. Errors wrapped in rowError affect a
+// single record, and reading may continue past them.
+type recordReader interface {
+	Read() (db.ShortData, error)
+}
+
+type recordWriter interface {
+	Write(db.ShortData) error
+	Flush() error
+}
+
+type rowError struct {
+	error
+}
+
+func newRecordReader(format string, r io.Reader) (recordReader, error) {
+	switch format {
+	case FormatJSONL:
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, maxRecordSize)
+		return &jsonlReader{s}, nil
+	case FormatCSV:
+		return newCSVReader(r)
+	case FormatYAML:
+		return &yamlReader{yaml.NewDecoder(r)}, nil
+	}
+	return nil, util.InvalidValueError(format)
+}
+
+func newRecordWriter(format string, w io.Writer) (recordWriter, error) {
+	switch format {
+	case FormatJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonlWriter{bw, json.NewEncoder(bw)}, nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		return &csvWriter{cw, false}, cw.Error()
+	case FormatYAML:
+		return &yamlWriter{yaml.NewEncoder(w)}, nil
+	}
+	return nil, util.InvalidValueError(format)
+}
+
+// JSON lines: one record per line; blank lines are skipped.
+type jsonlReader struct {
+	s *bufio.Scanner
+}
+
+func (r *jsonlReader) Read() (data db.ShortData, err error) {
+	for r.s.Scan() {
+		line := strings.TrimSpace(r.s.Text())
+		if line == "" {
+			continue
+		}
+		if err = json.Unmarshal([]byte(line), &data); err != nil {
+			err = rowError{err}
+		}
+		return
+	}
+	if err = r.s.Err(); err == nil {
+		err = io.EOF
+	}
+	return
+}
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w *jsonlWriter) Write(data db.ShortData) error {
+	return w.enc.Encode(data)
+}
+
+func (w *jsonlWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// CSV: a header naming the columns, which may be any subset of csvHeader in any
+// order, then one record per row. Editors are separated by spaces and expiry
+// is RFC 3339.
+type csvReader struct {
+	r       *csv.Reader
+	columns []string
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	c := &csvReader{r: csv.NewReader(r)}
+	c.r.FieldsPerRecord = -1
+	header, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range header {
+		h = strings.TrimSpace(h)
+		if !isCSVColumn(h) {
+			return nil, util.InvalidValueError(h)
+		}
+		c.columns = append(c.columns, h)
+	}
+	return c, nil
+}
+
+func isCSVColumn(name string) bool {
+	for _, h := range csvHeader {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *csvReader) Read() (data db.ShortData, err error) {
+	row, err := c.r.Read()
+	var perr *csv.ParseError
+	if errors.As(err, &perr) {
+		err = rowError{err}
+		return
+	} else if err != nil {
+		return
+	}
+	for i, v := range row {
+		if i >= len(c.columns) {
+			err = rowError{fmt.Errorf("too many fields")}
+			return
+		}
+		if err = setCSVField(&data, c.columns[i], strings.TrimSpace(v)); err != nil {
+			err = rowError{fmt.Errorf("%v: %w", c.columns[i], err)}
+			return
+		}
+	}
+	return
+}
+
+func setCSVField(data *db.ShortData, column, v string) (err error) {
+	if v == "" {
+		return
+	}
+	switch column {
+	case "Short":
+		data.Short = v
+	case "Long":
+		data.Long = v
+	case "Owner":
+		data.Owner, err = strconv.ParseUint(v, 10, 64)
+	case "Group":
+		data.Group, err = strconv.ParseUint(v, 10, 64)
+	case "Editors":
+		for _, e := range strings.Fields(v) {
+			var uid uint64
+			if uid, err = strconv.ParseUint(e, 10, 64); err != nil {
+				return
+			}
+			data.Editors = append(data.Editors, uid)
+		}
+	case "Mode":
+		var m int
+		m, err = strconv.Atoi(v)
+		data.Mode = db.RedirectMode(m)
+	case "ExpiresAt":
+		data.ExpiresAt, err = time.Parse(time.RFC3339, v)
+	case "MaxHits":
+		data.MaxHits, err = strconv.ParseInt(v, 10, 64)
+	case "Version":
+		data.Version, err = strconv.Atoi(v)
+	}
+	return
+}
+
+type csvWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func (c *csvWriter) Write(data db.ShortData) error {
+	if !c.wroteHeader {
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+		c.wroteHeader = true
+	}
+	editors := make([]string, len(data.Editors))
+	for i, e := range data.Editors {
+		editors[i] = strconv.FormatUint(e, 10)
+	}
+	expires := ""
+	if !data.ExpiresAt.IsZero() {
+		expires = data.ExpiresAt.Format(time.RFC3339)
+	}
+	return c.w.Write([]string{
+		data.Short,
+		data.Long,
+		strconv.FormatUint(data.Owner, 10),
+		strconv.FormatUint(data.Group, 10),
+		strings.Join(editors, " "),
+		strconv.Itoa(int(data.Mode)),
+		expires,
+		strconv.FormatInt(data.MaxHits, 10),
+		strconv.Itoa(data.Version),
+	})
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// YAML: a stream of documents, one per record. Decoding cannot resume after an
+// error, so every error ends the stream.
+type yamlReader struct {
+	dec *yaml.Decoder
+}
+
+func (r *yamlReader) Read() (data db.ShortData, err error) {
+	err = r.dec.Decode(&data)
+	return
+}
+
+type yamlWriter struct {
+	enc *yaml.Encoder
+}
+
+func (w *yamlWriter) Write(data db.ShortData) error {
+	return w.enc.Encode(data)
+}
+
+// Flush is a no-op: the encoder writes each document as it is encoded, and
+// closing it would end the stream.
+func (w *yamlWriter) Flush() error {
+	return nil
+}
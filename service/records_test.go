@@ -0,0 +1,110 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ml8/tinyr/service/db"
+)
+
+func TestRecordsRoundTrip(t *testing.T) {
+	records := []db.ShortData{
+		{Short: "a", Long: "https://a", Owner: 1, Version: 1},
+		{Short: "b/c", Long: "https://x/{1}", Owner: 2, Group: 3, Editors: []uint64{4, 5}, Mode: db.RedirectTemplate,
+			ExpiresAt: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), MaxHits: 10, Version: 7},
+	}
+	for _, format := range []string{FormatJSONL, FormatCSV, FormatYAML} {
+		var buf bytes.Buffer
+		w, err := newRecordWriter(format, &buf)
+		if err != nil {
+			t.Fatalf("%v: got error %v", format, err)
+		}
+		for _, data := range records {
+			if err := w.Write(data); err != nil {
+				t.Fatalf("%v: got error %v", format, err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("%v: got error %v", format, err)
+		}
+
+		r, err := newRecordReader(format, &buf)
+		if err != nil {
+			t.Fatalf("%v: got error %v", format, err)
+		}
+		var got []db.ShortData
+		for {
+			data, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%v: got error %v", format, err)
+			}
+			got = append(got, data)
+		}
+		if !reflect.DeepEqual(got, records) {
+			t.Errorf("%v: incorrect records %v, expected %v", format, got, records)
+		}
+	}
+}
+
+func TestRecordsUnknownFormat(t *testing.T) {
+	if _, err := newRecordReader("xml", strings.NewReader("")); err == nil {
+		t.Errorf("Expected error for unknown format")
+	}
+	if _, err := newRecordWriter("xml", io.Discard); err == nil {
+		t.Errorf("Expected error for unknown format")
+	}
+}
+
+// read returns the records and errors of a stream, up to io.EOF or the first
+// error that ends it.
+func read(t *testing.T, format, in string) (shorts []string, errs []error) {
+	r, err := newRecordReader(format, strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("%v: got error %v", format, err)
+	}
+	for {
+		data, err := r.Read()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			errs = append(errs, err)
+			if _, ok := err.(rowError); !ok {
+				return
+			}
+			continue
+		}
+		shorts = append(shorts, data.Short)
+	}
+}
+
+func TestRecordsRowErrors(t *testing.T) {
+	for _, tc := range []struct {
+		format, in string
+		shorts     []string
+		errs       int
+	}{
+		// Blank lines are skipped, and bad lines do not end the stream.
+		{FormatJSONL, "{\"Short\":\"a\"}\n\nnot json\n{\"Short\":\"b\"}\n", []string{"a", "b"}, 1},
+		// Columns may be a subset, in any order.
+		{FormatCSV, "Long,Short\nhttps://a,a\nhttps://b,b\n", []string{"a", "b"}, 0},
+		{FormatCSV, "Short,MaxHits\na,x\nb,1\n", []string{"b"}, 1},
+		{FormatCSV, "Short\na,extra\nb\n", []string{"b"}, 1},
+		// Documents after a YAML error cannot be read.
+		{FormatYAML, "Short: a\n---\nShort: [\n---\nShort: b\n", []string{"a"}, 1},
+	} {
+		shorts, errs := read(t, tc.format, tc.in)
+		if !reflect.DeepEqual(shorts, tc.shorts) || len(errs) != tc.errs {
+			t.Errorf("%v %q: incorrect shorts %v and errors %v", tc.format, tc.in, shorts, errs)
+		}
+	}
+
+	if _, err := newRecordReader(FormatCSV, strings.NewReader("Short,Unknown\n")); err == nil {
+		t.Errorf("Expected error for unknown column")
+	}
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+var placeholder = regexp.MustCompile(`\{([0-9]+)\}`)
+
+// placeholders returns the number of parameters a template takes. Placeholders
+// must be numbered from {1} without gaps.
+func placeholders(template string) (n int, err error) {
+	seen := make(map[int]bool)
+	for _, m := range placeholder.FindAllStringSubmatch(template, -1) {
+		i, err := strconv.Atoi(m[1])
+		if err != nil || i < 1 {
+			return 0, util.InvalidValueError(fmt.Sprintf("%v has invalid placeholder %v", template, m[0]))
+		}
+		seen[i] = true
+		n = max(n, i)
+	}
+	for i := 1; i <= n; i++ {
+		if !seen[i] {
+			return 0, util.InvalidValueError(fmt.Sprintf("%v is missing {%d}", template, i))
+		}
+	}
+	return
+}
+
+// redirectMode parses the requested mode for long, inferring it from the
+// presence of placeholders if empty.
+func redirectMode(mode, long string) (m db.RedirectMode, err error) {
+	n, err := placeholders(long)
+	if err != nil {
+		return
+	}
+	switch mode {
+	case "":
+		if n > 0 {
+			m = db.RedirectTemplate
+		}
+	case "prefix":
+		m = db.RedirectPrefix
+	case "template":
+		m = db.RedirectTemplate
+		if n == 0 {
+			err = util.InvalidValueError(fmt.Sprintf("%v has no placeholders", long))
+		}
+	default:
+		err = util.InvalidValueError(mode)
+	}
+	return
+}
+
+// validLong checks the long url of data, filling in any template.
+func validLong(data db.ShortData) error {
+	long := data.Long
+	if data.Mode == db.RedirectTemplate {
+		// Placeholders are not valid in every part of a url.
+		long = placeholder.ReplaceAllString(long, "x")
+	}
+	return ValidUrl(long)
+}
+
+// fill replaces the placeholders in template with segments. Segments are
+// escaped for the part of the url they land in. Placeholders without a
+// segment are left as they are; templates are checked with placeholders.
+func fill(template string, segments []string) string {
+	path, query, hasQuery := strings.Cut(template, "?")
+	replace := func(s string, escape func(string) string) string {
+		return placeholder.ReplaceAllStringFunc(s, func(p string) string {
+			i, err := strconv.Atoi(p[1 : len(p)-1])
+			if err != nil || i < 1 || i > len(segments) {
+				return p
+			}
+			return escape(segments[i-1])
+		})
+	}
+	filled := replace(path, url.PathEscape)
+	if hasQuery {
+		filled += "?" + replace(query, url.QueryEscape)
+	}
+	return filled
+}
+
+// redirectTarget combines long with rest, the path following the short, and
+// query, the request's query parameters. Request parameters replace those of
+// the same name in long.
+func redirectTarget(long string, mode db.RedirectMode, rest string, query url.Values) (target string, err error) {
+	var u *url.URL
+	switch mode {
+	case db.RedirectTemplate:
+		var segments []string
+		for _, s := range strings.Split(rest, "/") {
+			if s != "" {
+				segments = append(segments, s)
+			}
+		}
+		var n int
+		if n, err = placeholders(long); err != nil {
+			return
+		} else if len(segments) != n {
+			err = util.InvalidValueError(fmt.Sprintf("expected %d parameters, got %d", n, len(segments)))
+			return
+		}
+		if u, err = url.Parse(fill(long, segments)); err != nil {
+			return
+		}
+	default:
+		if u, err = url.Parse(long); err != nil {
+			return
+		}
+		if rest != "" {
+			u = u.JoinPath(rest)
+		}
+	}
+	if len(query) > 0 {
+		q := u.Query()
+		for k, v := range query {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	target = u.String()
+	return
+}
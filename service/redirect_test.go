@@ -0,0 +1,81 @@
+package service
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/ml8/tinyr/service/db"
+)
+
+func TestPlaceholders(t *testing.T) {
+	for _, tc := range []struct {
+		template string
+		n        int
+		valid    bool
+	}{
+		{"https://x", 0, true},
+		{"https://x/{1}", 1, true},
+		{"https://x/{1}/{2}?q={1}", 2, true},
+		{"https://x/{2}/{1}", 2, true},
+		{"https://x/{2}", 0, false},
+		{"https://x/{1}/{3}", 0, false},
+		{"https://x/{0}", 0, false},
+		{"https://x/{0}/{1}", 0, false},
+		{"https://x/{00}", 0, false},
+		{"https://x/{99999999999999999999}", 0, false},
+	} {
+		n, err := placeholders(tc.template)
+		if tc.valid != (err == nil) {
+			t.Errorf("%v: incorrect error %v", tc.template, err)
+		} else if n != tc.n {
+			t.Errorf("%v: incorrect count %v, expected %v", tc.template, n, tc.n)
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	for _, tc := range []struct {
+		template string
+		segments []string
+		filled   string
+	}{
+		{"https://x/{1}", []string{"a"}, "https://x/a"},
+		{"https://x/{2}/{1}", []string{"a", "b"}, "https://x/b/a"},
+		{"https://x/{1}?q={1}", []string{"a b"}, "https://x/a%20b?q=a+b"},
+		{"https://x/{1}?q={2}", []string{"a/b", "c&d"}, "https://x/a%2Fb?q=c%26d"},
+		// Placeholders without a segment are left as they are.
+		{"https://x/{0}/{1}/{3}", []string{"a"}, "https://x/{0}/a/{3}"},
+	} {
+		if filled := fill(tc.template, tc.segments); filled != tc.filled {
+			t.Errorf("%v %v: incorrect url %v, expected %v", tc.template, tc.segments, filled, tc.filled)
+		}
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	for _, tc := range []struct {
+		long   string
+		mode   db.RedirectMode
+		rest   string
+		query  url.Values
+		target string
+		valid  bool
+	}{
+		{"https://x/y", db.RedirectPrefix, "", nil, "https://x/y", true},
+		{"https://x/y", db.RedirectPrefix, "a/b", nil, "https://x/y/a/b", true},
+		{"https://x/y?a=1&b=2", db.RedirectPrefix, "", url.Values{"a": {"3"}}, "https://x/y?a=3&b=2", true},
+		{"https://x/{1}/{2}", db.RedirectTemplate, "a/b", nil, "https://x/a/b", true},
+		{"https://x/{1}", db.RedirectTemplate, "/a/", nil, "https://x/a", true},
+		{"https://x/s?q={1}", db.RedirectTemplate, "a b", url.Values{"p": {"1"}}, "https://x/s?p=1&q=a+b", true},
+		{"https://x/{1}/{2}", db.RedirectTemplate, "a", nil, "", false},
+		{"https://x/{1}", db.RedirectTemplate, "a/b", nil, "", false},
+		{"https://x/{0}/{1}", db.RedirectTemplate, "a", nil, "", false},
+	} {
+		target, err := redirectTarget(tc.long, tc.mode, tc.rest, tc.query)
+		if tc.valid != (err == nil) {
+			t.Errorf("%v %q: incorrect error %v", tc.long, tc.rest, err)
+		} else if target != tc.target {
+			t.Errorf("%v %q: incorrect target %v, expected %v", tc.long, tc.rest, target, tc.target)
+		}
+	}
+}
@@ -5,95 +5,384 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/zitadel/oidc/v3/pkg/client/rp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+
 	"github.com/ml8/tinyr/service/cache"
 	"github.com/ml8/tinyr/service/db"
 	"github.com/ml8/tinyr/service/healthz"
+	"github.com/ml8/tinyr/service/invalidation"
+	"github.com/ml8/tinyr/service/metrics"
+	"github.com/ml8/tinyr/service/tracing"
 	"github.com/ml8/tinyr/service/util"
 )
 
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
 type cacheEntry struct {
 	Long      string
-	Timestamp time.Time
+	Mode      db.RedirectMode
+	ExpiresAt time.Time
+	MaxHits   int64
+	// Hits is the recorded hits when the entry was loaded, counted only for
+	// entries with a hit limit.
+	Hits int64
+	// Missing marks a short that was not found, cached so that lookups of
+	// shorts that do not exist do not all reach the database.
+	Missing bool
 }
 
-type instance struct {
-	db     db.Interface
-	cache  cache.KVCache[cacheEntry]
-	ttl    time.Duration
-	logger *slog.Logger
+func newCacheEntry(data db.ShortData) cacheEntry {
+	return cacheEntry{Long: data.Long, Mode: data.Mode, ExpiresAt: data.ExpiresAt, MaxHits: data.MaxHits}
 }
 
-var svc instance
+// Server is a tinyr instance: it owns its database, cache and auth config. It
+// serves its routes, under Config.ShortURLPrefix, and the login and callback
+// routes from ServeHTTP, or registers them with another mux with Register.
+type Server struct {
+	db        db.Interface
+	cache     cache.KVCache[cacheEntry]
+	bus       invalidation.Bus
+	hits      *hitRecorder
+	stopReap  func()
+	stopSweep func()
+	generator generator
+	baseURL   string
+	prefix    string
+	missTTL   time.Duration // for shorts that were not found
+	reserved  reservations
+	admins    map[uint64]bool
+	auth      AuthConfig
+	provider  rp.RelyingParty
+	mux       *http.ServeMux
+	metrics   *metrics.Metrics
+	health    *healthz.Registry
+	logger    *slog.Logger
 
-var reserved map[string]bool
+	// loads coalesces concurrent lookups of a short that missed the cache, and
+	// refreshing holds the shorts being refreshed in the background.
+	loads      singleflight.Group
+	refreshing sync.Map
+	refreshes  sync.WaitGroup
+}
 
 type Config struct {
 	AuthConfig
 	ShortURLPrefix string
 	DB             db.Interface
-	CacheTTL       time.Duration
 	CacheSize      int
+
+	// Cached shorts expire after CacheTTL, shortened by a random fraction of
+	// up to CacheJitter of it, and shorts that were not found after
+	// NegativeCacheTTL; zero disables caching them. Expired entries are served
+	// for up to CacheStale more while they are refreshed in the background;
+	// zero disables serving them. Expired entries are swept every
+	// CacheSweepInterval, if they are not read first.
+	CacheTTL           time.Duration
+	CacheJitter        float64
+	NegativeCacheTTL   time.Duration
+	CacheStale         time.Duration
+	CacheSweepInterval time.Duration
+
+	// Invalidations, if set, broadcasts this replica's cache invalidations to
+	// the others, and applies theirs. The server closes it.
+	Invalidations invalidation.Bus
+
+	// Shorts generated for requests that omit one are ShortLength characters
+	// drawn from ShortAlphabet.
+	ShortAlphabet string
+	ShortLength   int
+
+	// Redirects are recorded in batches of up to HitBatchSize, or every
+	// HitFlushInterval. At most HitBufferSize hits are queued.
+	HitBufferSize    int
+	HitBatchSize     int
+	HitFlushInterval time.Duration
+
+	// Expired shorts are deleted every ReapInterval; zero disables reaping.
+	ReapInterval time.Duration
+
+	// Reserved names, which may be namespaced, cannot be created, and neither
+	// can anything under them. The service's routes are always reserved.
+	Reserved []string
+
+	// Admins are the emails of the users who may back up the store.
+	Admins []string
+
+	// Metrics, if set, instruments the routes and the cache. The database is
+	// instrumented by whoever opens it, with Metrics.DB.
+	Metrics *metrics.Metrics
+
+	// Health is the registry that the server's health check is registered
+	// with, until it is closed; nil is healthz.Default.
+	Health *healthz.Registry
 }
 
-func Init(mux *http.ServeMux, config Config) {
-	// register routes
-	mux.HandleFunc(fmt.Sprintf("%s/create", config.ShortURLPrefix), createHandler)
-	mux.HandleFunc(fmt.Sprintf("%s/delete", config.ShortURLPrefix), deleteHandler)
-	mux.HandleFunc(fmt.Sprintf("%s/{short}", config.ShortURLPrefix), goHandler)
-	reserved = map[string]bool{
-		"create": true,
-		"delete": true,
+// New returns a Server for config. It does not serve until it is registered
+// with a mux, or used as a handler.
+func New(config Config) *Server {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
 	}
-
 	var c cache.KVCache[cacheEntry] = nil
 	if config.CacheSize > 0 {
-		config.Logger.Info("caching enabled", "size", config.CacheSize, "ttl", config.CacheTTL)
-		c = cache.New[cacheEntry](config.CacheSize)
+		config.Logger.Info("caching enabled", "size", config.CacheSize, "ttl", config.CacheTTL, "negativeTTL", config.NegativeCacheTTL, "stale", config.CacheStale)
+		c = cache.NewWithConfig[cacheEntry](cache.Config{
+			Size:   config.CacheSize,
+			TTL:    config.CacheTTL,
+			Jitter: config.CacheJitter,
+			Stale:  config.CacheStale,
+		})
+	}
+	g, err := newGenerator(config.ShortAlphabet, config.ShortLength)
+	util.OkOrDie(err)
+	admins := make(map[uint64]bool)
+	for _, email := range config.Admins {
+		admins[util.Hash(email)] = true
+	}
+	s := &Server{
+		db:        config.DB,
+		cache:     c,
+		bus:       config.Invalidations,
+		generator: g,
+		baseURL:   config.BaseURL + config.ShortURLPrefix,
+		prefix:    config.ShortURLPrefix,
+		missTTL:   config.NegativeCacheTTL,
+		reserved: newReservations(append([]string{
+			"create",
+			"update",
+			"delete",
+			"list",
+			"stats",
+			"mine",
+			"transfer",
+			"groups",
+			"export",
+			"import",
+			"backup",
+			"healthz",
+			"livez",
+			"readyz",
+			"metrics",
+		}, config.Reserved...)...),
+		admins:  admins,
+		metrics: config.Metrics,
+		logger:  config.Logger,
+	}
+	s.stopSweep = func() {}
+	if c != nil {
+		if err := s.metrics.Cache("urls", c.Stats); err != nil {
+			s.logger.Warn("Error exporting cache metrics", "error", err)
+		}
+		s.stopSweep = cache.StartSweeper(c, config.CacheSweepInterval)
 	}
-	svc = instance{db: config.DB, cache: c, logger: config.Logger}
-	healthz.Register(&svc)
+	if s.bus != nil {
+		s.bus.Subscribe(s.evict)
+	}
+	s.hits = newHitRecorder(config.DB.Hits(), config, s.hitsFlushed)
+	if err := s.metrics.DroppedHits(s.hits.Dropped); err != nil {
+		s.logger.Warn("Error exporting hit metrics", "error", err)
+	}
+	s.initAuth(config.AuthConfig)
+	s.mux = http.NewServeMux()
+	s.Register(s.mux)
+	if s.health = config.Health; s.health == nil {
+		s.health = healthz.Default
+	}
+	s.health.RegisterNamed("service", s)
+	s.stopReap = startReaper(s.db.Shorts(), config.ReapInterval, s.logger)
 
-	initAuth(mux, config)
+	s.logger.Info("service config", "config", config)
+	return s
+}
 
-	svc.logger.Info("service config", "config", config)
+// Register registers the server's routes with mux.
+func (s *Server) Register(mux *http.ServeMux) {
+	s.handle(mux, "create", s.createHandler)
+	s.handle(mux, "update", s.updateHandler)
+	s.handle(mux, "delete", s.deleteHandler)
+	s.handle(mux, "list", s.listHandler)
+	s.handle(mux, "stats", s.statsHandler)
+	s.handle(mux, "mine", s.mineHandler)
+	s.handle(mux, "transfer", s.transferHandler)
+	s.handle(mux, "export", s.exportHandler)
+	s.handle(mux, "import", s.importHandler)
+	s.handle(mux, "groups", s.groupsHandler)
+	s.handle(mux, "groups/create", s.createGroupHandler)
+	s.handle(mux, "groups/add", s.memberHandler(true))
+	s.handle(mux, "groups/remove", s.memberHandler(false))
+	s.handle(mux, "backup", s.backupHandler)
+	s.handle(mux, "backup/download", s.downloadBackupHandler)
+	redirect := s.metrics.Route("redirect", tracing.Route("redirect", http.HandlerFunc(s.goHandler)))
+	mux.Handle(fmt.Sprintf("%s/{short}", s.prefix), redirect)
+	mux.Handle(fmt.Sprintf("%s/{short}/{rest...}", s.prefix), redirect)
+	s.registerAuth(mux)
 }
 
-func (s *instance) getWithCache(short string) (long string, err error) {
+// handle registers h for route, under the prefix.
+func (s *Server) handle(mux *http.ServeMux, route string, h http.HandlerFunc) {
+	mux.Handle(fmt.Sprintf("%s/%s", s.prefix, route), s.metrics.Route(route, tracing.Route(route, h)))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close unregisters the health check, stops the background workers, flushing
+// queued hits and invalidations, and then closes the database. Requests must
+// have drained first.
+func (s *Server) Close() error {
+	s.health.Unregister(s)
+	s.stopSweep()
+	s.stopReap()
+	s.refreshes.Wait()
+	s.hits.Close()
+	if s.bus != nil {
+		if err := s.bus.Close(); err != nil {
+			s.logger.Warn("Error closing invalidation bus", "error", err)
+		}
+	}
+	return s.db.Close()
+}
+
+// store returns the database bound to ctx, so that its calls are traced as
+// part of the request.
+func (s *Server) store(ctx context.Context) db.Interface {
+	return db.WithContext(ctx, s.db)
+}
+
+func (s *Server) getWithCache(ctx context.Context, short string) (entry cacheEntry, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "getWithCache", trace.WithAttributes(attribute.String("short", short)))
+	defer span.End()
 	if s.cache != nil {
-		var entry cacheEntry
-		entry, err = s.cache.Get(short)
-		if err == nil {
-			// in cache; valid?
-			if entry.Timestamp.Add(s.ttl).Before(time.Now()) {
-				// entry valid; exit early.
-				long = entry.Long
-				s.logger.Info("cache hit", "short", short, "long", entry.Long)
-				return
+		// entries are returned expired only within the stale window.
+		var fresh bool
+		if entry, fresh, err = s.cache.GetStale(short); err == nil {
+			span.SetAttributes(attribute.Bool("cache.hit", true), attribute.Bool("cache.stale", !fresh))
+			if !fresh {
+				s.logger.Info("cache hit, stale", "short", short)
+				s.refresh(ctx, short)
 			}
-			// entry is expired
-			s.logger.Info("ttl expired", "short", short)
-			s.cache.Invalidate(short)
+			if entry.Missing {
+				s.logger.Info("cache hit, not found", "short", short)
+				return cacheEntry{}, util.NoSuchKeyError(short)
+			}
+			s.logger.Info("cache hit", "short", short, "long", entry.Long)
+			return
 		}
 	}
-	// not in cache or cache invalid. query.
+	// not in cache. query, with any concurrent misses, and cache the answer.
 	s.logger.Info("cache miss", "short", short)
-	data, err := svc.db.Shorts().Get(short)
-	long = data.Long
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+	v, err, shared := s.loads.Do(short, func() (any, error) { return s.load(ctx, short) })
+	span.SetAttributes(attribute.Bool("cache.coalesced", shared))
+	return v.(cacheEntry), err
+}
+
+// refresh loads short in the background, unless it is already being
+// refreshed.
+func (s *Server) refresh(ctx context.Context, short string) {
+	if _, running := s.refreshing.LoadOrStore(short, true); running {
+		return
+	}
+	s.refreshes.Add(1)
+	go func() {
+		defer s.refreshes.Done()
+		defer s.refreshing.Delete(short)
+		if _, err, _ := s.loads.Do(short, func() (any, error) { return s.load(ctx, short) }); err != nil {
+			s.logger.Info("refresh failed", "short", short, "error", err)
+		}
+	}()
+}
+
+// load looks up short, and caches the answer unless short was evicted since
+// the lookup began. Loads are shared by the requests that coalesce on them, so
+// they are not cancelled with any one of them.
+func (s *Server) load(ctx context.Context, short string) (entry cacheEntry, err error) {
+	var gen uint64
+	if s.cache != nil {
+		gen = s.cache.Generation(short)
+	}
+	store := s.store(context.WithoutCancel(ctx))
+	data, err := store.Shorts().Get(short)
+	entry = newCacheEntry(data)
+	if err == nil && entry.MaxHits > 0 {
+		var countErr error
+		if entry.Hits, countErr = store.Hits().Count(short); countErr != nil {
+			s.logger.Warn("Error counting hits", "short", short, "error", countErr)
+		}
+	}
+	if s.cache != nil {
+		stored := true
+		switch {
+		case err == nil:
+			stored = s.cache.PutIfGeneration(short, entry, cache.DefaultTTL, gen)
+		case s.missTTL > 0 && util.StatusCode(err) == http.StatusNotFound:
+			stored = s.cache.PutIfGeneration(short, cacheEntry{Missing: true}, s.missTTL, gen)
+		}
+		if !stored {
+			s.logger.Info("cache load superseded", "short", short)
+		}
+	}
 	return
 }
 
-func (s *instance) invalidateAndReplace(short string, long string) {
+// expired is true iff the entry has passed its expiry time or hit limit. Hit
+// limits are checked against the hits counted when the entry was loaded;
+// entries with a limit are evicted whenever their hits are flushed, so the
+// count lags redirects by up to the hit flush interval.
+func expired(entry cacheEntry) bool {
+	return db.ShortData{ExpiresAt: entry.ExpiresAt, MaxHits: entry.MaxHits}.Expired(time.Now(), entry.Hits)
+}
+
+// hitsFlushed evicts the cached entries of shorts that have a hit limit, so
+// that they are loaded again with their new count. Other replicas count again
+// when their own hits are flushed, or their entries expire.
+func (s *Server) hitsFlushed(shorts []string) {
 	if s.cache == nil {
 		return
 	}
-	s.invalidate(short)
-	s.logger.Info("cache replace", "short", short, "long", long)
-	s.cache.Put(short, cacheEntry{Long: long, Timestamp: time.Now()})
+	for _, short := range shorts {
+		if entry, err := s.cache.Get(short); err == nil && entry.MaxHits > 0 {
+			s.evict(short)
+		}
+	}
+}
+
+func (s *Server) invalidateAndReplace(data db.ShortData) {
+	// other replicas may cache it even if this one does not.
+	s.invalidate(data.Short)
+	if s.cache == nil || data.MaxHits > 0 {
+		// limited entries are left to be loaded with their count.
+		return
+	}
+	s.logger.Info("cache replace", "short", data.Short, "long", data.Long)
+	s.cache.Put(data.Short, newCacheEntry(data))
 }
 
-func (s *instance) invalidate(short string) {
+// invalidate drops short from the cache, here and on the other replicas.
+func (s *Server) invalidate(short string) {
+	if s.bus != nil {
+		s.bus.Publish(short)
+	}
+	s.evict(short)
+}
+
+// evict drops short from this replica's cache. Lookups already running may
+// have read the old value, which they do not cache; later ones do not wait on
+// them.
+func (s *Server) evict(short string) {
+	s.loads.Forget(short)
 	if s.cache == nil {
 		return
 	}
@@ -101,21 +390,43 @@ func (s *instance) invalidate(short string) {
 	s.cache.Invalidate(short)
 }
 
-func goHandler(w http.ResponseWriter, r *http.Request) {
-	short := r.PathValue("short")
-	svc.logger.Info("Request for", "short", short, "host", util.GetIP(r))
+func (s *Server) goHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	path := r.PathValue("short")
+	if rest := r.PathValue("rest"); rest != "" {
+		path += "/" + rest
+	}
+	s.logger.Info("Request for", "path", path, "host", util.GetIP(r))
 
-	long, err := svc.getWithCache(short)
+	short, rest, entry, err := s.resolve(ctx, path)
 	if err != nil {
-		svc.logger.Warn("no url found", "short", short, "err", err)
+		s.logger.Warn("no url found", "path", path, "err", err)
 		w.WriteHeader(http.StatusNotFound)
 		return
+	} else if expired(entry) {
+		s.logger.Info("expired", "short", short)
+		w.WriteHeader(http.StatusGone)
+		return
 	}
-	http.Redirect(w, r, long, http.StatusTemporaryRedirect)
+	target, err := redirectTarget(entry.Long, entry.Mode, rest, r.URL.Query())
+	if err != nil {
+		s.logger.Info("bad parameters", "short", short, "err", err)
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.hits.Record(db.Hit{
+		Short:     short,
+		Timestamp: time.Now(),
+		Host:      util.GetIP(r),
+		Referrer:  r.Referer(),
+		UserAgent: r.UserAgent(),
+	}.Truncate())
+	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
 }
 
-func createHandler(w http.ResponseWriter, r *http.Request) {
-	uid, err := UserFrom(r)
+func (s *Server) createHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, err := s.UserFrom(r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
@@ -126,35 +437,214 @@ func createHandler(w http.ResponseWriter, r *http.Request) {
 		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	svc.logger.Info("Create", "short", req.Short, "long", req.Long)
+	s.logger.Info("Create", "short", req.Short, "long", req.Long)
 	req.Long = httpify(req.Long)
-	if !ValidShort(req.Short) {
-		svc.logger.Info("Invalid short", "short", req.Short)
+	data, err := shortData(*req, uid)
+	if err != nil {
+		s.logger.Info("Invalid limits", "expiresAt", req.ExpiresAt, "ttl", req.TTL, "maxHits", req.MaxHits)
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if data.Group, data.Editors, err = s.resolveOwners(ctx, uid, req.Group, req.Editors); err != nil {
+		s.logger.Info("Invalid owners", "group", req.Group, "editors", req.Editors)
+		util.ErrorResponse(w, util.StatusCode(err), err.Error())
+		return
+	}
+	if req.Short == "" {
+		s.createGenerated(ctx, w, data)
+		return
+	} else if !ValidShort(req.Short) {
+		s.logger.Info("Invalid short", "short", req.Short)
 		util.ErrorResponse(w, http.StatusBadRequest, "Short urls must be simple strings")
 		return
-	} else if err = ValidUrl(req.Long); err != nil {
-		svc.logger.Info("Invalid long", "long", req.Long)
+	} else if err = validLong(data); err != nil {
+		s.logger.Info("Invalid long", "long", req.Long)
 		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
-	} else if ok := reserved[req.Short]; ok {
-		svc.logger.Info("Reserved short", "short", req.Short)
+	} else if s.reserved.reserved(req.Short) {
+		s.logger.Info("Reserved short", "short", req.Short)
 		util.ErrorResponse(w, http.StatusBadRequest, util.InvalidValueError(req.Short).Error())
 		return
+	} else if err = s.checkNamespace(ctx, req.Short, uid); err != nil {
+		util.ErrorResponse(w, util.StatusCode(err), err.Error())
+		return
 	}
 
-	if err := svc.db.Shorts().Put(db.ShortData{Short: req.Short, Long: req.Long, Owner: uid}); err != nil {
-		svc.logger.Warn("Error storing", "short", req.Short, "error", err)
-		// TODO: response codes
-		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+	// Existing shorts are changed through /update, which checks versions.
+	if err := s.store(ctx).Shorts().Create(data); err != nil {
+		s.logger.Warn("Error storing", "short", req.Short, "error", err)
+		util.ErrorResponse(w, util.StatusCode(err), err.Error())
 		return
 	}
-	svc.invalidateAndReplace(req.Short, req.Long)
-	svc.logger.Info("Created", "short", req.Short, "long", req.Long, "owner", uid)
-	w.WriteHeader(http.StatusOK)
+	s.invalidateAndReplace(data)
+	s.logger.Info("Created", "short", req.Short, "long", req.Long, "owner", uid)
+	util.JsonResponse(w, http.StatusOK, s.createResponse(req.Short))
+}
+
+// shortData validates the limits in req and returns the entry it describes.
+func shortData(req CreateRequest, uid uint64) (data db.ShortData, err error) {
+	expires, err := req.Expiry(time.Now())
+	if err != nil {
+		return
+	} else if req.MaxHits < 0 {
+		err = util.InvalidValueError(fmt.Sprint(req.MaxHits))
+		return
+	}
+	mode, err := redirectMode(req.Mode, req.Long)
+	if err != nil {
+		return
+	}
+	data = db.ShortData{Short: req.Short, Long: req.Long, Mode: mode, Owner: uid, ExpiresAt: expires, MaxHits: req.MaxHits}
+	return
+}
+
+// applyUpdate changes data as req asks.
+func applyUpdate(req UpdateRequest, data *db.ShortData, now time.Time) (err error) {
+	data.Long = req.Long
+	if req.ExpiresAt != nil || req.TTL != nil {
+		var expiry CreateRequest
+		if req.ExpiresAt != nil {
+			expiry.ExpiresAt = *req.ExpiresAt
+		}
+		if req.TTL != nil {
+			expiry.TTL = *req.TTL
+		}
+		if data.ExpiresAt, err = expiry.Expiry(now); err != nil {
+			return
+		}
+	}
+	if req.MaxHits != nil {
+		if *req.MaxHits < 0 {
+			return util.InvalidValueError(fmt.Sprint(*req.MaxHits))
+		}
+		data.MaxHits = *req.MaxHits
+	}
+	switch {
+	case req.Mode != nil:
+		data.Mode, err = redirectMode(*req.Mode, data.Long)
+	case data.Mode == db.RedirectTemplate:
+		// Kept, but the new long url must still have placeholders.
+		_, err = redirectMode("template", data.Long)
+	}
+	return
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
-	uid, err := UserFrom(r)
+func (s *Server) updateHandler(w http.ResponseWriter, r *http.Request) {
+	uid, err := s.UserFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	req := &UpdateRequest{}
+	if err := Parse(r, &req); err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if v := r.Header.Get("If-Match"); v != "" {
+		version, err := parseETag(v)
+		if err != nil {
+			util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Version = &version
+	}
+	s.logger.Info("Update", "short", req.Short, "long", req.Long, "version", req.Version)
+	if req.Version == nil {
+		util.ErrorResponse(w, http.StatusPreconditionRequired, "A version or If-Match header is required")
+		return
+	}
+	if !ValidShort(req.Short) {
+		util.ErrorResponse(w, http.StatusBadRequest, "Short urls must be simple strings")
+		return
+	}
+
+	// Omitted fields are unchanged; the version check fails if the entry
+	// changed since it was read.
+	data, err := s.store(r.Context()).Shorts().Get(req.Short)
+	if err != nil {
+		util.ErrorResponse(w, http.StatusNotFound, util.NoSuchKeyError(req.Short).Error())
+		return
+	}
+	req.Long = httpify(req.Long)
+	if err = applyUpdate(*req, &data, time.Now()); err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err = validLong(data); err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	data.Owner = uid
+	data.Version = *req.Version
+	if err := s.store(r.Context()).Shorts().Update(data); err != nil {
+		s.logger.Info("Error updating", "short", req.Short, "error", err)
+		util.ErrorResponse(w, util.StatusCode(err), err.Error())
+		return
+	}
+	data.Version++
+	s.invalidateAndReplace(data)
+	s.logger.Info("Updated", "short", req.Short, "long", req.Long, "version", data.Version)
+	w.Header().Set("ETag", etag(data.Version))
+	util.JsonResponse(w, http.StatusOK, UpdateResponse{Short: data.Short, Version: data.Version})
+}
+
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+func parseETag(tag string) (version int, err error) {
+	v, err := strconv.Unquote(strings.TrimPrefix(tag, "W/"))
+	if err == nil {
+		version, err = strconv.Atoi(v)
+	}
+	if err != nil {
+		err = util.InvalidValueError(tag)
+	}
+	return
+}
+
+// createGenerated stores data under a generated short, retrying on collision.
+func (s *Server) createGenerated(ctx context.Context, w http.ResponseWriter, data db.ShortData) {
+	if err := validLong(data); err != nil {
+		s.logger.Info("Invalid long", "long", data.Long)
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for i := 0; i < maxGenerateAttempts; i++ {
+		short, err := s.generator.next()
+		if err != nil {
+			s.logger.Warn("Error generating short", "error", err)
+			util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		} else if s.reserved.reserved(short) {
+			continue
+		}
+		data.Short = short
+		err = s.store(ctx).Shorts().Create(data)
+		if _, ok := err.(util.AlreadyExistsError); ok {
+			s.logger.Info("Generated short in use", "short", short, "attempt", i)
+			continue
+		} else if err != nil {
+			s.logger.Warn("Error storing", "short", short, "error", err)
+			util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.invalidateAndReplace(data)
+		s.logger.Info("Created", "short", short, "long", data.Long, "owner", data.Owner)
+		util.JsonResponse(w, http.StatusOK, s.createResponse(short))
+		return
+	}
+	s.logger.Warn("Could not generate short", "attempts", maxGenerateAttempts)
+	util.ErrorResponse(w, http.StatusServiceUnavailable, ExhaustedError.Error())
+}
+
+func (s *Server) createResponse(short string) CreateResponse {
+	return CreateResponse{Short: short, URL: fmt.Sprintf("%s/%s", s.baseURL, short)}
+}
+
+func (s *Server) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	uid, err := s.UserFrom(r)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
@@ -165,7 +655,7 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	svc.logger.Info("Delete", "short", req.Short)
+	s.logger.Info("Delete", "short", req.Short)
 	if !ValidShort(req.Short) {
 		util.ErrorResponse(w, http.StatusBadRequest, "Short urls must be simple strings")
 		return
@@ -173,19 +663,91 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	entry := db.ShortData{Short: req.Short, Owner: uid}
 
-	if err := svc.db.Shorts().Delete(entry); err != nil {
-		// TODO: response codes
-		svc.logger.Info("Error deleting", "short", req.Short, "error", err)
-		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+	if err := s.store(r.Context()).Shorts().Delete(entry); err != nil {
+		s.logger.Info("Error deleting", "short", req.Short, "error", err)
+		util.ErrorResponse(w, util.StatusCode(err), err.Error())
 		return
 	}
-	svc.invalidate(req.Short)
-	svc.logger.Info("Deleted", "short", req.Short)
+	s.invalidate(req.Short)
+	s.logger.Info("Deleted", "short", req.Short)
 	w.WriteHeader(http.StatusOK)
 	return
 }
 
-func (s *instance) Healthz(ctx context.Context) error {
-	// TODO
-	return nil
+func (s *Server) listHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if _, err := s.UserFrom(r); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	start, end := r.URL.Query().Get("start"), r.URL.Query().Get("end")
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+		start, end = prefixRange(prefix)
+	}
+	s.logger.Info("List", "start", start, "end", end)
+	results, err := s.store(ctx).Shorts().List(start, end)
+	if err != nil {
+		s.logger.Warn("Error listing", "start", start, "end", end, "error", err)
+		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	util.JsonResponse(w, http.StatusOK, s.listEntries(ctx, results.Matching))
+}
+
+func (s *Server) mineHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uid, err := s.UserFrom(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxPageSize {
+			util.ErrorResponse(w, http.StatusBadRequest, util.InvalidValueError(v).Error())
+			return
+		}
+	}
+	s.logger.Info("Mine", "uid", uid, "cursor", cursor, "limit", limit)
+	results, err := s.store(ctx).Shorts().ListByOwner(uid, cursor, limit)
+	if err != nil {
+		s.logger.Warn("Error listing", "uid", uid, "cursor", cursor, "error", err)
+		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	util.JsonResponse(w, http.StatusOK, MineResponse{
+		Entries: s.listEntries(ctx, results.Matching),
+		Next:    results.Next,
+	})
+}
+
+func (s *Server) listEntries(ctx context.Context, matching []db.ShortData) []ListEntry {
+	shorts := make([]string, len(matching))
+	for i, data := range matching {
+		shorts[i] = data.Short
+	}
+	hits, err := s.store(ctx).Hits().Counts(shorts)
+	if err != nil {
+		s.logger.Warn("Error counting hits", "count", len(shorts), "error", err)
+	}
+	entries := make([]ListEntry, 0, len(matching))
+	for _, data := range matching {
+		entries = append(entries, ListEntry{
+			Short:     data.Short,
+			Long:      data.Long,
+			Hits:      int(hits[data.Short]),
+			ExpiresAt: data.ExpiresAt,
+			MaxHits:   data.MaxHits,
+			Version:   data.Version,
+		})
+	}
+	return entries
+}
+
+// Healthz fails if redirects are not being recorded.
+func (s *Server) Healthz(ctx context.Context) error {
+	return s.hits.Healthz(ctx)
 }
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/ml8/tinyr/service/cache"
+	"github.com/ml8/tinyr/service/db"
+)
+
+// blockingShorts signals read, if it is empty, when a lookup has read its
+// entry, and returns it once release is closed.
+type blockingShorts struct {
+	db.ShortStore
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s blockingShorts) Get(short string) (db.ShortData, error) {
+	data, err := s.ShortStore.Get(short)
+	select {
+	case s.read <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return data, err
+}
+
+type blockingDB struct {
+	db.Interface
+	shorts blockingShorts
+}
+
+func (d blockingDB) Shorts() db.ShortStore {
+	return d.shorts
+}
+
+func TestLoadAfterEvict(t *testing.T) {
+	d := db.NewInMemory()
+	d.Shorts().Create(db.ShortData{Short: "a", Long: "https://old"})
+	shorts := blockingShorts{d.Shorts(), make(chan struct{}, 1), make(chan struct{})}
+	s := &Server{db: blockingDB{d, shorts}, cache: cache.New[cacheEntry](10), logger: slog.Default()}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if entry, err := s.getWithCache(context.Background(), "a"); err != nil || entry.Long != "https://old" {
+			t.Errorf("Incorrect entry %v, %v", entry, err)
+		}
+	}()
+	// The load has read the old entry when it is changed.
+	<-shorts.read
+	s.evict("a")
+	close(shorts.release)
+	<-done
+
+	if entry, err := s.cache.Get("a"); err == nil {
+		t.Errorf("Old entry %v cached after eviction", entry)
+	}
+	// Loads that start after are cached.
+	if _, err := s.getWithCache(context.Background(), "a"); err != nil {
+		t.Fatalf("Got error %v", err)
+	} else if _, err := s.cache.Get("a"); err != nil {
+		t.Errorf("Entry not cached: %v", err)
+	}
+}
+
+// countingHits counts the hit counts read.
+type countingHits struct {
+	db.HitStore
+	counts *int
+}
+
+func (h countingHits) Count(short string) (int64, error) {
+	*h.counts++
+	return h.HitStore.Count(short)
+}
+
+type countingDB struct {
+	db.Interface
+	hits countingHits
+}
+
+func (d countingDB) Hits() db.HitStore {
+	return d.hits
+}
+
+func TestHitLimitCached(t *testing.T) {
+	d := db.NewInMemory()
+	d.Shorts().Create(db.ShortData{Short: "a", Long: "https://a", MaxHits: 2})
+	var counts int
+	s := &Server{db: countingDB{d, countingHits{d.Hits(), &counts}}, cache: cache.New[cacheEntry](10), logger: slog.Default()}
+
+	for i := 0; i < 3; i++ {
+		if entry, err := s.getWithCache(context.Background(), "a"); err != nil || expired(entry) {
+			t.Fatalf("Incorrect entry %v, %v", entry, err)
+		}
+	}
+	if counts != 1 {
+		t.Errorf("Counted hits %v times, expected once", counts)
+	}
+	// Flushed hits reach the limit.
+	d.Hits().Record([]db.Hit{{Short: "a"}, {Short: "a"}})
+	s.hitsFlushed([]string{"a"})
+	if entry, err := s.getWithCache(context.Background(), "a"); err != nil || !expired(entry) {
+		t.Errorf("Incorrect entry %v, %v, expected exhausted", entry, err)
+	}
+}
+
+func TestApplyUpdate(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	prev := db.ShortData{Short: "a", Long: "https://a/{1}", Mode: db.RedirectTemplate, ExpiresAt: now.Add(time.Hour), MaxHits: 5}
+	ptr := func(s string) *string { return &s }
+	zero, hits := time.Time{}, int64(0)
+	for _, tc := range []struct {
+		req UpdateRequest
+		exp db.ShortData
+		err bool
+	}{
+		// Omitted fields are unchanged.
+		{UpdateRequest{Long: "https://b/{1}"}, db.ShortData{Short: "a", Long: "https://b/{1}", Mode: db.RedirectTemplate, ExpiresAt: now.Add(time.Hour), MaxHits: 5}, false},
+		{UpdateRequest{Long: "https://b", Mode: ptr("prefix")}, db.ShortData{Short: "a", Long: "https://b", Mode: db.RedirectPrefix, ExpiresAt: now.Add(time.Hour), MaxHits: 5}, false},
+		{UpdateRequest{Long: "https://b/{1}", TTL: ptr("2h")}, db.ShortData{Short: "a", Long: "https://b/{1}", Mode: db.RedirectTemplate, ExpiresAt: now.Add(2 * time.Hour), MaxHits: 5}, false},
+		// Zero values remove limits.
+		{UpdateRequest{Long: "https://b/{1}", ExpiresAt: &zero, MaxHits: &hits}, db.ShortData{Short: "a", Long: "https://b/{1}", Mode: db.RedirectTemplate}, false},
+		{UpdateRequest{Long: "https://b", Mode: ptr("")}, db.ShortData{Short: "a", Long: "https://b", ExpiresAt: now.Add(time.Hour), MaxHits: 5}, false},
+		// A kept template needs placeholders.
+		{UpdateRequest{Long: "https://b"}, db.ShortData{}, true},
+	} {
+		data := prev
+		err := applyUpdate(tc.req, &data, now)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error", tc.req)
+			}
+		} else if err != nil || data.Short != tc.exp.Short || data.Long != tc.exp.Long || data.Mode != tc.exp.Mode || !data.ExpiresAt.Equal(tc.exp.ExpiresAt) || data.MaxHits != tc.exp.MaxHits {
+			t.Errorf("%+v: got %+v, %v, expected %+v", tc.req, data, err, tc.exp)
+		}
+	}
+}
+
+func TestHitRecorderHealthz(t *testing.T) {
+	// Not running, so hits stay buffered.
+	r := &hitRecorder{hits: make(chan db.Hit, 1), logger: slog.Default(), done: make(chan struct{})}
+	r.Record(db.Hit{Short: "a"})
+	r.Record(db.Hit{Short: "a"})
+	if n := r.Dropped(); n != 1 {
+		t.Errorf("Incorrect dropped hits %v", n)
+	}
+	if err := r.Healthz(context.Background()); err != nil {
+		t.Errorf("A full buffer should not fail: %v", err)
+	}
+	close(r.done)
+	if err := r.Healthz(context.Background()); err == nil {
+		t.Errorf("A stopped recorder should fail")
+	}
+}
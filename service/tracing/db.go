@@ -0,0 +1,192 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ml8/tinyr/service/db"
+	"github.com/ml8/tinyr/service/util"
+)
+
+// DB traces calls to the short, user and hit stores of d, whose backend is
+// named by backend. Bound to a context with db.WithContext, calls are
+// children of its span, and d's stores are bound to theirs.
+func DB(d db.Interface, backend string) db.Interface {
+	t := traced{Interface: d, backend: backend, ctx: context.Background()}
+	if b, ok := d.(db.Backuper); ok {
+		return backuper{t, b}
+	}
+	return t
+}
+
+type traced struct {
+	db.Interface
+	backend string
+	ctx     context.Context
+}
+
+func (t traced) Shorts() db.ShortStore { return &shortStore{t} }
+func (t traced) Users() db.UserStore   { return &userStore{t} }
+func (t traced) Hits() db.HitStore     { return &hitStore{t} }
+
+func (t traced) WithContext(ctx context.Context) db.Interface {
+	t.ctx = ctx
+	return t
+}
+
+// backuper keeps a traced store's backups available.
+type backuper struct {
+	traced
+	b db.Backuper
+}
+
+func (b backuper) Backup() (string, error)       { return b.b.Backup() }
+func (b backuper) WriteBackup(w io.Writer) error { return b.b.WriteBackup(w) }
+
+// span runs op on the database bound to a span for it. Errors that are an
+// answer, like a missing key, rather than a failure are recorded without
+// failing the span.
+func span[T any](t traced, op string, f func(d db.Interface) (T, error)) (T, error) {
+	ctx, s := Tracer().Start(t.ctx, op,
+		trace.WithAttributes(attribute.String("db.backend", t.backend)))
+	defer s.End()
+	v, err := f(db.WithContext(ctx, t.Interface))
+	if err != nil {
+		s.RecordError(err)
+		if util.StatusCode(err) >= http.StatusInternalServerError {
+			s.SetStatus(codes.Error, err.Error())
+		}
+	}
+	return v, err
+}
+
+// run is span for ops that return only an error.
+func (t traced) run(op string, f func(d db.Interface) error) error {
+	_, err := span(t, op, func(d db.Interface) (struct{}, error) { return struct{}{}, f(d) })
+	return err
+}
+
+type shortStore struct {
+	t traced
+}
+
+func (s *shortStore) Put(data db.ShortData) error {
+	return s.t.run("ShortStore.Put", func(d db.Interface) error { return d.Shorts().Put(data) })
+}
+
+func (s *shortStore) Create(data db.ShortData) error {
+	return s.t.run("ShortStore.Create", func(d db.Interface) error { return d.Shorts().Create(data) })
+}
+
+func (s *shortStore) Update(data db.ShortData) error {
+	return s.t.run("ShortStore.Update", func(d db.Interface) error { return d.Shorts().Update(data) })
+}
+
+func (s *shortStore) SetOwners(caller uint64, data db.ShortData) error {
+	return s.t.run("ShortStore.SetOwners", func(d db.Interface) error { return d.Shorts().SetOwners(caller, data) })
+}
+
+func (s *shortStore) Get(short string) (db.ShortData, error) {
+	return span(s.t, "ShortStore.Get", func(d db.Interface) (db.ShortData, error) { return d.Shorts().Get(short) })
+}
+
+func (s *shortStore) Delete(data db.ShortData) error {
+	return s.t.run("ShortStore.Delete", func(d db.Interface) error { return d.Shorts().Delete(data) })
+}
+
+func (s *shortStore) List(start, end string) (db.ListResults, error) {
+	return span(s.t, "ShortStore.List", func(d db.Interface) (db.ListResults, error) { return d.Shorts().List(start, end) })
+}
+
+func (s *shortStore) ListPage(start, end, cursor string, limit int) (db.ListResults, error) {
+	return span(s.t, "ShortStore.ListPage", func(d db.Interface) (db.ListResults, error) {
+		return d.Shorts().ListPage(start, end, cursor, limit)
+	})
+}
+
+func (s *shortStore) ListByOwner(owner uint64, cursor string, limit int) (db.ListResults, error) {
+	return span(s.t, "ShortStore.ListByOwner", func(d db.Interface) (db.ListResults, error) {
+		return d.Shorts().ListByOwner(owner, cursor, limit)
+	})
+}
+
+func (s *shortStore) DeleteExpired(now time.Time) (int, error) {
+	return span(s.t, "ShortStore.DeleteExpired", func(d db.Interface) (int, error) { return d.Shorts().DeleteExpired(now) })
+}
+
+func (s *shortStore) Restore(data db.ShortData) error {
+	return s.t.run("ShortStore.Restore", func(d db.Interface) error { return d.Shorts().Restore(data) })
+}
+
+type userStore struct {
+	t traced
+}
+
+func (s *userStore) LookupOrCreate(queryUser db.UserData) db.UserData {
+	user, _ := span(s.t, "UserStore.LookupOrCreate", func(d db.Interface) (db.UserData, error) {
+		return d.Users().LookupOrCreate(queryUser), nil
+	})
+	return user
+}
+
+func (s *userStore) Get(id uint64) (db.UserData, error) {
+	return span(s.t, "UserStore.Get", func(d db.Interface) (db.UserData, error) { return d.Users().Get(id) })
+}
+
+func (s *userStore) Delete(id uint64) error {
+	return s.t.run("UserStore.Delete", func(d db.Interface) error { return d.Users().Delete(id) })
+}
+
+func (s *userStore) CreateGroup(group db.GroupData) error {
+	return s.t.run("UserStore.CreateGroup", func(d db.Interface) error { return d.Users().CreateGroup(group) })
+}
+
+func (s *userStore) GetGroup(id uint64) (db.GroupData, error) {
+	return span(s.t, "UserStore.GetGroup", func(d db.Interface) (db.GroupData, error) { return d.Users().GetGroup(id) })
+}
+
+func (s *userStore) AddMember(group, uid uint64) error {
+	return s.t.run("UserStore.AddMember", func(d db.Interface) error { return d.Users().AddMember(group, uid) })
+}
+
+func (s *userStore) RemoveMember(group, uid uint64) error {
+	return s.t.run("UserStore.RemoveMember", func(d db.Interface) error { return d.Users().RemoveMember(group, uid) })
+}
+
+func (s *userStore) GroupsOf(uid uint64) ([]db.GroupData, error) {
+	return span(s.t, "UserStore.GroupsOf", func(d db.Interface) ([]db.GroupData, error) { return d.Users().GroupsOf(uid) })
+}
+
+func (s *userStore) List() ([]db.UserData, error) {
+	return span(s.t, "UserStore.List", func(d db.Interface) ([]db.UserData, error) { return d.Users().List() })
+}
+
+func (s *userStore) ListGroups() ([]db.GroupData, error) {
+	return span(s.t, "UserStore.ListGroups", func(d db.Interface) ([]db.GroupData, error) { return d.Users().ListGroups() })
+}
+
+type hitStore struct {
+	t traced
+}
+
+func (s *hitStore) Record(hits []db.Hit) error {
+	return s.t.run("HitStore.Record", func(d db.Interface) error { return d.Hits().Record(hits) })
+}
+
+func (s *hitStore) Count(short string) (int64, error) {
+	return span(s.t, "HitStore.Count", func(d db.Interface) (int64, error) { return d.Hits().Count(short) })
+}
+
+func (s *hitStore) Counts(shorts []string) (map[string]int64, error) {
+	return span(s.t, "HitStore.Counts", func(d db.Interface) (map[string]int64, error) { return d.Hits().Counts(shorts) })
+}
+
+func (s *hitStore) Clicks(short string, since, until time.Time) ([]db.Hit, error) {
+	return span(s.t, "HitStore.Clicks", func(d db.Interface) ([]db.Hit, error) { return d.Hits().Clicks(short, since, until) })
+}
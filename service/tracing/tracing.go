@@ -0,0 +1,127 @@
+// Package tracing exports OpenTelemetry traces of tinyr: HTTP routes, the
+// cache and database stores, whose drivers trace their queries as children.
+// Until Setup installs an exporter, spans are not recorded.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/ml8/tinyr/service"
+
+// Exporters, for Config.
+const (
+	// OTLPExporter sends traces to a collector over OTLP/HTTP.
+	OTLPExporter = "otlp"
+	// StdoutExporter and FileExporter write traces as JSON, for development.
+	StdoutExporter = "stdout"
+	FileExporter   = "file"
+)
+
+type Config struct {
+	// Exporter is one of the exporters above; empty disables tracing.
+	Exporter string
+	// Endpoint is the collector URL for OTLP, e.g. http://localhost:4318. If
+	// empty, the OTEL_EXPORTER_OTLP_ENDPOINT environment variable is used.
+	Endpoint string
+	// File is the path the file exporter appends traces to.
+	File string
+	// SampleRatio is the fraction of new traces recorded. Traces started by a
+	// caller are recorded if the caller recorded them.
+	SampleRatio float64
+	// ServiceName names the service in traces.
+	ServiceName string
+}
+
+// Setup installs the exporter, and the W3C trace context and baggage
+// propagators, globally. Shutdown flushes and closes the exporter.
+func Setup(ctx context.Context, config Config) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	shutdown = func(context.Context) error { return nil }
+	if config.Exporter == "" {
+		return
+	}
+
+	var closer io.Closer
+	var exporter sdktrace.SpanExporter
+	switch config.Exporter {
+	case OTLPExporter:
+		var opts []otlptracehttp.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case StdoutExporter:
+		exporter, err = stdouttrace.New()
+	case FileExporter:
+		var f *os.File
+		if f, err = os.OpenFile(config.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+			return
+		}
+		closer = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		err = fmt.Errorf("unknown trace exporter %q, expected %v, %v or %v", config.Exporter, OTLPExporter, StdoutExporter, FileExporter)
+	}
+	if err != nil {
+		return
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", config.ServiceName)))
+	if err != nil {
+		return
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))))
+	otel.SetTracerProvider(provider)
+	shutdown = func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+	return
+}
+
+// Tracer returns the service's tracer.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Route traces requests to h, which serves route, continuing any trace in
+// their headers.
+func Route(route string, h http.Handler) http.Handler {
+	return otelhttp.NewHandler(h, route)
+}
+
+// Client returns c with its requests traced as children of their context.
+func Client(c *http.Client) *http.Client {
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	traced := *c
+	traced.Transport = otelhttp.NewTransport(transport)
+	return &traced
+}
@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/ml8/tinyr/service/db"
+)
+
+func record(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return recorder
+}
+
+func TestDB(t *testing.T) {
+	recorder := record(t)
+	d := DB(db.NewInMemory(), "memory")
+
+	ctx, parent := Tracer().Start(context.Background(), "request")
+	bound := db.WithContext(ctx, d)
+	if err := bound.Shorts().Create(db.ShortData{Short: "a", Long: "b"}); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if _, err := bound.Shorts().Get("missing"); err == nil {
+		t.Errorf("Should not find missing short")
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Incorrect number of spans %v", len(spans))
+	}
+	for i, name := range []string{"ShortStore.Create", "ShortStore.Get"} {
+		s := spans[i]
+		if s.Name() != name {
+			t.Errorf("Incorrect span %v, expected %v", s.Name(), name)
+		}
+		if s.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("%v should be a child of the request", s.Name())
+		}
+		// A missing short is an answer, not a failure.
+		if s.Status().Code == codes.Error {
+			t.Errorf("%v should not have failed", s.Name())
+		}
+	}
+	if len(spans[1].Events()) != 1 {
+		t.Errorf("The missing short should be recorded")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	recorder := record(t)
+	Setup(context.Background(), Config{})
+
+	var child string
+	h := Route("create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, s := Tracer().Start(r.Context(), "handler")
+		child = s.SpanContext().TraceID().String()
+		s.End()
+	}))
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest(http.MethodPost, "/create", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if child != traceID {
+		t.Errorf("Incoming trace should be continued, got %v", child)
+	}
+	if spans := recorder.Ended(); len(spans) != 2 || spans[1].Name() != "create" {
+		t.Errorf("Incorrect spans %v", spans)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	if _, err := Setup(context.Background(), Config{Exporter: "nope"}); err == nil {
+		t.Errorf("Should reject an unknown exporter")
+	}
+
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+	path := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(context.Background(), Config{Exporter: FileExporter, File: path, SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	_, s := Tracer().Start(context.Background(), "span")
+	s.End()
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatalf("Got error %v", err)
+	}
+	if b, err := os.ReadFile(path); err != nil || len(b) == 0 {
+		t.Errorf("Traces should be written to the file: %v", err)
+	}
+}
@@ -15,19 +15,154 @@ var IsLetter = regexp.MustCompile(`^[0-9a-zA-Z_\-]+$`).MatchString
 type LogEntry struct {
 	Host      string    `json:"Host"`
 	Timestamp time.Time `json:"Timestamp"`
+	Referrer  string    `json:"Referrer"`
+	UserAgent string    `json:"UserAgent"`
 }
 
 type ListEntry struct {
-	Short string `json:"Short"`
-	Long  string `json:"Long"`
-	Hits  int    `json:"Hits"`
+	Short     string    `json:"Short"`
+	Long      string    `json:"Long"`
+	Hits      int       `json:"Hits"`
+	ExpiresAt time.Time `json:"ExpiresAt"`
+	MaxHits   int64     `json:"MaxHits"`
+	Version   int       `json:"Version"`
+}
+
+type MineResponse struct {
+	Entries []ListEntry `json:"Entries"`
+	Next    string      `json:"Next,omitempty"`
 }
 
 type CreateRequest struct {
 	Short string `json:"Short"`
 	Long  string `json:"Long"`
+	// Optional expiry, either absolute or as a duration (e.g. "72h") from now.
+	ExpiresAt time.Time `json:"ExpiresAt"`
+	TTL       string    `json:"TTL"`
+	// Optional limit on redirects.
+	MaxHits int64 `json:"MaxHits"`
+	// How the rest of a request's path is used: "prefix" appends it to Long,
+	// "template" fills Long's placeholders {1}, {2}, ... with its segments. If
+	// empty, Long is a template iff it has placeholders.
+	Mode string `json:"Mode"`
+	// Optional group, by name, whose members share ownership, and users, by
+	// email, who may edit.
+	Group   string   `json:"Group"`
+	Editors []string `json:"Editors"`
+}
+
+// Expiry returns the absolute expiry time requested, or zero for none.
+func (r CreateRequest) Expiry(now time.Time) (expires time.Time, err error) {
+	expires = r.ExpiresAt
+	if r.TTL != "" {
+		var ttl time.Duration
+		if ttl, err = time.ParseDuration(r.TTL); err != nil || ttl <= 0 || !expires.IsZero() {
+			err = util.InvalidValueError(r.TTL)
+			return
+		}
+		expires = now.Add(ttl)
+	}
+	if !expires.IsZero() && !expires.After(now) {
+		err = util.InvalidValueError(expires.String())
+	}
+	return
 }
+
 type CreateResponse struct {
+	Short string `json:"Short"`
+	URL   string `json:"URL"`
+}
+
+type StatsRequest struct {
+	Short  string
+	Since  time.Time
+	Until  time.Time
+	Bucket time.Duration
+	Clicks bool
+}
+
+type StatsBucket struct {
+	Start time.Time `json:"Start"`
+	Hits  int       `json:"Hits"`
+}
+
+type StatsResponse struct {
+	Short   string        `json:"Short"`
+	Total   int64         `json:"Total"`
+	Buckets []StatsBucket `json:"Buckets"`
+	Clicks  []LogEntry    `json:"Clicks,omitempty"`
+}
+
+// UpdateRequest replaces the long url of an existing short, and any limits
+// and mode given. Omitted fields are unchanged; a zero ExpiresAt or empty TTL
+// removes the expiry, a zero MaxHits the hit limit, and an empty Mode infers
+// it from Long. The version may instead be given in an If-Match header.
+type UpdateRequest struct {
+	Short     string     `json:"Short"`
+	Long      string     `json:"Long"`
+	ExpiresAt *time.Time `json:"ExpiresAt"`
+	TTL       *string    `json:"TTL"`
+	MaxHits   *int64     `json:"MaxHits"`
+	Mode      *string    `json:"Mode"`
+	Version   *int       `json:"Version"`
+}
+
+type UpdateResponse struct {
+	Short   string `json:"Short"`
+	Version int    `json:"Version"`
+}
+
+// TransferRequest changes the ownership of a short. Omitted fields are
+// unchanged; an empty Group removes the group. The version may instead be
+// given in an If-Match header.
+type TransferRequest struct {
+	Short   string    `json:"Short"`
+	Owner   *string   `json:"Owner"`
+	Group   *string   `json:"Group"`
+	Editors *[]string `json:"Editors"`
+	Version *int      `json:"Version"`
+}
+
+// GroupRequest creates a group whose only member is its creator. Members are
+// added with a MemberRequest.
+type GroupRequest struct {
+	Name string `json:"Name"`
+}
+
+type MemberRequest struct {
+	Group string `json:"Group"`
+	Email string `json:"Email"`
+}
+
+type GroupEntry struct {
+	Name    string   `json:"Name"`
+	Members []string `json:"Members"`
+}
+
+// ImportResponse reports the outcome of an import, or what it would be for a
+// dry run.
+type ImportResponse struct {
+	DryRun      bool `json:"DryRun"`
+	Created     int  `json:"Created"`
+	Overwritten int  `json:"Overwritten"`
+	Skipped     int  `json:"Skipped"`
+	Failed      int  `json:"Failed"`
+	// Stopped is true if records after the last error were not read.
+	Stopped bool          `json:"Stopped"`
+	Errors  []ImportError `json:"Errors"`
+}
+
+// ImportError describes a record that was not imported. Row counts records
+// from 1, excluding any header.
+type ImportError struct {
+	Row   int    `json:"Row"`
+	Short string `json:"Short"`
+	Error string `json:"Error"`
+}
+
+// BackupResponse names the backup taken on the server.
+type BackupResponse struct {
+	Path string `json:"Path"`
 }
 
 type DeleteRequest struct {
@@ -42,8 +177,18 @@ func Parse[T any](r *http.Request, v T) (err error) {
 	return
 }
 
+// ValidShort is true for names of up to maxDepth slash-separated segments.
 func ValidShort(short string) (ok bool) {
-	return IsLetter(short)
+	segments := strings.Split(short, "/")
+	if len(segments) > maxDepth {
+		return false
+	}
+	for _, s := range segments {
+		if !IsLetter(s) {
+			return false
+		}
+	}
+	return true
 }
 
 func ValidUrl(url string) (err error) {
@@ -58,6 +58,27 @@ func GetIP(r *http.Request) string {
 	return r.RemoteAddr
 }
 
+// StatusCode maps an error to the HTTP status that describes it.
+func StatusCode(err error) int {
+	switch err.(type) {
+	case NoSuchKeyError:
+		return http.StatusNotFound
+	case InvalidValueError:
+		return http.StatusBadRequest
+	case AlreadyExistsError, VersionMismatchError:
+		return http.StatusConflict
+	}
+	switch err {
+	case PermissionDeniedError:
+		return http.StatusForbidden
+	case InvalidTokenError:
+		return http.StatusUnauthorized
+	case EmptyError:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func ErrorResponse(w http.ResponseWriter, code int, message string) {
 	JsonResponse(w, code, map[string]string{"error": message})
 }